@@ -0,0 +1,345 @@
+// Package acl implements topic access control lists for the mqtt server.
+//
+// The rules are loaded from a text file with one rule per line:
+//
+//	# rules for all clients
+//	allow read $SYS/broker/#
+//
+//	# rules for the user 'alice'
+//	user alice
+//	allow readwrite sensors/#
+//	deny  write     sensors/+/config
+//
+//	# rules for the client id 'dashboard'
+//	client dashboard
+//	allow read #
+//
+//	# back to rules for all clients
+//	all
+//	allow readwrite clients/%c/#
+//	allow read      users/%u/#
+//
+// A rule is 'allow' or 'deny', followed by 'read', 'write' or 'readwrite' and
+// a topic filter. In filters %u is replaced by the username and %c by the
+// client id of the client. Rules with %u do not apply to clients without
+// username, and a username or client id containing '/', '+' or '#' is never
+// substituted into an allow rule.
+//
+// For each client the rules of its client id are checked first, then the rules
+// of its username, then the rules for all clients, each in file order.
+// The first rule that matches decides. Without a matching rule, access is
+// denied.
+//
+// Publishing to a topic needs write access to that topic. Subscribing to a
+// filter needs read access to every topic the filter matches: a subscription
+// to 'a/#' is rejected if any rule before the allowing rule denies a part of
+// it, like 'deny read a/secret'.
+package acl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/tools"
+	"github.com/j-forster/mqtt/topics"
+)
+
+// ErrDenied is returned by the Publish hook if the client has no write access.
+// It wraps mqtt.ErrNotAuthorized.
+var ErrDenied = fmt.Errorf("acl: access denied: %w", mqtt.ErrNotAuthorized)
+
+// access rights
+const (
+	Read      = 1
+	Write     = 2
+	ReadWrite = Read | Write
+)
+
+// Rule allows or denies Read, Write or ReadWrite access to a topic filter.
+type Rule struct {
+	Allow  bool
+	Access int
+	Filter string
+}
+
+type ruleset struct {
+	all     []Rule
+	users   map[string][]Rule
+	clients map[string][]Rule
+}
+
+// ACL is a set of access rules. It implements the Publish and Grant hooks
+// of mqtt handlers and can be added to a mqtt.Chain.
+type ACL struct {
+	path string
+
+	mu    sync.RWMutex
+	rules *ruleset
+}
+
+// Load reads the rules from a file.
+func Load(path string) (*ACL, error) {
+
+	acl := &ACL{path: path}
+	if err := acl.Reload(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// New creates an ACL with rules for all clients. It can not be reloaded.
+func New(rules ...Rule) (*ACL, error) {
+
+	for _, r := range rules {
+		if !topics.ValidFilter(r.Filter) {
+			return nil, fmt.Errorf("acl: invalid topic filter %q", r.Filter)
+		}
+	}
+	return &ACL{rules: &ruleset{all: rules}}, nil
+}
+
+// Parse reads the rules from r. An ACL created this way can not be reloaded.
+func Parse(r io.Reader) (*ACL, error) {
+
+	rules, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return &ACL{rules: rules}, nil
+}
+
+// Reload reads the rules file again. The current rules are kept if the file
+// has errors.
+func (acl *ACL) Reload() error {
+
+	if acl.path == "" {
+		return errors.New("acl: no rules file")
+	}
+
+	file, err := os.Open(acl.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rules, err := parse(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", acl.path, err)
+	}
+
+	acl.mu.Lock()
+	acl.rules = rules
+	acl.mu.Unlock()
+	return nil
+}
+
+// Watch checks the rules file for changes at the given interval and reloads
+// it. Reload errors are logged. Call the returned function to stop watching.
+func (acl *ACL) Watch(interval time.Duration, log mqtt.Logger) (stop func()) {
+
+	return tools.WatchFile(acl.path, interval, func() {
+		if err := acl.Reload(); err != nil {
+			log.Warn("acl reload failed", "path", acl.path, "err", err)
+		} else {
+			log.Info("acl reloaded", "path", acl.path)
+		}
+	})
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// CanWrite reports whether a client may publish to the topic.
+func (acl *ACL) CanWrite(username, clientID, topic string) bool {
+
+	t := strings.Split(topic, "/")
+	for _, r := range acl.match(username, clientID, Write) {
+		if filter, ok := r.expand(username, clientID); ok {
+			if topics.MatchLevels(filter, t) {
+				return r.Allow
+			}
+		} else if !r.Allow {
+			return false
+		}
+	}
+	return false
+}
+
+// CanRead reports whether a client may subscribe to the topic filter,
+// that is whether it may read every topic matched by the filter.
+func (acl *ACL) CanRead(username, clientID, filter string) bool {
+
+	f := strings.Split(filter, "/")
+	for _, r := range acl.match(username, clientID, Read) {
+		rf, ok := r.expand(username, clientID)
+		if !ok {
+			if !r.Allow {
+				return false
+			}
+			continue
+		}
+
+		if r.Allow {
+			if covers(rf, f) {
+				return true
+			}
+			// a part of the filter might be allowed,
+			// but we have to check the rest with the next rules
+		} else {
+			if intersects(rf, f) {
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// match returns the rules for a client in the order they are checked.
+func (acl *ACL) match(username, clientID string, access int) []Rule {
+
+	acl.mu.RLock()
+	rules := acl.rules
+	acl.mu.RUnlock()
+
+	var list []Rule
+	add := func(rules []Rule) {
+		for _, r := range rules {
+			if r.Access&access != 0 {
+				list = append(list, r)
+			}
+		}
+	}
+	add(rules.clients[clientID])
+	if username != "" {
+		add(rules.users[username])
+	}
+	add(rules.all)
+	return list
+}
+
+// expand replaces %u and %c in the rule filter.
+// It returns false if the rule can not be applied to this client.
+func (r *Rule) expand(username, clientID string) ([]string, bool) {
+
+	f := strings.Split(r.Filter, "/")
+	for i, level := range f {
+		if !strings.Contains(level, "%") {
+			continue
+		}
+		if strings.Contains(level, "%u") {
+			if !safe(username) {
+				return nil, false
+			}
+			level = strings.ReplaceAll(level, "%u", username)
+		}
+		if strings.Contains(level, "%c") {
+			if !safe(clientID) {
+				return nil, false
+			}
+			level = strings.ReplaceAll(level, "%c", clientID)
+		}
+		f[i] = level
+	}
+	return f, true
+}
+
+func safe(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "/+#")
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Publish implements the mqtt publish hook.
+func (acl *ACL) Publish(ctx *mqtt.Context, msg *mqtt.Message) error {
+
+	if !acl.CanWrite(ctx.Username, ctx.ClientID, msg.Topic) {
+		return ErrDenied
+	}
+	return nil
+}
+
+// Grant implements the mqtt grant hook.
+func (acl *ACL) Grant(ctx *mqtt.Context, topic string, qos byte) byte {
+
+	if !acl.CanRead(ctx.Username, ctx.ClientID, topic) {
+		return mqtt.SUBSCRIBE_FAILURE
+	}
+	return qos
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func parse(r io.Reader) (*ruleset, error) {
+
+	rules := &ruleset{
+		users:   make(map[string][]Rule),
+		clients: make(map[string][]Rule),
+	}
+	// the current section: "all", "user" or "client" and its name
+	section, name := "all", ""
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+
+		switch fields[0] {
+		case "all":
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("line %d: 'all' has no arguments", n)
+			}
+			section, name = "all", ""
+			continue
+
+		case "user", "client":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: '%s' needs one name", n, fields[0])
+			}
+			section, name = fields[0], fields[1]
+			continue
+
+		case "allow", "deny":
+		default:
+			return nil, fmt.Errorf("line %d: unknown keyword %q", n, fields[0])
+		}
+
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected '%s read|write|readwrite <filter>'", n, fields[0])
+		}
+
+		r := Rule{Allow: fields[0] == "allow", Filter: fields[2]}
+		switch fields[1] {
+		case "read":
+			r.Access = Read
+		case "write":
+			r.Access = Write
+		case "readwrite":
+			r.Access = ReadWrite
+		default:
+			return nil, fmt.Errorf("line %d: unknown access %q", n, fields[1])
+		}
+		if !topics.ValidFilter(r.Filter) {
+			return nil, fmt.Errorf("line %d: invalid topic filter %q", n, r.Filter)
+		}
+
+		switch section {
+		case "user":
+			rules.users[name] = append(rules.users[name], r)
+		case "client":
+			rules.clients[name] = append(rules.clients[name], r)
+		default:
+			rules.all = append(rules.all, r)
+		}
+	}
+	return rules, scanner.Err()
+}
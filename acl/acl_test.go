@@ -0,0 +1,94 @@
+package acl
+
+import (
+	"strings"
+	"testing"
+)
+
+const rules = `
+# all clients
+allow read $SYS/broker/#
+
+user alice
+deny  read      sensors/secret/#
+allow readwrite sensors/#
+deny  write     sensors/+/config
+
+client dashboard
+allow read #
+
+all
+allow readwrite clients/%c/#
+allow read      users/%u/#
+`
+
+func TestACL(t *testing.T) {
+
+	acl, err := Parse(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		access           int
+		username, client string
+		topic            string
+		ok               bool
+	}{
+		{Write, "alice", "c1", "sensors/a/temp", true},
+		{Write, "alice", "c1", "sensors/a/config", true}, // the allow rule comes first
+		{Write, "bob", "c1", "sensors/a/temp", false},
+		{Read, "alice", "c1", "sensors/a/temp", true},
+		{Read, "alice", "c1", "sensors/a/#", true},
+		{Read, "alice", "c1", "sensors/+/temp", false}, // includes sensors/secret/temp
+		{Read, "alice", "c1", "sensors/#", false},      // includes sensors/secret
+		{Read, "alice", "c1", "sensors/secret/x", false},
+		{Read, "alice", "c1", "#", false},
+
+		{Read, "", "dashboard", "#", true},
+		{Read, "", "dashboard", "$SYS/broker/load", true},
+		{Read, "", "dashboard", "$SYS/other", false}, // '#' does not match '$' topics
+		{Write, "", "dashboard", "a", false},
+		{Read, "", "c1", "$SYS/broker/#", true},
+		{Read, "", "c1", "$SYS/#", false},
+
+		{Write, "", "c1", "clients/c1/x", true},
+		{Read, "", "c1", "clients/c1/#", true},
+		{Read, "", "c1", "clients/#", false},
+		{Read, "", "c1", "clients/+/x", false},
+		{Write, "", "c2", "clients/c1/x", false},
+		{Write, "", "+", "clients/x/y", false}, // no wildcards from client ids
+		{Read, "", "#", "clients/#", false},
+		{Read, "alice", "c1", "users/alice/x", true},
+		{Read, "", "c1", "users//x", false}, // no username
+	}
+
+	for _, test := range tests {
+		var ok bool
+		if test.access == Read {
+			ok = acl.CanRead(test.username, test.client, test.topic)
+		} else {
+			ok = acl.CanWrite(test.username, test.client, test.topic)
+		}
+		if ok != test.ok {
+			t.Errorf("access %d for %q/%q to %q: got %v, want %v",
+				test.access, test.username, test.client, test.topic, ok, test.ok)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+
+	for _, text := range []string{
+		"allow read",
+		"allow all a/b",
+		"permit read a/b",
+		"allow read a/#/b",
+		"allow read a/b+",
+		"user",
+	} {
+		if _, err := Parse(strings.NewReader(text)); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+}
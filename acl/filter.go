@@ -0,0 +1,75 @@
+package acl
+
+import (
+	"github.com/j-forster/mqtt/topics"
+)
+
+// covers reports whether every topic matched by the filter sub is also
+// matched by the filter rule.
+func covers(rule, sub []string) bool {
+
+	for i, r := range rule {
+		if r == "#" {
+			return len(sub) <= i || topics.Wildcard(i, sub[i])
+		}
+		if i == len(sub) {
+			return false
+		}
+		switch sub[i] {
+		case "#":
+			return false // rule is not '#' here
+		case "+":
+			if r != "+" {
+				return false
+			}
+		default:
+			if r == "+" {
+				if !topics.Wildcard(i, sub[i]) {
+					return false
+				}
+			} else if r != sub[i] {
+				return false
+			}
+		}
+	}
+	return len(rule) == len(sub)
+}
+
+// intersects reports whether there is a topic matched by both filters.
+func intersects(a, b []string) bool {
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x, y := a[i], b[i]
+		xw := x == "+" || x == "#"
+		yw := y == "+" || y == "#"
+
+		switch {
+		case xw && yw:
+		case xw:
+			if !topics.Wildcard(i, y) {
+				return false
+			}
+		case yw:
+			if !topics.Wildcard(i, x) {
+				return false
+			}
+		case x != y:
+			return false
+		}
+
+		if x == "#" || y == "#" {
+			return true
+		}
+	}
+
+	// 'a/#' also matches 'a'
+	switch {
+	case len(a) == len(b):
+		return true
+	case len(a) == len(b)+1:
+		return a[len(b)] == "#"
+	case len(b) == len(a)+1:
+		return b[len(a)] == "#"
+	}
+	return false
+}
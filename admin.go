@@ -0,0 +1,427 @@
+package mqtt
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ClientInfo describes a connected client, see Server.Clients.
+type ClientInfo struct {
+	ClientID        string `json:"client_id"`
+	RemoteAddr      string `json:"remote_addr,omitempty"`
+	Username        string `json:"username,omitempty"`
+	ProtocolVersion byte   `json:"protocol_version"`
+	CleanSession    bool   `json:"clean_session"`
+	// KeepAlive in seconds
+	KeepAlive int `json:"keepalive"`
+	// Subscriptions are the topic filters with the granted qos.
+	Subscriptions map[string]byte `json:"subscriptions"`
+	// Inflight is the number of unacknowledged messages sent to the client.
+	Inflight int `json:"inflight"`
+}
+
+// SessionInfo describes the stored session of an offline client,
+// see Server.Sessions.
+type SessionInfo struct {
+	ClientID      string          `json:"client_id"`
+	Subscriptions map[string]byte `json:"subscriptions"`
+	// Queued is the number of messages waiting for the client.
+	Queued int `json:"queued"`
+}
+
+// Clients returns all connected clients, sorted by client id.
+func (svr *Server) Clients() []ClientInfo {
+
+	ctxs := svr.contexts("", true)
+	clients := make([]ClientInfo, len(ctxs))
+	subs := make([]map[string]*Subscription, len(ctxs))
+
+	for i, ctx := range ctxs {
+
+		// the subscriptions are changed while handling packets
+		ctx.rmu.Lock()
+		subs[i] = make(map[string]*Subscription, len(ctx.subs))
+		for topic, sub := range ctx.subs {
+			subs[i][topic] = sub
+		}
+		ctx.rmu.Unlock()
+
+		ctx.wmu.Lock()
+		inflight := len(ctx.inflight)
+		ctx.wmu.Unlock()
+
+		clients[i] = ClientInfo{
+			ClientID:        ctx.ClientID,
+			Username:        ctx.Username,
+			ProtocolVersion: ctx.ProtocolVersion,
+			CleanSession:    ctx.CleanSession,
+			KeepAlive:       int(ctx.KeepAlive.Seconds()),
+			Inflight:        inflight,
+		}
+		if ctx.RemoteAddr != nil {
+			clients[i].RemoteAddr = ctx.RemoteAddr.String()
+		}
+	}
+
+	// the granted qos is changed by the Run goroutine
+	svr.do(func() {
+		for i := range clients {
+			clients[i].Subscriptions = subscriptionInfo(subs[i])
+		}
+	})
+	return clients
+}
+
+// Sessions returns the stored sessions of offline clients, sorted by client id.
+func (svr *Server) Sessions() []SessionInfo {
+
+	svr.smu.Lock()
+	sessions := make([]SessionInfo, 0, len(svr.sessions))
+	subs := make([]map[string]*Subscription, 0, len(svr.sessions))
+	for _, ctx := range svr.sessions {
+
+		ctx.wmu.Lock()
+		queued := len(ctx.queue)
+		ctx.wmu.Unlock()
+
+		sessions = append(sessions, SessionInfo{ClientID: ctx.ClientID, Queued: queued})
+		subs = append(subs, ctx.subs)
+	}
+	svr.smu.Unlock()
+
+	svr.do(func() {
+		for i := range sessions {
+			sessions[i].Subscriptions = subscriptionInfo(subs[i])
+		}
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ClientID < sessions[j].ClientID
+	})
+	return sessions
+}
+
+func subscriptionInfo(subs map[string]*Subscription) map[string]byte {
+
+	info := make(map[string]byte, len(subs))
+	for topic, sub := range subs {
+		info[topic] = sub.qos
+	}
+	return info
+}
+
+// connected returns the connected clients with exactly this client id.
+func (svr *Server) connected(clientID string) []*Context {
+	return svr.contexts(clientID, false)
+}
+
+// contexts returns the connected clients with the client id, or all
+// connected clients.
+func (svr *Server) contexts(clientID string, all bool) []*Context {
+
+	svr.cmu.Lock()
+	ctxs := make([]*Context, 0, len(svr.clients))
+	for ctx := range svr.clients {
+		if all || ctx.ClientID == clientID {
+			ctxs = append(ctxs, ctx)
+		}
+	}
+	svr.cmu.Unlock()
+
+	sort.Slice(ctxs, func(i, j int) bool {
+		return ctxs[i].ClientID < ctxs[j].ClientID
+	})
+	return ctxs
+}
+
+// Kick closes the connections of all clients with the client id, as
+// Context.Kick does. It returns the number of closed connections.
+func (svr *Server) Kick(clientID string) int {
+
+	ctxs := svr.connected(clientID)
+	for _, ctx := range ctxs {
+		ctx.Log().Info("client kicked")
+		ctx.Kick()
+	}
+	return len(ctxs)
+}
+
+// Ban rejects the client id at CONNECT with ErrBanned until Unban is called,
+// and kicks connected clients with this id. Bans are not persisted.
+func (svr *Server) Ban(clientID string) {
+
+	svr.cmu.Lock()
+	svr.banned[clientID] = true
+	svr.cmu.Unlock()
+
+	svr.log().Info("client banned", "client", clientID)
+	svr.Kick(clientID)
+}
+
+// Unban removes a ban of Ban.
+func (svr *Server) Unban(clientID string) {
+
+	svr.cmu.Lock()
+	delete(svr.banned, clientID)
+	svr.cmu.Unlock()
+}
+
+// Banned reports whether the client id has been banned.
+func (svr *Server) Banned(clientID string) bool {
+
+	svr.cmu.Lock()
+	defer svr.cmu.Unlock()
+	return svr.banned[clientID]
+}
+
+// Bans returns the banned client ids, sorted.
+func (svr *Server) Bans() []string {
+
+	svr.cmu.Lock()
+	bans := make([]string, 0, len(svr.banned))
+	for clientID := range svr.banned {
+		bans = append(bans, clientID)
+	}
+	svr.cmu.Unlock()
+
+	sort.Strings(bans)
+	return bans
+}
+
+// Topics returns the topic tree with the number of subscriptions per topic.
+func (svr *Server) Topics() (info *TopicInfo) {
+
+	svr.do(func() {
+		info = topicInfo(svr.subscriptions, svr.retained)
+	})
+	return info
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// AdminHandler serves a REST API to inspect and manage the server.
+// Requests must have the header "Authorization: Bearer <token>".
+// With an empty token all requests are rejected.
+//
+//	GET    /clients               connected clients, see ClientInfo
+//	GET    /clients/{id}          clients with this client id
+//	POST   /clients/{id}/kick     close the connection, see Kick
+//	POST   /clients/{id}/ban      reject the client id, see Ban
+//	GET    /bans                  banned client ids
+//	DELETE /bans/{id}             remove a ban
+//	GET    /sessions              stored sessions, see SessionInfo
+//	GET    /topics                the topic tree, see TopicInfo
+//	GET    /retained              all retained messages
+//	GET    /retained/{topic}      the retained message of a topic
+//	PUT    /retained/{topic}      retain the request body, ?qos=0|1|2
+//	DELETE /retained/{topic}      clear the retained message
+//
+// Retained messages are JSON objects with topic, qos and the base64
+// encoded payload.
+func (svr *Server) AdminHandler(token string) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mqtt"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		resource, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		switch resource {
+		case "clients":
+			svr.adminClients(w, r, rest)
+		case "bans":
+			svr.adminBans(w, r, rest)
+		case "sessions":
+			if !allow(w, r, rest == "", http.MethodGet) {
+				return
+			}
+			writeJSON(w, svr.Sessions())
+		case "topics":
+			if !allow(w, r, rest == "", http.MethodGet) {
+				return
+			}
+			writeJSON(w, svr.Topics())
+		case "retained":
+			svr.adminRetained(w, r, rest)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// allow answers requests to unknown paths or with other methods.
+func allow(w http.ResponseWriter, r *http.Request, found bool, methods ...string) bool {
+
+	if !found {
+		http.NotFound(w, r)
+		return false
+	}
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func (svr *Server) adminClients(w http.ResponseWriter, r *http.Request, path string) {
+
+	if path == "" {
+		if allow(w, r, true, http.MethodGet) {
+			writeJSON(w, svr.Clients())
+		}
+		return
+	}
+
+	id, action, _ := strings.Cut(path, "/")
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch action {
+	case "":
+		if !allow(w, r, true, http.MethodGet) {
+			return
+		}
+		var clients []ClientInfo
+		for _, c := range svr.Clients() {
+			if c.ClientID == id {
+				clients = append(clients, c)
+			}
+		}
+		if len(clients) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, clients)
+
+	case "kick":
+		if !allow(w, r, true, http.MethodPost) {
+			return
+		}
+		if svr.Kick(id) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "ban":
+		if !allow(w, r, true, http.MethodPost) {
+			return
+		}
+		svr.Ban(id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (svr *Server) adminBans(w http.ResponseWriter, r *http.Request, id string) {
+
+	if id == "" {
+		if allow(w, r, true, http.MethodGet) {
+			writeJSON(w, svr.Bans())
+		}
+		return
+	}
+	if allow(w, r, true, http.MethodDelete) {
+		svr.Unban(id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (svr *Server) adminRetained(w http.ResponseWriter, r *http.Request, topic string) {
+
+	if topic == "" {
+		if !allow(w, r, true, http.MethodGet) {
+			return
+		}
+		msgs := svr.Retained()
+		retained := make([]retainedMessage, len(msgs))
+		for i, msg := range msgs {
+			retained[i] = retainedMessage{msg.Topic, msg.QoS, msg.Buf}
+		}
+		sort.Slice(retained, func(i, j int) bool {
+			return retained[i].Topic < retained[j].Topic
+		})
+		writeJSON(w, retained)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		for _, msg := range svr.Retained() {
+			if msg.Topic == topic {
+				writeJSON(w, retainedMessage{msg.Topic, msg.QoS, msg.Buf})
+				return
+			}
+		}
+		http.NotFound(w, r)
+
+	case http.MethodPut:
+		if strings.ContainsAny(topic, "+#") {
+			http.Error(w, "topic must not contain wildcards", http.StatusBadRequest)
+			return
+		}
+		var qos byte
+		if q := r.URL.Query().Get("qos"); q != "" {
+			n, err := strconv.Atoi(q)
+			if err != nil || n < 0 || n > 2 {
+				http.Error(w, "invalid qos", http.StatusBadRequest)
+				return
+			}
+			qos = byte(n)
+		}
+		payload, err := io.ReadAll(io.LimitReader(r.Body, int64(svr.Limits.maxMessageLength())))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(payload) == 0 {
+			http.Error(w, "empty payload, use DELETE to clear a retained message", http.StatusBadRequest)
+			return
+		}
+		svr.Retain(&Message{Topic: topic, Buf: payload, QoS: qos, Retain: true})
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		svr.Retain(&Message{Topic: topic, Retain: true})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		allow(w, r, true, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// ListenAdmin serves the AdminHandler at http://addr/.
+// It blocks until the listener fails.
+func (svr *Server) ListenAdmin(addr, token string) error {
+
+	svr.log().Info("admin api listening", "addr", addr)
+	return http.ListenAndServe(addr, svr.AdminHandler(token))
+}
+
+type retainedMessage struct {
+	Topic   string `json:"topic"`
+	QoS     byte   `json:"qos"`
+	Payload []byte `json:"payload"`
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
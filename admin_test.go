@@ -0,0 +1,219 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// request sends a request with the bearer token to the handler.
+func request(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+
+	server, _ := newTestServer(t, nil)
+	h := server.AdminHandler("secret")
+
+	for _, header := range []string{"", "Bearer", "Bearer ", "Bearer wrong", "Basic secret", "bearer secret"} {
+		r := httptest.NewRequest(http.MethodGet, "/clients", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q: %d", header, w.Code)
+		}
+	}
+	if w := request(h, http.MethodGet, "/clients", "secret", ""); w.Code != http.StatusOK {
+		t.Errorf("valid token: %d", w.Code)
+	}
+
+	// an empty token rejects all requests
+	h = server.AdminHandler("")
+	if w := request(h, http.MethodGet, "/clients", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("empty token: %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/clients", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("empty token: %d", w.Code)
+	}
+}
+
+func TestAdminClients(t *testing.T) {
+
+	server, _ := newTestServer(t, nil)
+	h := server.AdminHandler("secret")
+
+	c := dial(t, server)
+	c.write(connectPacket)
+	c.connack()
+	c.subscribe("a/#", 1)
+
+	w := request(h, http.MethodGet, "/clients/client", "secret", "")
+	var clients []ClientInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &clients); err != nil {
+		t.Fatal(w.Code, err)
+	}
+	if len(clients) != 1 || clients[0].ClientID != "client" || clients[0].Subscriptions["a/#"] != 1 {
+		t.Fatalf("clients %+v", clients)
+	}
+	if w := request(h, http.MethodGet, "/clients/nobody", "secret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown client: %d", w.Code)
+	}
+	if w := request(h, http.MethodGet, "/clients/client/kick", "secret", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET kick: %d", w.Code)
+	}
+	if w := request(h, http.MethodPost, "/clients/nobody/kick", "secret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("kick unknown client: %d", w.Code)
+	}
+
+	if w := request(h, http.MethodPost, "/clients/client/kick", "secret", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("kick: %d", w.Code)
+	}
+	c.closed()
+
+	// banned clients are kicked and rejected
+	c = dial(t, server)
+	c.write(connectPacket)
+	c.connack()
+	if w := request(h, http.MethodPost, "/clients/client/ban", "secret", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("ban: %d", w.Code)
+	}
+	c.closed()
+	if w := request(h, http.MethodGet, "/bans", "secret", ""); strings.TrimSpace(w.Body.String()) != "[\n  \"client\"\n]" {
+		t.Fatalf("bans %s", w.Body)
+	}
+	c = dial(t, server)
+	c.write(connectPacket)
+	if code := c.connack(); code != NOT_AUTHORIZED {
+		t.Fatalf("banned client: code %d", code)
+	}
+
+	if w := request(h, http.MethodDelete, "/bans/client", "secret", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("unban: %d", w.Code)
+	}
+	c = dial(t, server)
+	c.write(connectPacket)
+	if code := c.connack(); code != ACCEPTED {
+		t.Fatalf("unbanned client: code %d", code)
+	}
+}
+
+func TestAdminEmptyClientID(t *testing.T) {
+
+	server, _ := newTestServer(t, nil)
+	h := server.AdminHandler("secret")
+
+	a := dial(t, server)
+	a.write(connectAs("a", 0x02))
+	a.connack()
+	b := dial(t, server)
+	b.write(connectAs("b", 0x02))
+	b.connack()
+
+	for _, path := range []string{"/clients//kick", "/clients//ban"} {
+		if w := request(h, http.MethodPost, path, "secret", ""); w.Code != http.StatusNotFound {
+			t.Errorf("POST %s: %d", path, w.Code)
+		}
+	}
+	if n := server.Kick(""); n != 0 {
+		t.Errorf("Kick(\"\") closed %d connections", n)
+	}
+	if n := len(server.Clients()); n != 2 {
+		t.Fatalf("%d clients", n)
+	}
+	if bans := server.Bans(); len(bans) != 0 {
+		t.Fatalf("bans %q", bans)
+	}
+	a.nothing()
+	b.nothing()
+}
+
+func TestAdminRetained(t *testing.T) {
+
+	server, _ := newTestServer(t, nil)
+	h := server.AdminHandler("secret")
+
+	if w := request(h, http.MethodPut, "/retained/a/b?qos=1", "secret", "hello"); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	for _, path := range []string{"/retained/a/+?qos=1", "/retained/a/b?qos=3", "/retained/a/b?qos=x"} {
+		if w := request(h, http.MethodPut, path, "secret", "hello"); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: %d", path, w.Code)
+		}
+	}
+	if w := request(h, http.MethodPut, "/retained/a/c", "secret", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT without payload: %d", w.Code)
+	}
+
+	var msgs []retainedMessage
+	w := request(h, http.MethodGet, "/retained", "secret", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &msgs); err != nil {
+		t.Fatal(w.Code, err)
+	}
+	if len(msgs) != 1 || msgs[0].Topic != "a/b" || msgs[0].QoS != 1 || string(msgs[0].Payload) != "hello" {
+		t.Fatalf("retained %+v", msgs)
+	}
+	var msg retainedMessage
+	w = request(h, http.MethodGet, "/retained/a/b", "secret", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil || msg.Topic != "a/b" || string(msg.Payload) != "hello" {
+		t.Fatalf("GET: %d %s", w.Code, w.Body)
+	}
+	if w := request(h, http.MethodPost, "/retained/a/b", "secret", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d", w.Code)
+	}
+
+	if w := request(h, http.MethodDelete, "/retained/a/b", "secret", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d", w.Code)
+	}
+	if w := request(h, http.MethodGet, "/retained/a/b", "secret", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("GET after DELETE: %d", w.Code)
+	}
+	if n := len(server.Retained()); n != 0 {
+		t.Fatalf("%d retained messages", n)
+	}
+}
+
+func TestAdminTopics(t *testing.T) {
+
+	// newTestServer subscribes to '#'
+	server, _ := newTestServer(t, nil)
+	h := server.AdminHandler("secret")
+
+	if w := request(h, http.MethodPut, "/retained/a/b", "secret", "hello"); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	var info TopicInfo
+	w := request(h, http.MethodGet, "/topics", "secret", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(w.Code, err)
+	}
+	if len(info.Children) != 2 {
+		t.Fatalf("topics %+v", info)
+	}
+	if c := info.Children[0]; c.Name != "#" || c.Subscriptions != 1 || c.Retained {
+		t.Errorf("# %+v", c)
+	}
+	a := info.Children[1]
+	if a.Name != "a" || a.Subscriptions != 0 || len(a.Children) != 1 {
+		t.Fatalf("a %+v", a)
+	}
+	if b := a.Children[0]; b.Name != "b" || !b.Retained || b.Subscriptions != 0 {
+		t.Errorf("a/b %+v", b)
+	}
+}
@@ -0,0 +1,183 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Asynchronous variants of the Connect and Publish hooks for handlers that
+// ask slow backends. If the handler implements one of them, it is used
+// instead of the synchronous hook. The handler must call done exactly once
+// with its decision, from any goroutine. Without a decision within the
+// ConnectTimeout or PublishTimeout of the server, the connection or message
+// is rejected with ErrHookTimeout.
+//
+// The CONNACK is sent when the connect decision arrives. Packets the client
+// sends meanwhile are queued and processed afterwards. Published messages are
+// routed in the order the client sent them, when their decisions arrive.
+type (
+	AsyncConnectHandler interface {
+		ConnectAsync(ctx *Context, username, password string, done func(error))
+	}
+	AsyncPublishHandler interface {
+		PublishAsync(ctx *Context, msg *Message, done func(error))
+	}
+)
+
+// ErrHookTimeout is used when an asynchronous hook did not decide in time.
+var ErrHookTimeout = errors.New("handler timeout")
+
+// ErrTooManyPending is used when a client sends too many packets while
+// waiting for the connect decision, or too many messages while waiting for
+// the publish decisions.
+var ErrTooManyPending = errors.New("too many pending packets")
+
+// maximum number of packets or messages waiting for a decision per client
+const maxPending = 1000
+
+// default timeouts for asynchronous hooks
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultPublishTimeout = 10 * time.Second
+)
+
+// a packet received while waiting for the connect decision
+type packet struct {
+	fh  FixedHeader
+	buf []byte
+}
+
+// a message waiting for the publish decision
+type pendingPublish struct {
+	msg    *Message
+	result chan error
+}
+
+// decide returns a done function for asynchronous hooks. The first call of
+// done, or the timeout, calls fn in a new goroutine. Later calls are ignored.
+func decide(timeout time.Duration, fn func(error)) (done func(error)) {
+
+	var mu sync.Mutex
+	var timer *time.Timer
+	decided := false
+
+	done = func(err error) {
+		mu.Lock()
+		if decided {
+			mu.Unlock()
+			return
+		}
+		decided = true
+		if timer != nil {
+			timer.Stop()
+		}
+		mu.Unlock()
+
+		go fn(err)
+	}
+
+	if timeout > 0 {
+		mu.Lock()
+		timer = time.AfterFunc(timeout, func() {
+			done(ErrHookTimeout)
+		})
+		mu.Unlock()
+	}
+	return done
+}
+
+func (svr *Server) asyncConnect() (AsyncConnectHandler, bool) {
+
+	if chain, ok := svr.handler.(*Chain); ok && !chain.hasAsyncConnect {
+		return nil, false
+	}
+	h, ok := svr.handler.(AsyncConnectHandler)
+	return h, ok
+}
+
+func (svr *Server) asyncPublish() (AsyncPublishHandler, bool) {
+
+	if chain, ok := svr.handler.(*Chain); ok && !chain.hasAsyncPublish {
+		return nil, false
+	}
+	h, ok := svr.handler.(AsyncPublishHandler)
+	return h, ok
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// connectAsync asks the asynchronous connect hook. Packets are queued until
+// the decision arrives.
+func (ctx *Context) connectAsync(h AsyncConnectHandler, username, password string, usernameFlag bool) {
+
+	ctx.setState(AUTHENTICATING)
+
+	h.ConnectAsync(ctx, username, password, decide(ctx.server.ConnectTimeout, func(err error) {
+
+		defer ctx.recoverPanic()
+		ctx.rmu.Lock()
+		defer ctx.rmu.Unlock()
+
+		ctx.connected(username, usernameFlag, err)
+
+		pending := ctx.pending
+		ctx.pending = nil
+		for _, p := range pending {
+			if !ctx.Alive() {
+				return
+			}
+			ctx.handle(nil, &p.fh, p.buf)
+		}
+	}))
+}
+
+// publishAsync asks the asynchronous publish hook. The message is routed
+// when the decisions of all previous messages of this client have arrived.
+func (ctx *Context) publishAsync(h AsyncPublishHandler, msg *Message) {
+
+	p := pendingPublish{msg, make(chan error, 1)}
+
+	ctx.dmu.Lock()
+	full := len(ctx.decisions) >= maxPending
+	if !full {
+		ctx.decisions = append(ctx.decisions, p)
+	}
+	start := !full && !ctx.deciding
+	if start {
+		ctx.deciding = true
+	}
+	ctx.dmu.Unlock()
+
+	if full {
+		ctx.server.drop(ctx, msg, ErrTooManyPending)
+		return
+	}
+
+	h.PublishAsync(ctx, msg, decide(ctx.server.PublishTimeout, func(err error) {
+		p.result <- err
+	}))
+
+	if start {
+		go ctx.routeDecided()
+	}
+}
+
+// routeDecided routes the pending messages in order, as their decisions arrive.
+func (ctx *Context) routeDecided() {
+
+	defer ctx.recoverPanic()
+	for {
+		ctx.dmu.Lock()
+		if len(ctx.decisions) == 0 {
+			ctx.deciding = false
+			ctx.dmu.Unlock()
+			return
+		}
+		p := ctx.decisions[0]
+		ctx.decisions = ctx.decisions[1:]
+		ctx.dmu.Unlock()
+
+		ctx.server.route(ctx, p.msg, <-p.result)
+	}
+}
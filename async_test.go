@@ -0,0 +1,64 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// heldPublish holds the decisions of the asynchronous publish hook until the
+// test makes them.
+type heldPublish struct {
+	decisions chan func(error)
+	drops     chan error
+}
+
+func (h *heldPublish) PublishAsync(ctx *Context, msg *Message, done func(error)) {
+	h.decisions <- done
+}
+
+func (h *heldPublish) Drop(ctx *Context, msg *Message, reason error) {
+	h.drops <- reason
+}
+
+func TestCloseWithPendingDecision(t *testing.T) {
+
+	h := &heldPublish{make(chan func(error), 1), make(chan error, 10)}
+	server := NewServer(nil, NewChain(h))
+	stopped := make(chan struct{})
+	go func() {
+		server.Run()
+		close(stopped)
+	}()
+
+	c := dial(t, server)
+	c.write(connectPacket, publishPacket)
+	c.connack()
+
+	var done func(error)
+	select {
+	case done = <-h.decisions:
+	case <-time.After(time.Second):
+		t.Fatal("publish hook not called")
+	}
+
+	server.Close()
+	<-stopped
+
+	// the decision arrives after the Run goroutine has stopped
+	done(nil)
+	select {
+	case reason := <-h.drops:
+		if !errors.Is(reason, ErrServerClosing) {
+			t.Fatalf("dropped: %v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not dropped")
+	}
+
+	// nothing waits for the Run goroutine
+	server.Retain(&Message{Topic: "a/b", Buf: []byte("hello")})
+	if msgs := server.Retained(); len(msgs) != 0 {
+		t.Fatalf("%d retained messages", len(msgs))
+	}
+}
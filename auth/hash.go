@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hash algorithms for HashPassword.
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+	PBKDF2   = "pbkdf2"
+)
+
+// ErrUnknownHash is returned for hashes in an unsupported format.
+var ErrUnknownHash = errors.New("auth: unknown password hash format")
+
+// parameters for new hashes
+const (
+	bcryptCost = 12
+
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 2
+	argon2KeyLen  = 32
+
+	pbkdf2Iter   = 600000
+	pbkdf2KeyLen = 32
+
+	saltLen = 16
+)
+
+var b64 = base64.RawStdEncoding
+
+// HashPassword hashes the password with a random salt. The algorithm is
+// Bcrypt, Argon2id or PBKDF2 (with SHA-256). The hashes are encoded as
+//
+//	$2a$12$...                                 (bcrypt)
+//	$argon2id$v=19$m=65536,t=3,p=2$salt$hash   (argon2id)
+//	$pbkdf2-sha256$i=600000$salt$hash          (pbkdf2)
+//
+// with salt and hash in unpadded base64.
+func HashPassword(password, alg string) (string, error) {
+
+	switch alg {
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		return string(hash), err
+
+	case Argon2id:
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+
+	case PBKDF2:
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+		key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iter, pbkdf2KeyLen)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s",
+			pbkdf2Iter, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	}
+	return "", fmt.Errorf("auth: unknown hash algorithm %q", alg)
+}
+
+// CheckPassword reports whether the password matches the hash.
+// It returns an error if the hash can not be parsed.
+func CheckPassword(hash, password string) (bool, error) {
+
+	switch {
+	case strings.HasPrefix(hash, "$2a$"),
+		strings.HasPrefix(hash, "$2b$"),
+		strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+
+	case strings.HasPrefix(hash, "$argon2id$"):
+		var version, memory, time int
+		var threads uint8
+		var salt, key string
+		parts := strings.Split(hash, "$")
+		if len(parts) != 6 {
+			return false, ErrUnknownHash
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, ErrUnknownHash
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return false, ErrUnknownHash
+		}
+		salt, key = parts[4], parts[5]
+		s, err1 := b64.DecodeString(salt)
+		k, err2 := b64.DecodeString(key)
+		if err1 != nil || err2 != nil || len(k) == 0 || memory <= 0 || time <= 0 || threads == 0 {
+			return false, ErrUnknownHash
+		}
+		other := argon2.IDKey([]byte(password), s, uint32(time), uint32(memory), threads, uint32(len(k)))
+		return subtle.ConstantTimeCompare(k, other) == 1, nil
+
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		var iter int
+		parts := strings.Split(hash, "$")
+		if len(parts) != 5 {
+			return false, ErrUnknownHash
+		}
+		if _, err := fmt.Sscanf(parts[2], "i=%d", &iter); err != nil || iter <= 0 {
+			return false, ErrUnknownHash
+		}
+		s, err1 := b64.DecodeString(parts[3])
+		k, err2 := b64.DecodeString(parts[4])
+		if err1 != nil || err2 != nil || len(k) == 0 {
+			return false, ErrUnknownHash
+		}
+		other, err := pbkdf2.Key(sha256.New, password, s, iter, len(k))
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare(k, other) == 1, nil
+	}
+	return false, ErrUnknownHash
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLen)
+	_, err := rand.Read(salt)
+	return salt, err
+}
@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+
+	for _, alg := range []string{Bcrypt, Argon2id, PBKDF2} {
+
+		hash, err := HashPassword("secret", alg)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+
+		if ok, err := CheckPassword(hash, "secret"); !ok || err != nil {
+			t.Errorf("%s: correct password rejected: %v", alg, err)
+		}
+		if ok, err := CheckPassword(hash, "Secret"); ok || err != nil {
+			t.Errorf("%s: wrong password accepted: %v", alg, err)
+		}
+	}
+
+	if _, err := CheckPassword("plain", "plain"); err != ErrUnknownHash {
+		t.Errorf("plain text hash: got %v, want ErrUnknownHash", err)
+	}
+}
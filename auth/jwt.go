@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/acl"
+)
+
+// JWT errors returned by Connect. Both wrap mqtt.ErrBadCredentials.
+var (
+	ErrInvalidToken = fmt.Errorf("auth: invalid token: %w", mqtt.ErrBadCredentials)
+	ErrTokenExpired = fmt.Errorf("auth: token expired: %w", mqtt.ErrBadCredentials)
+)
+
+// JWT authenticates clients that pass a JSON Web Token as password.
+// Tokens are signed with HS256 (Secret) or with RS256 or ES256 (public keys
+// from a JWKS file, selected by the "kid" header). The "exp" claim is
+// required, "nbf" is checked if present. A client is disconnected when its
+// token expires.
+//
+// The claim named by UsernameClaim becomes the username of the client
+// (Context.Username). If the token has an ACLClaim like
+//
+//	"acl": {"pub": ["devices/42/#"], "sub": ["commands/42/#"]}
+//
+// the client may only publish to and subscribe to these topic filters.
+// Use the JWT in a mqtt.Chain to have its Publish, Grant and Disconnect hooks
+// called.
+type JWT struct {
+	// Secret is the HMAC key for HS256 tokens.
+	Secret []byte
+	// Keys are the public keys (*rsa.PublicKey or *ecdsa.PublicKey) by key id.
+	Keys map[string]crypto.PublicKey
+	// UsernameClaim is the claim used as username. Default: "sub".
+	UsernameClaim string
+	// ACLClaim is the claim with the topic grants. Default: "acl".
+	ACLClaim string
+	// Leeway allows for clock skew when checking "exp" and "nbf".
+	Leeway time.Duration
+}
+
+// context keys
+const (
+	jwtACL   = "auth.jwt.acl"
+	jwtTimer = "auth.jwt.timer"
+)
+
+// LoadJWKS adds the RSA and P-256 EC keys of a JWKS (JSON Web Key Set) file
+// to the keys.
+func (j *JWT) LoadJWKS(path string) error {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if j.Keys == nil {
+		j.Keys = make(map[string]crypto.PublicKey)
+	}
+
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := decodeInt(k.N)
+			e, err2 := decodeInt(k.E)
+			if err1 != nil || err2 != nil || !e.IsInt64() {
+				return fmt.Errorf("%s: invalid RSA key %q", path, k.Kid)
+			}
+			j.Keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+		case "EC":
+			if k.Crv != "P-256" {
+				return fmt.Errorf("%s: unsupported curve %q of key %q", path, k.Crv, k.Kid)
+			}
+			x, err1 := decodeInt(k.X)
+			y, err2 := decodeInt(k.Y)
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("%s: invalid EC key %q", path, k.Kid)
+			}
+			j.Keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+		default:
+			return fmt.Errorf("%s: unsupported key type %q of key %q", path, k.Kty, k.Kid)
+		}
+	}
+	return nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, ErrInvalidToken
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Claims are the claims of a verified token.
+type Claims map[string]interface{}
+
+// Verify checks the signature, "exp" and "nbf" of a token.
+func (j *JWT) Verify(token string, now time.Time) (Claims, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJSON(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	hash := sha256.Sum256(signed)
+
+	// each algorithm only accepts its own kind of key: HS256 the Secret,
+	// RS256 and ES256 an RSA or ECDSA key of Keys. A token that names HS256
+	// can not be verified with a public RSA key, and "none" is rejected.
+	switch header.Alg {
+	case "HS256":
+		if len(j.Secret) == 0 {
+			return nil, ErrInvalidToken
+		}
+		mac := hmac.New(sha256.New, j.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, ErrInvalidToken
+		}
+
+	case "RS256":
+		key, ok := j.Keys[header.Kid].(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) != nil {
+			return nil, ErrInvalidToken
+		}
+
+	case "ES256":
+		key, ok := j.Keys[header.Kid].(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return nil, ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, hash[:], r, s) {
+			return nil, ErrInvalidToken
+		}
+
+	default:
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	exp, ok := claims.Time("exp")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	if now.After(exp.Add(j.Leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if _, ok := claims["nbf"]; ok {
+		nbf, ok := claims.Time("nbf")
+		if !ok || now.Before(nbf.Add(-j.Leeway)) {
+			return nil, ErrInvalidToken
+		}
+	}
+	return claims, nil
+}
+
+func decodeJSON(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Time returns a NumericDate claim.
+func (c Claims) Time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec := int64(v)
+	return time.Unix(sec, int64((v-float64(sec))*1e9)), true
+}
+
+// Strings returns a claim that is a string or a list of strings.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Connect implements the mqtt connect hook.
+func (j *JWT) Connect(ctx *mqtt.Context, username, password string) error {
+
+	now := time.Now()
+	claims, err := j.Verify(password, now)
+	if err != nil {
+		return err
+	}
+
+	usernameClaim := j.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+	name, _ := claims[usernameClaim].(string)
+	if name == "" {
+		return ErrInvalidToken
+	}
+	ctx.Username = name
+
+	aclClaim := j.ACLClaim
+	if aclClaim == "" {
+		aclClaim = "acl"
+	}
+	if grants, ok := claims[aclClaim].(map[string]interface{}); ok {
+		var rules []acl.Rule
+		for _, filter := range Claims(grants).Strings("pub") {
+			rules = append(rules, acl.Rule{Allow: true, Access: acl.Write, Filter: filter})
+		}
+		for _, filter := range Claims(grants).Strings("sub") {
+			rules = append(rules, acl.Rule{Allow: true, Access: acl.Read, Filter: filter})
+		}
+		topics, err := acl.New(rules...)
+		if err != nil {
+			return ErrInvalidToken
+		}
+		ctx.Set(jwtACL, topics)
+	}
+
+	exp, _ := claims.Time("exp")
+	ctx.Set(jwtTimer, time.AfterFunc(exp.Add(j.Leeway).Sub(now), func() {
+		ctx.Log().Info("token expired")
+		ctx.Kick()
+	}))
+	return nil
+}
+
+// Disconnect implements the mqtt disconnect hook.
+func (j *JWT) Disconnect(ctx *mqtt.Context) {
+
+	if timer, ok := ctx.Get(jwtTimer).(*time.Timer); ok {
+		timer.Stop()
+	}
+}
+
+// Publish implements the mqtt publish hook. It checks the topic grants of the
+// token, if any.
+func (j *JWT) Publish(ctx *mqtt.Context, msg *mqtt.Message) error {
+
+	if topics, ok := ctx.Get(jwtACL).(*acl.ACL); ok {
+		return topics.Publish(ctx, msg)
+	}
+	return nil
+}
+
+// Grant implements the mqtt grant hook. It checks the topic grants of the
+// token, if any.
+func (j *JWT) Grant(ctx *mqtt.Context, topic string, qos byte) byte {
+
+	if topics, ok := ctx.Get(jwtACL).(*acl.ACL); ok {
+		return topics.Grant(ctx, topic, qos)
+	}
+	return qos
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sign(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func TestJWT(t *testing.T) {
+
+	secret := []byte("secret")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	enc := base64.RawURLEncoding
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kid": "r", "kty": "RSA", "n": enc.EncodeToString(rsaKey.N.Bytes()), "e": "AQAB"},
+		{"kid": "e", "kty": "EC", "crv": "P-256",
+			"x": enc.EncodeToString(ecKey.X.Bytes()), "y": enc.EncodeToString(ecKey.Y.Bytes())},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, jwks, 0600)
+
+	j := &JWT{Secret: secret}
+	if err := j.LoadJWKS(path); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	valid := map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix()}
+	expired := map[string]interface{}{"sub": "alice", "exp": now.Add(-time.Hour).Unix()}
+	early := map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix(), "nbf": now.Add(time.Minute).Unix()}
+	noExp := map[string]interface{}{"sub": "alice"}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"HS256", sign(t, "HS256", "", secret, valid), nil},
+		{"RS256", sign(t, "RS256", "r", rsaKey, valid), nil},
+		{"ES256", sign(t, "ES256", "e", ecKey, valid), nil},
+		{"expired", sign(t, "HS256", "", secret, expired), ErrTokenExpired},
+		{"nbf", sign(t, "HS256", "", secret, early), ErrInvalidToken},
+		{"no exp", sign(t, "HS256", "", secret, noExp), ErrInvalidToken},
+		{"wrong secret", sign(t, "HS256", "", []byte("other"), valid), ErrInvalidToken},
+		{"wrong kid", sign(t, "ES256", "r", ecKey, valid), ErrInvalidToken},
+		{"none", sign(t, "none", "", []byte{}, valid), ErrInvalidToken},
+		{"garbage", "a.b.c", ErrInvalidToken},
+	}
+
+	for _, test := range tests {
+		claims, err := j.Verify(test.token, now)
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+		if err == nil && claims["sub"] != "alice" {
+			t.Errorf("%s: wrong claims %v", test.name, claims)
+		}
+	}
+}
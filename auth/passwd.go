@@ -0,0 +1,127 @@
+// Package auth contains authenticators for the Connect hook of mqtt handlers.
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/tools"
+)
+
+// ErrBadPassword is returned by Connect for unknown users and wrong passwords.
+// It wraps mqtt.ErrBadCredentials.
+var ErrBadPassword = fmt.Errorf("auth: %w", mqtt.ErrBadCredentials)
+
+// PasswordFile authenticates clients with a password file. Each line of the
+// file holds a username and a password hash (see HashPassword):
+//
+//	alice:$2a$12$...
+//	bob:$argon2id$v=19$m=65536,t=3,p=2$...$...
+//
+// Empty lines and lines starting with '#' are ignored.
+// The mqttpasswd command creates and edits password files.
+type PasswordFile struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+// LoadPasswordFile reads a password file.
+func LoadPasswordFile(path string) (*PasswordFile, error) {
+
+	pf := &PasswordFile{path: path}
+	if err := pf.Reload(); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+// Reload reads the password file again. The current users are kept if the
+// file has errors.
+func (pf *PasswordFile) Reload() error {
+
+	file, err := os.Open(pf.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users, err := ParsePasswords(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", pf.path, err)
+	}
+
+	pf.mu.Lock()
+	pf.users = users
+	pf.mu.Unlock()
+	return nil
+}
+
+// Watch checks the password file for changes at the given interval and reloads
+// it. Reload errors are logged. Call the returned function to stop watching.
+func (pf *PasswordFile) Watch(interval time.Duration, log mqtt.Logger) (stop func()) {
+
+	return tools.WatchFile(pf.path, interval, func() {
+		if err := pf.Reload(); err != nil {
+			log.Warn("password file reload failed", "path", pf.path, "err", err)
+		} else {
+			log.Info("password file reloaded", "path", pf.path)
+		}
+	})
+}
+
+// dummy hash checked for unknown users, so that they take as long as known ones
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("", Bcrypt)
+	return hash
+})
+
+// Connect implements the mqtt connect hook.
+func (pf *PasswordFile) Connect(ctx *mqtt.Context, username, password string) error {
+
+	pf.mu.RLock()
+	hash, ok := pf.users[username]
+	pf.mu.RUnlock()
+
+	if !ok {
+		CheckPassword(dummyHash(), password)
+		return ErrBadPassword
+	}
+
+	match, err := CheckPassword(hash, password)
+	if err != nil {
+		return fmt.Errorf("auth: user %q: %w", username, err)
+	}
+	if !match {
+		return ErrBadPassword
+	}
+	return nil
+}
+
+// ParsePasswords reads 'username:hash' lines.
+func ParsePasswords(r io.Reader) (map[string]string, error) {
+
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" || hash == "" {
+			return nil, fmt.Errorf("line %d: expected 'username:hash'", n)
+		}
+		users[username] = hash
+	}
+	return users, scanner.Err()
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/j-forster/mqtt"
+)
+
+// writePasswords writes a password file with the users and their passwords,
+// and moves its modification time forward so that a watcher notices it.
+// The hashes use few PBKDF2 iterations to keep the test fast.
+func writePasswords(t *testing.T, path string, passwords ...string) {
+
+	var lines []string
+	for i := 0; i+1 < len(passwords); i += 2 {
+		salt := []byte(passwords[i])
+		key, err := pbkdf2.Key(sha256.New, passwords[i+1], salt, 1000, pbkdf2KeyLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, passwords[i]+":$pbkdf2-sha256$i=1000$"+b64.EncodeToString(salt)+"$"+b64.EncodeToString(key))
+	}
+	writeFile(t, path, "# users\n\n"+strings.Join(lines, "\n")+"\n")
+}
+
+// writeFile replaces the file at once, with a later modification time.
+func writeFile(t *testing.T, path, content string) {
+
+	mtime := time.Now()
+	if stat, err := os.Stat(path); err == nil {
+		mtime = stat.ModTime().Add(time.Second)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(tmp, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "passwd")
+	writePasswords(t, path, "alice", "secret", "bob", "hunter2")
+
+	pf, err := LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		username, password string
+		err                error
+	}{
+		{"alice", "secret", nil},
+		{"bob", "hunter2", nil},
+		{"alice", "hunter2", ErrBadPassword},
+		{"alice", "", ErrBadPassword},
+		{"carol", "secret", ErrBadPassword},
+		{"", "", ErrBadPassword},
+	} {
+		err := pf.Connect(nil, test.username, test.password)
+		if err != test.err {
+			t.Errorf("%s/%s: %v, want %v", test.username, test.password, err, test.err)
+		}
+		if test.err != nil && mqtt.ConnAckCode(err, true) != mqtt.BAD_USER_OR_PASS {
+			t.Errorf("%s/%s: not a bad password", test.username, test.password)
+		}
+	}
+
+	// a hash that is not supported is an error, not a wrong password
+	writeFile(t, path, "alice:plain\n")
+	if err := pf.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pf.Connect(nil, "alice", "plain"); !errors.Is(err, ErrUnknownHash) {
+		t.Errorf("unknown hash: %v", err)
+	}
+
+	if _, err := LoadPasswordFile(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestParsePasswords(t *testing.T) {
+
+	users, err := ParsePasswords(strings.NewReader("# comment\n\n  alice:hash1  \nbob:$2a$12$x:y\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["alice"] != "hash1" || users["bob"] != "$2a$12$x:y" {
+		t.Fatalf("users %v", users)
+	}
+
+	for _, test := range []struct {
+		file, err string
+	}{
+		{"alice:hash\nbob\n", "line 2: expected 'username:hash'"},
+		{":hash\n", "line 1: expected 'username:hash'"},
+		{"# comment\nalice:\n", "line 2: expected 'username:hash'"},
+	} {
+		if _, err := ParsePasswords(strings.NewReader(test.file)); err == nil || err.Error() != test.err {
+			t.Errorf("%q: %v, want %s", test.file, err, test.err)
+		}
+	}
+}
+
+// watchLog records the messages of a watcher.
+type watchLog chan string
+
+func (l watchLog) Debug(msg string, args ...interface{}) {}
+func (l watchLog) Info(msg string, args ...interface{})  { l <- msg }
+func (l watchLog) Warn(msg string, args ...interface{})  { l <- msg }
+func (l watchLog) Error(msg string, args ...interface{}) {}
+
+func (l watchLog) expect(t *testing.T, msg string) {
+
+	t.Helper()
+	select {
+	case m := <-l:
+		if m != msg {
+			t.Fatalf("logged %q, want %q", m, msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%q not logged", msg)
+	}
+}
+
+func TestPasswordFileWatch(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "passwd")
+	writePasswords(t, path, "alice", "secret")
+	pf, err := LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := make(watchLog, 10)
+	stop := pf.Watch(10*time.Millisecond, log)
+	defer stop()
+
+	writePasswords(t, path, "bob", "hunter2")
+	log.expect(t, "password file reloaded")
+	if err := pf.Connect(nil, "bob", "hunter2"); err != nil {
+		t.Errorf("new user: %v", err)
+	}
+	if err := pf.Connect(nil, "alice", "secret"); err != ErrBadPassword {
+		t.Errorf("removed user: %v", err)
+	}
+
+	// the users are kept if the file has errors
+	writeFile(t, path, "bob\n")
+	log.expect(t, "password file reload failed")
+	if err := pf.Connect(nil, "bob", "hunter2"); err != nil {
+		t.Errorf("after failed reload: %v", err)
+	}
+	if err := pf.Reload(); err == nil || !strings.Contains(err.Error(), path+": line 1") {
+		t.Errorf("Reload = %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/j-forster/mqtt"
+)
+
+// ErrDenied is returned by the Webhook if the endpoint denied the request.
+// It wraps mqtt.ErrNotAuthorized. Endpoints that fail return errors wrapping
+// mqtt.ErrServerUnavailable.
+var ErrDenied = fmt.Errorf("auth: denied by webhook: %w", mqtt.ErrNotAuthorized)
+
+// Webhook asks HTTP endpoints whether clients may connect, publish and
+// subscribe. Each decision is a POST request with a JSON body like
+//
+//	{"clientid": "c1", "username": "alice", "password": "...",
+//	 "topic": "a/b", "qos": 1, "action": "publish"}
+//
+// The password is only sent to ConnectURL. A 2xx status allows and a 4xx
+// status denies. Decisions are cached for CacheTTL. If an endpoint can not be
+// reached, times out or answers with another status, FailOpen decides.
+// Hooks without URL allow everything.
+type Webhook struct {
+	ConnectURL   string
+	PublishURL   string
+	SubscribeURL string
+
+	// Timeout of a single request. Default: 5s.
+	Timeout time.Duration
+	// CacheTTL is how long decisions are cached. Zero disables the cache.
+	CacheTTL time.Duration
+	// FailOpen allows everything if the endpoint fails or times out.
+	FailOpen bool
+	// Client is the HTTP client to use. Default: http.DefaultClient.
+	Client *http.Client
+
+	mu    sync.Mutex
+	cache map[webhookRequest]cached
+}
+
+type webhookRequest struct {
+	Action   string `json:"action"`
+	ClientID string `json:"clientid"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	QoS      byte   `json:"qos"`
+}
+
+type cached struct {
+	err     error
+	expires time.Time
+}
+
+// Connect implements the mqtt connect hook.
+func (wh *Webhook) Connect(ctx *mqtt.Context, username, password string) error {
+
+	return wh.ask(wh.ConnectURL, webhookRequest{
+		Action:   "connect",
+		ClientID: ctx.ClientID,
+		Username: username,
+		Password: password,
+	})
+}
+
+// Disconnect implements the mqtt disconnect hook.
+func (wh *Webhook) Disconnect(ctx *mqtt.Context) {}
+
+// Publish implements the mqtt publish hook.
+func (wh *Webhook) Publish(ctx *mqtt.Context, msg *mqtt.Message) error {
+
+	return wh.ask(wh.PublishURL, webhookRequest{
+		Action:   "publish",
+		ClientID: ctx.ClientID,
+		Username: ctx.Username,
+		Topic:    msg.Topic,
+		QoS:      msg.QoS,
+	})
+}
+
+// Subscribe implements the mqtt subscribe hook.
+func (wh *Webhook) Subscribe(ctx *mqtt.Context, topic string, qos byte) error {
+
+	return wh.ask(wh.SubscribeURL, webhookRequest{
+		Action:   "subscribe",
+		ClientID: ctx.ClientID,
+		Username: ctx.Username,
+		Topic:    topic,
+		QoS:      qos,
+	})
+}
+
+func (wh *Webhook) ask(url string, req webhookRequest) error {
+
+	if url == "" {
+		return nil
+	}
+
+	// the cache keeps password hashes only
+	key := req
+	if key.Password != "" {
+		sum := sha256.Sum256([]byte(key.Password))
+		key.Password = string(sum[:])
+	}
+
+	now := time.Now()
+	if wh.CacheTTL > 0 {
+		wh.mu.Lock()
+		c, ok := wh.cache[key]
+		wh.mu.Unlock()
+		if ok && now.Before(c.expires) {
+			return c.err
+		}
+	}
+
+	err := wh.post(url, req)
+	if err != nil && err != ErrDenied {
+		if wh.FailOpen {
+			return nil
+		}
+		return err // not cached
+	}
+
+	if wh.CacheTTL > 0 {
+		wh.mu.Lock()
+		if wh.cache == nil {
+			wh.cache = make(map[webhookRequest]cached)
+		}
+		// drop expired entries now and then
+		if len(wh.cache) > 1024 {
+			for k, c := range wh.cache {
+				if now.After(c.expires) {
+					delete(wh.cache, k)
+				}
+			}
+		}
+		wh.cache[key] = cached{err, now.Add(wh.CacheTTL)}
+		wh.mu.Unlock()
+	}
+	return err
+}
+
+func (wh *Webhook) post(url string, req webhookRequest) error {
+
+	timeout := wh.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	client := wh.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(c, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(r)
+	if err != nil {
+		return fmt.Errorf("auth: webhook %s: %w: %w", req.Action, mqtt.ErrServerUnavailable, err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode <= 499:
+		return ErrDenied
+	}
+	return fmt.Errorf("auth: webhook %s: %w: %s", req.Action, mqtt.ErrServerUnavailable, resp.Status)
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/j-forster/mqtt"
+)
+
+func TestWebhook(t *testing.T) {
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req webhookRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case r.URL.Path == "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case r.URL.Path == "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case req.Action == "connect" && req.Password == "secret":
+		case req.Action == "publish" && req.Topic == "allowed":
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	wh := &Webhook{
+		ConnectURL: srv.URL + "/connect",
+		PublishURL: srv.URL + "/publish",
+		CacheTTL:   time.Minute,
+	}
+	ctx := mqtt.NewContext(nil, nil, mqtt.NewServer(nil, nil))
+
+	if err := wh.Connect(ctx, "alice", "secret"); err != nil {
+		t.Errorf("connect: %v", err)
+	}
+	if err := wh.Connect(ctx, "alice", "wrong"); err != ErrDenied {
+		t.Errorf("connect with wrong password: got %v", err)
+	}
+	if err := wh.Publish(ctx, &mqtt.Message{Topic: "allowed"}); err != nil {
+		t.Errorf("publish: %v", err)
+	}
+	if err := wh.Publish(ctx, &mqtt.Message{Topic: "denied"}); err != ErrDenied {
+		t.Errorf("publish denied: got %v", err)
+	}
+	if err := wh.Subscribe(ctx, "a/b", 0); err != nil {
+		t.Errorf("subscribe without url: %v", err)
+	}
+
+	n := calls.Load()
+	wh.Connect(ctx, "alice", "secret")
+	wh.Publish(ctx, &mqtt.Message{Topic: "denied"})
+	if calls.Load() != n {
+		t.Errorf("cached decisions should not call the endpoint")
+	}
+
+	for _, failOpen := range []bool{false, true} {
+		for _, path := range []string{"/slow", "/broken"} {
+			wh := &Webhook{
+				PublishURL: srv.URL + path,
+				Timeout:    50 * time.Millisecond,
+				FailOpen:   failOpen,
+			}
+			err := wh.Publish(ctx, &mqtt.Message{Topic: "allowed"})
+			if (err == nil) != failOpen {
+				t.Errorf("%s with fail open %v: got %v", path, failOpen, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package mqtt
+
+// The single hooks of a Handler. Plugins for a Chain implement only the
+// hooks they need.
+type (
+	ConnectHandler interface {
+		Connect(ctx *Context, username, password string) error
+	}
+	DisconnectHandler interface {
+		Disconnect(ctx *Context)
+	}
+	PublishHandler interface {
+		Publish(ctx *Context, msg *Message) error
+	}
+	SubscribeHandler interface {
+		Subscribe(ctx *Context, topic string, qos byte) error
+	}
+)
+
+// Function adapters for the single hooks, like http.HandlerFunc.
+type (
+	ConnectFunc    func(ctx *Context, username, password string) error
+	DisconnectFunc func(ctx *Context)
+	PublishFunc    func(ctx *Context, msg *Message) error
+	SubscribeFunc  func(ctx *Context, topic string, qos byte) error
+)
+
+func (f ConnectFunc) Connect(ctx *Context, username, password string) error {
+	return f(ctx, username, password)
+}
+
+func (f DisconnectFunc) Disconnect(ctx *Context) {
+	f(ctx)
+}
+
+func (f PublishFunc) Publish(ctx *Context, msg *Message) error {
+	return f(ctx, msg)
+}
+
+func (f SubscribeFunc) Subscribe(ctx *Context, topic string, qos byte) error {
+	return f(ctx, topic, qos)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Chain is a Handler that calls a list of plugins for each hook, including
+// the optional lifecycle hooks (DeliverHandler, AckHandler, ...).
+// The plugins of a hook are called in the order they have been added.
+// Connect, Publish and Subscribe stop at the first plugin that returns an
+// error, and the Chain returns that error. Grant stops at the first plugin
+// that rejects the topic. Rewrite passes the messages from plugin to plugin.
+// All other hooks are called on all plugins. A hook without plugins accepts
+// everything.
+type Chain struct {
+	connect    []ConnectHandler
+	disconnect []DisconnectHandler
+	publish    []PublishHandler
+	subscribe  []SubscribeHandler
+	grant      []GrantHandler
+	rewrite    []RewriteHandler
+
+	deliver     []DeliverHandler
+	ack         []AckHandler
+	drop        []DropHandler
+	unsubscribe []UnsubscribeHandler
+	will        []WillHandler
+	session     []SessionHandler
+	keepAlive   []KeepAliveHandler
+
+	// set if a connect or publish plugin is asynchronous
+	hasAsyncConnect bool
+	hasAsyncPublish bool
+}
+
+// NewChain creates a Chain and adds the plugins with Use.
+func NewChain(plugins ...interface{}) *Chain {
+
+	chain := new(Chain)
+	for _, plugin := range plugins {
+		chain.Use(plugin)
+	}
+	return chain
+}
+
+// Use adds the plugin to all hooks it implements.
+// It panics if the plugin does not implement any hook.
+func (chain *Chain) Use(plugin interface{}) *Chain {
+
+	n := 0
+	if h, ok := plugin.(AsyncConnectHandler); ok {
+		chain.UseAsyncConnect(h)
+		n++
+	} else if h, ok := plugin.(ConnectHandler); ok {
+		chain.connect = append(chain.connect, h)
+		n++
+	}
+	if h, ok := plugin.(DisconnectHandler); ok {
+		chain.disconnect = append(chain.disconnect, h)
+		n++
+	}
+	if h, ok := plugin.(AsyncPublishHandler); ok {
+		chain.UseAsyncPublish(h)
+		n++
+	} else if h, ok := plugin.(PublishHandler); ok {
+		chain.publish = append(chain.publish, h)
+		n++
+	}
+	if h, ok := plugin.(SubscribeHandler); ok {
+		chain.subscribe = append(chain.subscribe, h)
+		n++
+	}
+	if h, ok := plugin.(GrantHandler); ok {
+		chain.grant = append(chain.grant, h)
+		n++
+	}
+	if h, ok := plugin.(RewriteHandler); ok {
+		chain.rewrite = append(chain.rewrite, h)
+		n++
+	}
+	if h, ok := plugin.(DeliverHandler); ok {
+		chain.deliver = append(chain.deliver, h)
+		n++
+	}
+	if h, ok := plugin.(AckHandler); ok {
+		chain.ack = append(chain.ack, h)
+		n++
+	}
+	if h, ok := plugin.(DropHandler); ok {
+		chain.drop = append(chain.drop, h)
+		n++
+	}
+	if h, ok := plugin.(UnsubscribeHandler); ok {
+		chain.unsubscribe = append(chain.unsubscribe, h)
+		n++
+	}
+	if h, ok := plugin.(WillHandler); ok {
+		chain.will = append(chain.will, h)
+		n++
+	}
+	if h, ok := plugin.(SessionHandler); ok {
+		chain.session = append(chain.session, h)
+		n++
+	}
+	if h, ok := plugin.(KeepAliveHandler); ok {
+		chain.keepAlive = append(chain.keepAlive, h)
+		n++
+	}
+	if n == 0 {
+		panic("mqtt: plugin does not implement any hook")
+	}
+	return chain
+}
+
+// UseConnect adds a plugin to the Connect hook only. Together with the other
+// UseX methods this allows a different order of plugins per hook.
+func (chain *Chain) UseConnect(h ConnectHandler) *Chain {
+	chain.connect = append(chain.connect, h)
+	return chain
+}
+
+// UseDisconnect adds a plugin to the Disconnect hook only.
+func (chain *Chain) UseDisconnect(h DisconnectHandler) *Chain {
+	chain.disconnect = append(chain.disconnect, h)
+	return chain
+}
+
+// UsePublish adds a plugin to the Publish hook only.
+func (chain *Chain) UsePublish(h PublishHandler) *Chain {
+	chain.publish = append(chain.publish, h)
+	return chain
+}
+
+// UseAsyncConnect adds an asynchronous plugin to the Connect hook only.
+// The Chain then decides asynchronously as well.
+func (chain *Chain) UseAsyncConnect(h AsyncConnectHandler) *Chain {
+	chain.connect = append(chain.connect, asyncConnect{h})
+	chain.hasAsyncConnect = true
+	return chain
+}
+
+// UseAsyncPublish adds an asynchronous plugin to the Publish hook only.
+// The Chain then decides asynchronously as well.
+func (chain *Chain) UseAsyncPublish(h AsyncPublishHandler) *Chain {
+	chain.publish = append(chain.publish, asyncPublish{h})
+	chain.hasAsyncPublish = true
+	return chain
+}
+
+// UseSubscribe adds a plugin to the Subscribe hook only.
+func (chain *Chain) UseSubscribe(h SubscribeHandler) *Chain {
+	chain.subscribe = append(chain.subscribe, h)
+	return chain
+}
+
+// UseGrant adds a plugin to the Grant hook only.
+func (chain *Chain) UseGrant(h GrantHandler) *Chain {
+	chain.grant = append(chain.grant, h)
+	return chain
+}
+
+// UseRewrite adds a plugin to the Rewrite hook only.
+func (chain *Chain) UseRewrite(h RewriteHandler) *Chain {
+	chain.rewrite = append(chain.rewrite, h)
+	return chain
+}
+
+// UseDeliver adds a plugin to the Deliver hook only.
+func (chain *Chain) UseDeliver(h DeliverHandler) *Chain {
+	chain.deliver = append(chain.deliver, h)
+	return chain
+}
+
+// UseAck adds a plugin to the Ack hook only.
+func (chain *Chain) UseAck(h AckHandler) *Chain {
+	chain.ack = append(chain.ack, h)
+	return chain
+}
+
+// UseDrop adds a plugin to the Drop hook only.
+func (chain *Chain) UseDrop(h DropHandler) *Chain {
+	chain.drop = append(chain.drop, h)
+	return chain
+}
+
+// UseUnsubscribe adds a plugin to the Unsubscribe hook only.
+func (chain *Chain) UseUnsubscribe(h UnsubscribeHandler) *Chain {
+	chain.unsubscribe = append(chain.unsubscribe, h)
+	return chain
+}
+
+// UseWill adds a plugin to the Will hook only.
+func (chain *Chain) UseWill(h WillHandler) *Chain {
+	chain.will = append(chain.will, h)
+	return chain
+}
+
+// UseSession adds a plugin to the SessionResumed and SessionExpired hooks only.
+func (chain *Chain) UseSession(h SessionHandler) *Chain {
+	chain.session = append(chain.session, h)
+	return chain
+}
+
+// UseKeepAlive adds a plugin to the KeepAliveTimeout hook only.
+func (chain *Chain) UseKeepAlive(h KeepAliveHandler) *Chain {
+	chain.keepAlive = append(chain.keepAlive, h)
+	return chain
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func (chain *Chain) Connect(ctx *Context, username, password string) error {
+
+	for _, h := range chain.connect {
+		if err := h.Connect(ctx, username, password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectAsync runs Connect in a new goroutine, so asynchronous plugins can
+// be called one after the other.
+func (chain *Chain) ConnectAsync(ctx *Context, username, password string, done func(error)) {
+
+	go func() {
+		done(chain.Connect(ctx, username, password))
+	}()
+}
+
+func (chain *Chain) Disconnect(ctx *Context) {
+
+	for _, h := range chain.disconnect {
+		h.Disconnect(ctx)
+	}
+}
+
+func (chain *Chain) Publish(ctx *Context, msg *Message) error {
+
+	for _, h := range chain.publish {
+		if err := h.Publish(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PublishAsync runs Publish in a new goroutine, so asynchronous plugins can
+// be called one after the other.
+func (chain *Chain) PublishAsync(ctx *Context, msg *Message, done func(error)) {
+
+	go func() {
+		done(chain.Publish(ctx, msg))
+	}()
+}
+
+func (chain *Chain) Subscribe(ctx *Context, topic string, qos byte) error {
+
+	for _, h := range chain.subscribe {
+		if err := h.Subscribe(ctx, topic, qos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Grant returns the lowest qos granted by the plugins, or SUBSCRIBE_FAILURE
+// as soon as one plugin rejects the topic.
+func (chain *Chain) Grant(ctx *Context, topic string, qos byte) byte {
+
+	for _, h := range chain.grant {
+		granted := h.Grant(ctx, topic, qos)
+		if granted == SUBSCRIBE_FAILURE {
+			return SUBSCRIBE_FAILURE
+		}
+		if granted < qos {
+			qos = granted
+		}
+	}
+	return qos
+}
+
+// Rewrite passes every message returned by a plugin to the next plugin.
+// It stops at the first error.
+func (chain *Chain) Rewrite(ctx *Context, msg *Message) ([]*Message, error) {
+
+	msgs := []*Message{msg}
+	for _, h := range chain.rewrite {
+		var next []*Message
+		for _, m := range msgs {
+			rewritten, err := h.Rewrite(ctx, m)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, rewritten...)
+		}
+		msgs = next
+	}
+	return msgs, nil
+}
+
+func (chain *Chain) Deliver(ctx *Context, msg *Message, qos byte) {
+
+	for _, h := range chain.deliver {
+		h.Deliver(ctx, msg, qos)
+	}
+}
+
+func (chain *Chain) Ack(ctx *Context, msg *Message) {
+
+	for _, h := range chain.ack {
+		h.Ack(ctx, msg)
+	}
+}
+
+func (chain *Chain) Drop(ctx *Context, msg *Message, reason error) {
+
+	for _, h := range chain.drop {
+		h.Drop(ctx, msg, reason)
+	}
+}
+
+func (chain *Chain) Unsubscribe(ctx *Context, topic string) {
+
+	for _, h := range chain.unsubscribe {
+		h.Unsubscribe(ctx, topic)
+	}
+}
+
+func (chain *Chain) Will(ctx *Context, msg *Message) {
+
+	for _, h := range chain.will {
+		h.Will(ctx, msg)
+	}
+}
+
+func (chain *Chain) SessionResumed(ctx *Context) {
+
+	for _, h := range chain.session {
+		h.SessionResumed(ctx)
+	}
+}
+
+func (chain *Chain) SessionExpired(clientID string) {
+
+	for _, h := range chain.session {
+		h.SessionExpired(clientID)
+	}
+}
+
+func (chain *Chain) KeepAliveTimeout(ctx *Context) {
+
+	for _, h := range chain.keepAlive {
+		h.KeepAliveTimeout(ctx)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// asyncConnect and asyncPublish wait for the decision of an asynchronous
+// plugin. They are only called by ConnectAsync and PublishAsync of the Chain.
+// Like the asynchronous hooks of the server, they give up with
+// ErrHookTimeout after the ConnectTimeout or PublishTimeout of the server.
+type (
+	asyncConnect struct{ h AsyncConnectHandler }
+	asyncPublish struct{ h AsyncPublishHandler }
+)
+
+func (a asyncConnect) Connect(ctx *Context, username, password string) error {
+
+	timeout := defaultConnectTimeout
+	if ctx != nil && ctx.server != nil {
+		timeout = ctx.server.ConnectTimeout
+	}
+	result := make(chan error, 1)
+	a.h.ConnectAsync(ctx, username, password, decide(timeout, func(err error) { result <- err }))
+	return <-result
+}
+
+func (a asyncPublish) Publish(ctx *Context, msg *Message) error {
+
+	timeout := defaultPublishTimeout
+	if ctx != nil && ctx.server != nil {
+		timeout = ctx.server.PublishTimeout
+	}
+	result := make(chan error, 1)
+	a.h.PublishAsync(ctx, msg, decide(timeout, func(err error) { result <- err }))
+	return <-result
+}
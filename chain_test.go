@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// plugin records its calls as "<name>.<hook>" and fails the hooks in fail.
+type plugin struct {
+	name  string
+	calls *[]string
+	fail  string
+}
+
+var errPlugin = errors.New("plugin failed")
+
+func (p plugin) call(hook string) error {
+
+	*p.calls = append(*p.calls, p.name+"."+hook)
+	if strings.Contains(p.fail, hook) {
+		return errPlugin
+	}
+	return nil
+}
+
+func (p plugin) Connect(ctx *Context, username, password string) error {
+	return p.call("connect")
+}
+
+func (p plugin) Disconnect(ctx *Context) {
+	p.call("disconnect")
+}
+
+func (p plugin) Publish(ctx *Context, msg *Message) error {
+	return p.call("publish")
+}
+
+func (p plugin) Subscribe(ctx *Context, topic string, qos byte) error {
+	return p.call("subscribe")
+}
+
+func TestChainOrder(t *testing.T) {
+
+	var calls []string
+	chain := NewChain(
+		plugin{"a", &calls, ""},
+		plugin{"b", &calls, "publish subscribe"},
+		plugin{"c", &calls, "subscribe"})
+
+	check := func(want string) {
+		t.Helper()
+		if got := strings.Join(calls, " "); got != want {
+			t.Fatalf("calls %q, want %q", got, want)
+		}
+		calls = nil
+	}
+
+	if err := chain.Connect(nil, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	check("a.connect b.connect c.connect")
+
+	// the first error stops the hook
+	if err := chain.Publish(nil, nil); err != errPlugin {
+		t.Fatalf("Publish = %v", err)
+	}
+	check("a.publish b.publish")
+	if err := chain.Subscribe(nil, "a", 0); err != errPlugin {
+		t.Fatalf("Subscribe = %v", err)
+	}
+	check("a.subscribe b.subscribe")
+
+	chain.Disconnect(nil)
+	check("a.disconnect b.disconnect c.disconnect")
+
+	// plugins of a single hook keep their place in that hook
+	chain = NewChain(plugin{"a", &calls, ""}).
+		UsePublish(PublishFunc(func(ctx *Context, msg *Message) error {
+			calls = append(calls, "func.publish")
+			return nil
+		})).
+		Use(plugin{"c", &calls, ""})
+	chain.Publish(nil, nil)
+	check("a.publish func.publish c.publish")
+	chain.Connect(nil, "", "")
+	check("a.connect c.connect")
+
+	// a hook without plugins accepts everything
+	if err := NewChain().Publish(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChainUsePanics(t *testing.T) {
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic")
+		}
+	}()
+	NewChain(struct{}{})
+}
+
+type grantFunc func(ctx *Context, topic string, qos byte) byte
+
+func (f grantFunc) Grant(ctx *Context, topic string, qos byte) byte {
+	return f(ctx, topic, qos)
+}
+
+func TestChainGrant(t *testing.T) {
+
+	grant := func(max byte) grantFunc {
+		return func(ctx *Context, topic string, qos byte) byte {
+			if max < qos {
+				return max
+			}
+			return qos
+		}
+	}
+	var calls int
+	chain := NewChain(grant(2), grant(1), grantFunc(func(ctx *Context, topic string, qos byte) byte {
+		calls++
+		if topic == "forbidden" {
+			return SUBSCRIBE_FAILURE
+		}
+		return qos
+	}), grant(2))
+
+	if qos := chain.Grant(nil, "a", 2); qos != 1 {
+		t.Fatalf("Grant = %d", qos)
+	}
+	if qos := chain.Grant(nil, "forbidden", 2); qos != SUBSCRIBE_FAILURE {
+		t.Fatalf("Grant = %d", qos)
+	}
+	if calls != 2 {
+		t.Fatalf("%d calls", calls)
+	}
+}
+
+// undecided is an asynchronous plugin that never decides.
+type undecided struct{}
+
+func (undecided) ConnectAsync(ctx *Context, username, password string, done func(error)) {}
+
+func (undecided) PublishAsync(ctx *Context, msg *Message, done func(error)) {}
+
+func TestChainAsyncTimeout(t *testing.T) {
+
+	server := NewServer(nil, nil)
+	server.ConnectTimeout = 10 * time.Millisecond
+	server.PublishTimeout = 10 * time.Millisecond
+	ctx := server.newLocalContext()
+
+	chain := NewChain().UseAsyncConnect(undecided{}).UseAsyncPublish(undecided{})
+	if err := chain.Connect(ctx, "", ""); err != ErrHookTimeout {
+		t.Fatalf("Connect = %v", err)
+	}
+	if err := chain.Publish(ctx, &Message{Topic: "a"}); err != ErrHookTimeout {
+		t.Fatalf("Publish = %v", err)
+	}
+}
@@ -0,0 +1,686 @@
+// Package client is a small MQTT 3.1 client. It is used by the bridges of the
+// server command and the command line tools, and can talk to any broker.
+//
+//	c, err := client.Dial("tcp://localhost:1883", &client.Options{
+//		ClientID:  "sensor-1",
+//		OnMessage: func(msg *mqtt.Message) { ... },
+//	})
+//	c.Subscribe("commands/sensor-1/#", 1)
+//	c.Publish("sensors/1/temp", []byte("21.5"), 1, false)
+//	c.Disconnect()
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"golang.org/x/net/websocket"
+)
+
+// errors
+var (
+	ErrClosed      = errors.New("client: connection closed")
+	ErrTimeout     = errors.New("client: timeout")
+	ErrRejected    = errors.New("client: subscription rejected")
+	ErrBadProtocol = errors.New("client: unacceptable protocol version")
+)
+
+// Options for a client connection. The zero value connects with an empty
+// client id and a clean session.
+type Options struct {
+	ClientID string
+	Username string
+	Password string
+
+	// CleanSession is requested if set, or if the ClientID is empty.
+	CleanSession bool
+	// KeepAlive is the ping interval. Zero disables pings.
+	KeepAlive time.Duration
+	// Will is published by the broker if the connection is lost.
+	Will *mqtt.Message
+
+	// TLSConfig is used for tls:// and wss:// addresses.
+	TLSConfig *tls.Config
+	// Timeout for the connection and for acknowledgements. Default: 10s.
+	Timeout time.Duration
+
+	// OnMessage is called for every message received from the broker, one
+	// after the other. It must not block, and must not wait for a Publish
+	// with QoS > 0 or a Subscribe, as no more packets are read meanwhile.
+	OnMessage func(msg *mqtt.Message)
+}
+
+// Client is a connection to a broker. Its methods can be called from any
+// goroutine.
+type Client struct {
+	conn    net.Conn
+	opts    Options
+	timeout time.Duration
+
+	// packets are written by the writer goroutine, in order
+	wmu    sync.Mutex
+	queue  [][]byte
+	ready  chan struct{}
+	stop   chan struct{}
+	closed sync.Once
+
+	mu       sync.Mutex
+	mid      int
+	acks     map[int]chan packet // waiting for an acknowledgement
+	received map[int]bool        // QoS 2 messages waiting for PUBREL
+	err      error
+
+	done chan struct{}
+}
+
+type packet struct {
+	b0   byte
+	body []byte
+}
+
+// Dial connects to a broker. The address is a URL like tcp://host:1883,
+// tls://host:8883, ws://host/mqtt, wss://host/mqtt or unix:///path/to/socket.
+// Addresses without scheme are TCP addresses.
+func Dial(addr string, opts *Options) (*Client, error) {
+
+	if opts == nil {
+		opts = new(Options)
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	conn, err := DialConn(addr, opts.TLSConfig, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := Connect(conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialConn opens the network connection to a broker at an address as for
+// Dial, without sending a CONNECT packet.
+func DialConn(addr string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+
+	if !strings.Contains(addr, "://") {
+		addr = "tcp://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return dialer.Dial("tcp", withPort(u.Host, "1883"))
+	case "tls", "ssl", "mqtts":
+		return tls.DialWithDialer(dialer, "tcp", withPort(u.Host, "8883"), tlsConfig)
+	case "unix":
+		return dialer.Dial("unix", u.Path)
+	case "ws", "wss":
+		return dialWebSocket(u, tlsConfig)
+	default:
+		return nil, fmt.Errorf("client: unsupported scheme %q", u.Scheme)
+	}
+}
+
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return net.JoinHostPort(host, port)
+	}
+	return host
+}
+
+func dialWebSocket(u *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" {
+		origin = "https://" + u.Host
+	}
+	config, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{"mqtt"}
+	config.TlsConfig = tlsConfig
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// Connect sends a CONNECT packet over an established connection and waits
+// for the CONNACK. A rejected connection returns the matching error of the
+// mqtt package, like mqtt.ErrBadCredentials.
+func Connect(conn net.Conn, opts *Options) (*Client, error) {
+
+	if opts == nil {
+		opts = new(Options)
+	}
+
+	c := &Client{
+		conn:     conn,
+		opts:     *opts,
+		timeout:  opts.Timeout,
+		acks:     make(map[int]chan packet),
+		received: make(map[int]bool),
+		ready:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if c.timeout == 0 {
+		c.timeout = 10 * time.Second
+	}
+
+	reader := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := conn.Write(connectPacket(opts)); err != nil {
+		return nil, err
+	}
+	p, err := readPacket(reader)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if p.b0>>4 != mqtt.CONNACK || len(p.body) != 2 {
+		return nil, fmt.Errorf("client: expected CONNACK, got packet type %d", p.b0>>4)
+	}
+	switch p.body[1] {
+	case mqtt.ACCEPTED:
+	case mqtt.UNACCEPTABLE_PROTOV:
+		return nil, ErrBadProtocol
+	case mqtt.IDENTIFIER_REJ:
+		return nil, mqtt.ErrIdentifierRejected
+	case mqtt.SERVER_UNAVAIL:
+		return nil, mqtt.ErrServerUnavailable
+	case mqtt.BAD_USER_OR_PASS:
+		return nil, mqtt.ErrBadCredentials
+	default:
+		return nil, mqtt.ErrNotAuthorized
+	}
+
+	go c.read(reader)
+	go c.writer()
+	if opts.KeepAlive > 0 {
+		go c.ping(opts.KeepAlive)
+	}
+	return c, nil
+}
+
+// Done is closed when the connection is closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the connection has been closed, or nil.
+func (c *Client) Err() error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close closes the connection without DISCONNECT, so the broker publishes
+// the will message.
+func (c *Client) Close() error {
+
+	c.fail(ErrClosed)
+	return nil
+}
+
+// Disconnect sends a DISCONNECT packet and closes the connection after all
+// packets have been written.
+func (c *Client) Disconnect() error {
+
+	err := c.write([]byte{mqtt.DISCONNECT << 4, 0})
+	c.closed.Do(func() { close(c.stop) })
+
+	select {
+	case <-c.done:
+	case <-time.After(c.timeout):
+		c.fail(ErrTimeout)
+	}
+	return err
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Publish sends a message. With QoS 1 or 2 it waits until the broker has
+// acknowledged the message.
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) error {
+
+	if qos > 2 {
+		return fmt.Errorf("client: invalid qos %d", qos)
+	}
+	b0 := byte(mqtt.PUBLISH<<4) | qos<<1
+	if retain {
+		b0 |= 1
+	}
+
+	if qos == 0 {
+		return c.write(encode(b0, str(topic), payload))
+	}
+
+	mid, ack := c.await()
+	defer c.release(mid)
+
+	if err := c.write(encode(b0, str(topic), id(mid), payload)); err != nil {
+		return err
+	}
+
+	if qos == 1 {
+		_, err := c.wait(ack, mqtt.PUBACK)
+		return err
+	}
+
+	if _, err := c.wait(ack, mqtt.PUBREC); err != nil {
+		return err
+	}
+	if err := c.write(encode(mqtt.PUBREL<<4|0x02, id(mid))); err != nil {
+		return err
+	}
+	_, err := c.wait(ack, mqtt.PUBCOMP)
+	return err
+}
+
+// Subscribe subscribes to a topic filter and returns the granted QoS.
+// It returns ErrRejected if the broker rejected the subscription.
+func (c *Client) Subscribe(filter string, qos byte) (byte, error) {
+
+	mid, ack := c.await()
+	defer c.release(mid)
+
+	if err := c.write(encode(mqtt.SUBSCRIBE<<4|0x02, id(mid), str(filter), []byte{qos})); err != nil {
+		return 0, err
+	}
+	p, err := c.wait(ack, mqtt.SUBACK)
+	if err != nil {
+		return 0, err
+	}
+	if len(p.body) < 3 {
+		return 0, mqtt.IncompleteMessage
+	}
+	if p.body[2] == mqtt.SUBSCRIBE_FAILURE {
+		return 0, ErrRejected
+	}
+	return p.body[2], nil
+}
+
+// Unsubscribe removes subscriptions.
+func (c *Client) Unsubscribe(filters ...string) error {
+
+	mid, ack := c.await()
+	defer c.release(mid)
+
+	parts := [][]byte{id(mid)}
+	for _, filter := range filters {
+		parts = append(parts, str(filter))
+	}
+	if err := c.write(encode(mqtt.UNSUBSCRIBE<<4|0x02, parts...)); err != nil {
+		return err
+	}
+	_, err := c.wait(ack, mqtt.UNSUBACK)
+	return err
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// await reserves a message id for a packet that is acknowledged.
+func (c *Client) await() (int, chan packet) {
+
+	ack := make(chan packet, 2)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		c.mid = c.mid%0xffff + 1 // message ids are 1..65535
+		if _, ok := c.acks[c.mid]; !ok {
+			c.acks[c.mid] = ack
+			return c.mid, ack
+		}
+	}
+}
+
+func (c *Client) release(mid int) {
+
+	c.mu.Lock()
+	delete(c.acks, mid)
+	c.mu.Unlock()
+}
+
+func (c *Client) wait(ack chan packet, mtype byte) (packet, error) {
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case p := <-ack:
+		if p.b0>>4 != mtype {
+			return p, fmt.Errorf("client: unexpected packet type %d", p.b0>>4)
+		}
+		return p, nil
+	case <-c.done:
+		return packet{}, c.Err()
+	case <-timer.C:
+		return packet{}, ErrTimeout
+	}
+}
+
+// write queues a packet for the writer goroutine, so that the reading
+// goroutine never blocks when it acknowledges packets.
+func (c *Client) write(buf []byte) error {
+
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+
+	c.wmu.Lock()
+	c.queue = append(c.queue, buf)
+	c.wmu.Unlock()
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *Client) writer() {
+
+	for {
+		stop := false
+		select {
+		case <-c.ready:
+		case <-c.stop:
+			stop = true
+		case <-c.done:
+			return
+		}
+
+		c.wmu.Lock()
+		queue := c.queue
+		c.queue = nil
+		c.wmu.Unlock()
+
+		for _, buf := range queue {
+			if _, err := c.conn.Write(buf); err != nil {
+				c.fail(err)
+				return
+			}
+		}
+
+		if stop {
+			c.fail(ErrClosed)
+			return
+		}
+	}
+}
+
+func (c *Client) fail(err error) {
+
+	c.mu.Lock()
+	closed := c.err != nil
+	if !closed {
+		c.err = err
+	}
+	c.mu.Unlock()
+
+	if !closed {
+		c.conn.Close()
+		close(c.done)
+	}
+}
+
+func (c *Client) ping(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.write([]byte{mqtt.PINGREQ << 4, 0})
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// read receives packets until the connection fails.
+func (c *Client) read(reader *bufio.Reader) {
+
+	for {
+		p, err := readPacket(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				err = ErrClosed
+			}
+			c.fail(err)
+			return
+		}
+
+		switch p.b0 >> 4 {
+		case mqtt.PUBLISH:
+			if err := c.receive(p); err != nil {
+				c.fail(err)
+				return
+			}
+
+		case mqtt.PUBREL:
+			if len(p.body) < 2 {
+				c.fail(mqtt.IncompleteMessage)
+				return
+			}
+			mid := int(p.body[0])<<8 + int(p.body[1])
+			c.mu.Lock()
+			delete(c.received, mid)
+			c.mu.Unlock()
+			c.write(encode(mqtt.PUBCOMP<<4, p.body[:2]))
+
+		case mqtt.PUBACK, mqtt.PUBREC, mqtt.PUBCOMP, mqtt.SUBACK, mqtt.UNSUBACK:
+			if len(p.body) < 2 {
+				c.fail(mqtt.IncompleteMessage)
+				return
+			}
+			mid := int(p.body[0])<<8 + int(p.body[1])
+			c.mu.Lock()
+			ack, ok := c.acks[mid]
+			c.mu.Unlock()
+			if ok {
+				select {
+				case ack <- p:
+				default:
+				}
+			}
+
+		case mqtt.PINGRESP:
+		}
+	}
+}
+
+// receive handles a PUBLISH packet from the broker.
+func (c *Client) receive(p packet) error {
+
+	qos := (p.b0 >> 1) & 0x03
+	buf := p.body
+
+	if len(buf) < 2 {
+		return mqtt.IncompleteMessage
+	}
+	l := int(buf[0])<<8 + int(buf[1])
+	if len(buf) < 2+l {
+		return mqtt.IncompleteMessage
+	}
+	msg := &mqtt.Message{
+		Topic:  string(buf[2 : 2+l]),
+		QoS:    qos,
+		Retain: p.b0&0x01 != 0,
+	}
+	buf = buf[2+l:]
+
+	var mid []byte
+	if qos > 0 {
+		if len(buf) < 2 {
+			return mqtt.IncompleteMessage
+		}
+		mid = buf[:2]
+		buf = buf[2:]
+	}
+	msg.Buf = buf
+
+	switch qos {
+	case 0:
+		c.deliver(msg)
+	case 1:
+		c.deliver(msg)
+		c.write(encode(mqtt.PUBACK<<4, mid))
+	case 2:
+		// deliver once, even if the broker sends the message again
+		c.mu.Lock()
+		dup := c.received[int(mid[0])<<8+int(mid[1])]
+		c.received[int(mid[0])<<8+int(mid[1])] = true
+		c.mu.Unlock()
+		if !dup {
+			c.deliver(msg)
+		}
+		c.write(encode(mqtt.PUBREC<<4, mid))
+	}
+	return nil
+}
+
+func (c *Client) deliver(msg *mqtt.Message) {
+
+	if c.opts.OnMessage != nil {
+		c.opts.OnMessage(msg)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func connectPacket(opts *Options) []byte {
+
+	var flags byte
+	if opts.CleanSession || opts.ClientID == "" {
+		flags |= 0x02
+	}
+
+	keepAlive := int(opts.KeepAlive / time.Second)
+	if keepAlive > 0xffff {
+		keepAlive = 0xffff
+	}
+
+	parts := [][]byte{
+		str("MQIsdp"),
+		{3, 0, byte(keepAlive >> 8), byte(keepAlive)}, // flags are set below
+		str(opts.ClientID),
+	}
+
+	if opts.Will != nil {
+		flags |= 0x04 | opts.Will.QoS<<3
+		if opts.Will.Retain {
+			flags |= 0x20
+		}
+		parts = append(parts, str(opts.Will.Topic), str(string(opts.Will.Buf)))
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		parts = append(parts, str(opts.Username))
+		if opts.Password != "" {
+			flags |= 0x40
+			parts = append(parts, str(opts.Password))
+		}
+	}
+	parts[1][1] = flags
+
+	return encode(mqtt.CONNECT<<4, parts...)
+}
+
+// encode builds a packet from the first header byte and the parts of the body.
+func encode(b0 byte, parts ...[]byte) []byte {
+
+	var length int
+	for _, part := range parts {
+		length += len(part)
+	}
+
+	buf := make([]byte, 0, 5+length)
+	buf = append(buf, b0)
+	for {
+		b := byte(length & 127)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	for _, part := range parts {
+		buf = append(buf, part...)
+	}
+	return buf
+}
+
+// str encodes a string with its length.
+func str(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// id encodes a message id.
+func id(mid int) []byte {
+	return []byte{byte(mid >> 8), byte(mid)}
+}
+
+func readPacket(reader *bufio.Reader) (packet, error) {
+
+	b0, err := reader.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	var length, shift int
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length |= int(b&127) << shift
+		if b&128 == 0 {
+			break
+		}
+		shift += 7
+		if shift > 21 {
+			return packet{}, mqtt.MessageLengthInvalid
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return packet{}, err
+	}
+	return packet{b0, body}, nil
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/j-forster/mqtt"
+)
+
+func startServer(t *testing.T, handler mqtt.Handler) *mqtt.Server {
+
+	svr := mqtt.NewServer(nil, handler)
+	go svr.Run()
+	t.Cleanup(svr.Close)
+	return svr
+}
+
+func pipe(t *testing.T, svr *mqtt.Server, opts *Options) *Client {
+
+	conn, remote := net.Pipe()
+	go svr.Serve(remote)
+	c, err := Connect(conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Disconnect() })
+	return c
+}
+
+func TestPublishSubscribe(t *testing.T) {
+
+	svr := startServer(t, nil)
+
+	received := make(chan *mqtt.Message, 10)
+	sub := pipe(t, svr, &Options{
+		ClientID:  "sub",
+		OnMessage: func(msg *mqtt.Message) { received <- msg },
+	})
+	pub := pipe(t, svr, &Options{ClientID: "pub"})
+
+	if _, err := sub.Subscribe("a/b", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for qos := byte(0); qos <= 2; qos++ {
+		if err := pub.Publish("a/b", []byte{'0' + qos}, qos, false); err != nil {
+			t.Fatalf("qos %d: %v", qos, err)
+		}
+		select {
+		case msg := <-received:
+			if msg.Topic != "a/b" || string(msg.Buf) != string('0'+qos) || msg.QoS != qos {
+				t.Fatalf("qos %d: got %+v", qos, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("qos %d: no message", qos)
+		}
+	}
+
+	if err := sub.Unsubscribe("a/b"); err != nil {
+		t.Fatal(err)
+	}
+	pub.Publish("a/b", []byte("x"), 1, false)
+	select {
+	case msg := <-received:
+		t.Fatalf("message after unsubscribe: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConnectRejected(t *testing.T) {
+
+	svr := startServer(t, mqtt.NewChain(mqtt.ConnectFunc(
+		func(ctx *mqtt.Context, username, password string) error {
+			return mqtt.ErrBadCredentials
+		})))
+
+	conn, remote := net.Pipe()
+	go svr.Serve(remote)
+	_, err := Connect(conn, &Options{Username: "alice", Password: "wrong"})
+	if err != mqtt.ErrBadCredentials {
+		t.Fatalf("got %v, want %v", err, mqtt.ErrBadCredentials)
+	}
+}
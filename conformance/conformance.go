@@ -0,0 +1,515 @@
+// Package conformance tests mqtt brokers for conformance with MQTT 3.1, the
+// protocol version of this server.
+//
+// The suite speaks the protocol packet by packet, so it can send malformed
+// input and check every acknowledgement. It is a library and can test any
+// broker that a Dial function connects to:
+//
+//	func TestMosquitto(t *testing.T) {
+//		suite := conformance.Suite{
+//			Dial: func() (net.Conn, error) {
+//				return net.Dial("tcp", "localhost:1883")
+//			},
+//		}
+//		suite.Run(t)
+//	}
+//
+// The tests of this package run the suite against an in-process server, or
+// against another broker with
+//
+//	go test ./conformance -broker localhost:1883
+//
+// All topics of a run start with a random prefix, so the suite can run on
+// a broker that is used by other clients. The broker must accept clients
+// without username and password, and must allow them to publish and
+// subscribe to all topics.
+package conformance
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/j-forster/mqtt"
+)
+
+// Suite is a conformance test suite for one broker.
+type Suite struct {
+	// Dial opens a new connection to the broker.
+	Dial func() (net.Conn, error)
+	// Timeout is the time to wait for an expected packet, and to make sure
+	// that a packet does not arrive. Default: 1s.
+	Timeout time.Duration
+
+	prefix string
+}
+
+// Run runs all tests of the suite as subtests of t. Use 'go test -run' to
+// select tests. The keep alive tests take a few seconds and are skipped in
+// short mode.
+func (s *Suite) Run(t *testing.T) {
+
+	if s.Dial == nil {
+		t.Fatal("conformance: Suite.Dial is nil")
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = time.Second
+	}
+	s.prefix = "conformance/" + randomID(4) + "/"
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(s, t)
+		})
+	}
+}
+
+func randomID(n int) string {
+
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// topic returns a topic of this run.
+func (s *Suite) topic(t *testing.T, name string) string {
+	return s.prefix + t.Name() + "/" + name
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// packet is an mqtt packet as received from the broker.
+type packet struct {
+	b0   byte // type and flags
+	body []byte
+}
+
+func (p *packet) mtype() byte {
+	return p.b0 >> 4
+}
+
+func (p *packet) qos() byte {
+	return p.b0 >> 1 & 0x03
+}
+
+func (p *packet) String() string {
+
+	name := "reserved"
+	switch t := p.mtype(); t {
+	case mqtt.CONNECT:
+		name = "CONNECT"
+	case mqtt.CONNACK:
+		name = "CONNACK"
+	case mqtt.PUBLISH:
+		name = "PUBLISH"
+	case mqtt.PUBACK:
+		name = "PUBACK"
+	case mqtt.PUBREC:
+		name = "PUBREC"
+	case mqtt.PUBREL:
+		name = "PUBREL"
+	case mqtt.PUBCOMP:
+		name = "PUBCOMP"
+	case mqtt.SUBSCRIBE:
+		name = "SUBSCRIBE"
+	case mqtt.SUBACK:
+		name = "SUBACK"
+	case mqtt.UNSUBSCRIBE:
+		name = "UNSUBSCRIBE"
+	case mqtt.UNSUBACK:
+		name = "UNSUBACK"
+	case mqtt.PINGREQ:
+		name = "PINGREQ"
+	case mqtt.PINGRESP:
+		name = "PINGRESP"
+	case mqtt.DISCONNECT:
+		name = "DISCONNECT"
+	}
+	return fmt.Sprintf("%s (%#02x, %d bytes)", name, p.b0, len(p.body))
+}
+
+// publish is a parsed PUBLISH packet.
+type publish struct {
+	topic   string
+	mid     int
+	payload string
+	qos     byte
+	retain  bool
+	dup     bool
+}
+
+func (p *packet) publish() (*publish, error) {
+
+	pub := &publish{
+		qos:    p.qos(),
+		retain: p.b0&0x01 != 0,
+		dup:    p.b0&0x08 != 0,
+	}
+	buf := p.body
+	if len(buf) < 2 || len(buf) < 2+int(buf[0])<<8+int(buf[1]) {
+		return nil, errors.New("PUBLISH without topic")
+	}
+	l := 2 + int(buf[0])<<8 + int(buf[1])
+	pub.topic, buf = string(buf[2:l]), buf[l:]
+	if pub.qos != 0 {
+		if len(buf) < 2 {
+			return nil, errors.New("PUBLISH without message id")
+		}
+		pub.mid, buf = int(buf[0])<<8+int(buf[1]), buf[2:]
+	}
+	pub.payload = string(buf)
+	return pub, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// encode returns a packet with the first header byte b0 and the body parts.
+func encode(b0 byte, parts ...[]byte) []byte {
+
+	var body []byte
+	for _, part := range parts {
+		body = append(body, part...)
+	}
+
+	buf := []byte{b0}
+	l := len(body)
+	for {
+		b := byte(l & 0x7f)
+		l >>= 7
+		if l != 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if l == 0 {
+			break
+		}
+	}
+	return append(buf, body...)
+}
+
+// str encodes a length-prefixed string.
+func str(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// id encodes a message id.
+func id(mid int) []byte {
+	return []byte{byte(mid >> 8), byte(mid)}
+}
+
+// connectOptions are the fields of a CONNECT packet.
+type connectOptions struct {
+	protocol  string
+	version   byte
+	clientID  string
+	dirty     bool // no clean session
+	keepAlive uint16
+	will      *publish
+	username  *string
+	password  *string
+}
+
+func (o *connectOptions) encode() []byte {
+
+	var flags byte
+	if !o.dirty {
+		flags |= 0x02
+	}
+	payload := str(o.clientID)
+	if o.will != nil {
+		flags |= 0x04 | o.will.qos<<3
+		if o.will.retain {
+			flags |= 0x20
+		}
+		payload = append(payload, str(o.will.topic)...)
+		payload = append(payload, str(o.will.payload)...)
+	}
+	if o.username != nil {
+		flags |= 0x80
+		payload = append(payload, str(*o.username)...)
+	}
+	if o.password != nil {
+		flags |= 0x40
+		payload = append(payload, str(*o.password)...)
+	}
+	return encode(mqtt.CONNECT<<4,
+		str(o.protocol),
+		[]byte{o.version, flags, byte(o.keepAlive >> 8), byte(o.keepAlive)},
+		payload)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// conn is a connection to the broker. A goroutine reads all packets, so the
+// broker never blocks writing to the connection.
+type conn struct {
+	t       *testing.T
+	name    string
+	conn    net.Conn
+	timeout time.Duration
+	packets chan *packet
+	err     error // set before packets is closed
+}
+
+// dial opens a connection without sending the CONNECT.
+func (s *Suite) dial(t *testing.T, name string) *conn {
+
+	t.Helper()
+	nc, err := s.Dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c := &conn{
+		t:       t,
+		name:    name,
+		conn:    nc,
+		timeout: s.Timeout,
+		packets: make(chan *packet, 100),
+	}
+	t.Cleanup(func() { nc.Close() })
+	go c.read()
+	return c
+}
+
+// connect opens a connection with a clean session and waits for the CONNACK.
+func (s *Suite) connect(t *testing.T, name string) *conn {
+
+	t.Helper()
+	c := s.dial(t, name)
+	c.connect(&connectOptions{clientID: s.clientID(name)})
+	return c
+}
+
+// clientID returns a client id of this run with at most 23 characters, as
+// MQTT 3.1 asks for.
+func (s *Suite) clientID(name string) string {
+
+	id := s.prefix[len("conformance/"):len(s.prefix)-1] + "-" + name
+	if len(id) > 23 {
+		id = id[:23]
+	}
+	return id
+}
+
+func (c *conn) read() {
+
+	r := bufio.NewReader(c.conn)
+	defer close(c.packets)
+	for {
+		b0, err := r.ReadByte()
+		if err != nil {
+			c.err = err
+			return
+		}
+		var l, shift int
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				c.err = err
+				return
+			}
+			l |= int(b&0x7f) << shift
+			shift += 7
+			if b&0x80 == 0 {
+				break
+			}
+			if shift > 21 {
+				c.err = errors.New("invalid remaining length")
+				return
+			}
+		}
+		p := &packet{b0: b0, body: make([]byte, l)}
+		if _, err := io.ReadFull(r, p.body); err != nil {
+			c.err = err
+			return
+		}
+		c.packets <- p
+	}
+}
+
+func (c *conn) send(packets ...[]byte) {
+
+	c.t.Helper()
+	for _, p := range packets {
+		c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+		if _, err := c.conn.Write(p); err != nil {
+			c.t.Fatalf("%s: write: %v", c.name, err)
+		}
+	}
+}
+
+// sendMalformed sends a packet that makes the broker close the connection,
+// maybe before the whole packet has been written.
+func (c *conn) sendMalformed(p []byte) {
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	c.conn.Write(p)
+}
+
+// next returns the next packet, or nil if the connection has been closed.
+func (c *conn) next() *packet {
+
+	c.t.Helper()
+	select {
+	case p, ok := <-c.packets:
+		if !ok {
+			return nil
+		}
+		return p
+	case <-time.After(c.timeout):
+		c.t.Fatalf("%s: no packet within %v", c.name, c.timeout)
+		return nil
+	}
+}
+
+// expect returns the next packet, which must be of the message type.
+func (c *conn) expect(mtype byte) *packet {
+
+	c.t.Helper()
+	p := c.next()
+	if p == nil {
+		c.t.Fatalf("%s: connection closed (%v), expected packet type %d", c.name, c.err, mtype)
+	}
+	if p.mtype() != mtype {
+		c.t.Fatalf("%s: got %v, expected packet type %d", c.name, p, mtype)
+	}
+	return p
+}
+
+// expectPublish returns the next packet, which must be a PUBLISH of the
+// topic, payload and qos.
+func (c *conn) expectPublish(topic, payload string, qos byte) *publish {
+
+	c.t.Helper()
+	pub, err := c.expect(mqtt.PUBLISH).publish()
+	if err != nil {
+		c.t.Fatalf("%s: %v", c.name, err)
+	}
+	if pub.topic != topic || pub.payload != payload || pub.qos != qos {
+		c.t.Fatalf("%s: got PUBLISH %q %q at QoS %d, expected %q %q at QoS %d",
+			c.name, pub.topic, pub.payload, pub.qos, topic, payload, qos)
+	}
+	if qos != 0 && pub.mid == 0 {
+		c.t.Errorf("%s: PUBLISH with message id 0", c.name)
+	}
+	return pub
+}
+
+// expectAck reads an acknowledgement of the type with the message id.
+func (c *conn) expectAck(mtype byte, mid int) {
+
+	c.t.Helper()
+	p := c.expect(mtype)
+	if len(p.body) != 2 || int(p.body[0])<<8+int(p.body[1]) != mid {
+		c.t.Fatalf("%s: got %v with body %x, expected message id %d", c.name, p, p.body, mid)
+	}
+}
+
+// expectNothing makes sure that no packet arrives within the timeout.
+func (c *conn) expectNothing() {
+
+	c.t.Helper()
+	select {
+	case p, ok := <-c.packets:
+		if ok {
+			c.t.Fatalf("%s: unexpected %v", c.name, p)
+		}
+		c.t.Fatalf("%s: connection closed: %v", c.name, c.err)
+	case <-time.After(c.timeout):
+	}
+}
+
+// expectClosed makes sure that the broker closes the connection without
+// sending other packets than allowed.
+func (c *conn) expectClosed(allowed ...byte) {
+
+	c.t.Helper()
+	for {
+		select {
+		case p, ok := <-c.packets:
+			if !ok {
+				return
+			}
+			ok = false
+			for _, mtype := range allowed {
+				ok = ok || p.mtype() == mtype
+			}
+			if !ok {
+				c.t.Fatalf("%s: unexpected %v, expected the connection to be closed", c.name, p)
+			}
+		case <-time.After(c.timeout):
+			c.t.Fatalf("%s: connection not closed within %v", c.name, c.timeout)
+		}
+	}
+}
+
+// connect sends the CONNECT and expects an accepting CONNACK.
+func (c *conn) connect(o *connectOptions) {
+
+	c.t.Helper()
+	if o.protocol == "" {
+		o.protocol, o.version = "MQIsdp", 3
+	}
+	c.send(o.encode())
+	if code := c.connack(); code != mqtt.ACCEPTED {
+		c.t.Fatalf("%s: CONNACK return code %d", c.name, code)
+	}
+}
+
+// connack reads the CONNACK and returns the return code.
+func (c *conn) connack() byte {
+
+	c.t.Helper()
+	p := c.expect(mqtt.CONNACK)
+	if len(p.body) != 2 {
+		c.t.Fatalf("%s: CONNACK with %d bytes", c.name, len(p.body))
+	}
+	return p.body[1]
+}
+
+// subscribe subscribes to the filter and checks the granted qos.
+func (c *conn) subscribe(filter string, qos byte) {
+
+	c.t.Helper()
+	c.send(encode(mqtt.SUBSCRIBE<<4|0x02, id(1), str(filter), []byte{qos}))
+	p := c.expect(mqtt.SUBACK)
+	if len(p.body) != 3 || p.body[0] != 0 || p.body[1] != 1 || p.body[2] != qos {
+		c.t.Fatalf("%s: SUBACK %x, expected message id 1 and QoS %d", c.name, p.body, qos)
+	}
+}
+
+// publish publishes a message and completes the QoS flow.
+func (c *conn) publish(topic, payload string, qos byte, retain bool) {
+
+	c.t.Helper()
+	b0 := byte(mqtt.PUBLISH<<4) | qos<<1
+	if retain {
+		b0 |= 0x01
+	}
+	switch qos {
+	case 0:
+		c.send(encode(b0, str(topic), []byte(payload)))
+	case 1:
+		c.send(encode(b0, str(topic), id(7), []byte(payload)))
+		c.expectAck(mqtt.PUBACK, 7)
+	case 2:
+		c.send(encode(b0, str(topic), id(7), []byte(payload)))
+		c.expectAck(mqtt.PUBREC, 7)
+		c.send(encode(mqtt.PUBREL<<4|0x02, id(7)))
+		c.expectAck(mqtt.PUBCOMP, 7)
+	}
+}
+
+// disconnect sends a DISCONNECT.
+func (c *conn) disconnect() {
+
+	c.t.Helper()
+	c.send(encode(mqtt.DISCONNECT << 4))
+	c.expectClosed()
+}
@@ -0,0 +1,34 @@
+package conformance
+
+import (
+	"flag"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/j-forster/mqtt"
+)
+
+var broker = flag.String("broker", "", "address of a broker to test instead of the in-process server")
+
+func TestConformance(t *testing.T) {
+
+	suite := Suite{Dial: func() (net.Conn, error) {
+		return net.Dial("tcp", *broker)
+	}}
+
+	if *broker == "" {
+		server := mqtt.NewServer(nil, nil)
+		go server.Run()
+		defer server.Close()
+
+		suite.Timeout = 200 * time.Millisecond
+		suite.Dial = func() (net.Conn, error) {
+			conn, pipe := net.Pipe()
+			go server.Serve(pipe)
+			return conn, nil
+		}
+	}
+
+	suite.Run(t)
+}
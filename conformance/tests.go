@@ -0,0 +1,556 @@
+package conformance
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/j-forster/mqtt"
+)
+
+// tests of the suite, in the order they run
+var tests = []struct {
+	name string
+	fn   func(s *Suite, t *testing.T)
+}{
+	{"Connect", (*Suite).testConnect},
+	{"ConnectCredentials", (*Suite).testConnectCredentials},
+	{"ConnectProtocolVersion", (*Suite).testConnectProtocolVersion},
+	{"ConnectProtocolName", (*Suite).testConnectProtocolName},
+	{"ConnectFirst", (*Suite).testConnectFirst},
+	{"SecondConnect", (*Suite).testSecondConnect},
+	{"Takeover", (*Suite).testTakeover},
+	{"Ping", (*Suite).testPing},
+	{"QoS0", (*Suite).testQoS0},
+	{"QoS1", (*Suite).testQoS1},
+	{"QoS2", (*Suite).testQoS2},
+	{"QoS2Duplicate", (*Suite).testQoS2Duplicate},
+	{"Downgrade", (*Suite).testDowngrade},
+	{"SubscribeMany", (*Suite).testSubscribeMany},
+	{"Resubscribe", (*Suite).testResubscribe},
+	{"Unsubscribe", (*Suite).testUnsubscribe},
+	{"Wildcards", (*Suite).testWildcards},
+	{"DollarTopics", (*Suite).testDollarTopics},
+	{"Retained", (*Suite).testRetained},
+	{"RetainedWildcard", (*Suite).testRetainedWildcard},
+	{"RetainedClear", (*Suite).testRetainedClear},
+	{"Will", (*Suite).testWill},
+	{"WillRetained", (*Suite).testWillRetained},
+	{"NoWillOnDisconnect", (*Suite).testNoWillOnDisconnect},
+	{"Session", (*Suite).testSession},
+	{"KeepAlive", (*Suite).testKeepAlive},
+	{"Malformed", (*Suite).testMalformed},
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// CONNECT
+
+func (s *Suite) testConnect(t *testing.T) {
+
+	c := s.dial(t, "c")
+	c.connect(&connectOptions{clientID: s.clientID("c"), keepAlive: 60})
+	c.disconnect()
+}
+
+func (s *Suite) testConnectCredentials(t *testing.T) {
+
+	// brokers that allow anonymous clients may still check credentials,
+	// so only the encoding of the fields is tested
+	user, pass := "", ""
+	c := s.dial(t, "c")
+	c.send((&connectOptions{
+		protocol: "MQIsdp",
+		version:  3,
+		clientID: s.clientID("c"),
+		username: &user,
+		password: &pass,
+	}).encode())
+	if code := c.connack(); code != mqtt.ACCEPTED {
+		if code != mqtt.BAD_USER_OR_PASS && code != mqtt.NOT_AUTHORIZED {
+			t.Errorf("CONNACK return code %d", code)
+		}
+		c.expectClosed()
+	}
+}
+
+func (s *Suite) testConnectProtocolVersion(t *testing.T) {
+
+	c := s.dial(t, "c")
+	c.send((&connectOptions{protocol: "MQIsdp", version: 42, clientID: s.clientID("c")}).encode())
+	if code := c.connack(); code != mqtt.UNACCEPTABLE_PROTOV {
+		t.Errorf("CONNACK return code %d, expected %d", code, mqtt.UNACCEPTABLE_PROTOV)
+	}
+	c.expectClosed()
+}
+
+func (s *Suite) testConnectProtocolName(t *testing.T) {
+
+	// the broker may answer with a CONNACK before it closes the connection
+	c := s.dial(t, "c")
+	c.send((&connectOptions{protocol: "MQTX", version: 3, clientID: s.clientID("c")}).encode())
+	p := c.next()
+	if p != nil && p.mtype() == mqtt.CONNACK {
+		if len(p.body) == 2 && p.body[1] == mqtt.ACCEPTED {
+			t.Fatal("unknown protocol accepted")
+		}
+		p = c.next()
+	}
+	if p != nil {
+		t.Fatalf("unexpected %v", p)
+	}
+}
+
+func (s *Suite) testConnectFirst(t *testing.T) {
+
+	topic := s.topic(t, "x")
+	sub := s.connect(t, "sub")
+	sub.subscribe(topic, 0)
+
+	c := s.dial(t, "c")
+	c.send(encode(mqtt.PUBLISH<<4, str(topic), []byte("no CONNECT")))
+	c.expectClosed()
+	sub.expectNothing()
+}
+
+func (s *Suite) testSecondConnect(t *testing.T) {
+
+	c := s.connect(t, "c")
+	c.send((&connectOptions{protocol: "MQIsdp", version: 3, clientID: s.clientID("c")}).encode())
+	c.expectClosed()
+}
+
+func (s *Suite) testTakeover(t *testing.T) {
+
+	// a new connection with the same client id closes the old one
+	old := s.connect(t, "c")
+	s.connect(t, "c")
+	old.expectClosed()
+}
+
+func (s *Suite) testPing(t *testing.T) {
+
+	c := s.connect(t, "c")
+	c.send(encode(mqtt.PINGREQ << 4))
+	if p := c.expect(mqtt.PINGRESP); p.b0 != mqtt.PINGRESP<<4 || len(p.body) != 0 {
+		t.Errorf("invalid %v", p)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// QoS flows
+
+func (s *Suite) testQoS0(t *testing.T) {
+
+	topic := s.topic(t, "x")
+	sub := s.connect(t, "sub")
+	sub.subscribe(topic, 0)
+
+	pub := s.connect(t, "pub")
+	pub.publish(topic, "hello", 0, false)
+	sub.expectPublish(topic, "hello", 0)
+
+	// an empty payload is a valid message
+	pub.publish(topic, "", 0, false)
+	sub.expectPublish(topic, "", 0)
+}
+
+func (s *Suite) testQoS1(t *testing.T) {
+
+	topic := s.topic(t, "x")
+	sub := s.connect(t, "sub")
+	sub.subscribe(topic, 1)
+
+	pub := s.connect(t, "pub")
+	pub.publish(topic, "hello", 1, false)
+
+	p := sub.expectPublish(topic, "hello", 1)
+	sub.send(encode(mqtt.PUBACK<<4, id(p.mid)))
+	sub.expectNothing()
+}
+
+func (s *Suite) testQoS2(t *testing.T) {
+
+	topic := s.topic(t, "x")
+	sub := s.connect(t, "sub")
+	sub.subscribe(topic, 2)
+
+	pub := s.connect(t, "pub")
+	pub.publish(topic, "hello", 2, false)
+
+	p := sub.expectPublish(topic, "hello", 2)
+	sub.send(encode(mqtt.PUBREC<<4, id(p.mid)))
+	sub.expectAck(mqtt.PUBREL, p.mid)
+	sub.send(encode(mqtt.PUBCOMP<<4, id(p.mid)))
+	sub.expectNothing()
+}
+
+func (s *Suite) testQoS2Duplicate(t *testing.T) {
+
+	// a QoS 2 message sent twice before the PUBREL is delivered once
+	topic := s.topic(t, "x")
+	sub := s.connect(t, "sub")
+	sub.subscribe(topic, 0)
+
+	pub := s.connect(t, "pub")
+	publish := encode(mqtt.PUBLISH<<4|2<<1, str(topic), id(9), []byte("once"))
+	pub.send(publish)
+	pub.expectAck(mqtt.PUBREC, 9)
+	publish[0] |= 0x08 // DUP
+	pub.send(publish)
+	pub.expectAck(mqtt.PUBREC, 9)
+	pub.send(encode(mqtt.PUBREL<<4|0x02, id(9)))
+	pub.expectAck(mqtt.PUBCOMP, 9)
+
+	sub.expectPublish(topic, "once", 0)
+	sub.expectNothing()
+}
+
+func (s *Suite) testDowngrade(t *testing.T) {
+
+	// messages are delivered at the lower QoS of message and subscription
+	topic := s.topic(t, "x")
+	sub0 := s.connect(t, "sub0")
+	sub0.subscribe(topic, 0)
+	sub1 := s.connect(t, "sub1")
+	sub1.subscribe(topic, 1)
+
+	pub := s.connect(t, "pub")
+	pub.publish(topic, "two", 2, false)
+	sub0.expectPublish(topic, "two", 0)
+	p := sub1.expectPublish(topic, "two", 1)
+	sub1.send(encode(mqtt.PUBACK<<4, id(p.mid)))
+
+	pub.publish(topic, "zero", 0, false)
+	sub0.expectPublish(topic, "zero", 0)
+	sub1.expectPublish(topic, "zero", 0)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// SUBSCRIBE and UNSUBSCRIBE
+
+func (s *Suite) testSubscribeMany(t *testing.T) {
+
+	// one SUBACK with a granted QoS per topic
+	a, b := s.topic(t, "a"), s.topic(t, "b")
+	c := s.connect(t, "c")
+	c.send(encode(mqtt.SUBSCRIBE<<4|0x02, id(0x1234), str(a), []byte{2}, str(b), []byte{0}))
+	p := c.expect(mqtt.SUBACK)
+	if string(p.body) != "\x12\x34\x02\x00" {
+		t.Errorf("SUBACK %x", p.body)
+	}
+
+	c.publish(b, "b", 0, false)
+	c.expectPublish(b, "b", 0)
+}
+
+func (s *Suite) testResubscribe(t *testing.T) {
+
+	// subscribing again replaces the subscription and does not duplicate it
+	topic := s.topic(t, "x")
+	c := s.connect(t, "c")
+	c.subscribe(topic, 0)
+	c.subscribe(topic, 1)
+
+	pub := s.connect(t, "pub")
+	pub.publish(topic, "hello", 1, false)
+	p := c.expectPublish(topic, "hello", 1)
+	c.send(encode(mqtt.PUBACK<<4, id(p.mid)))
+	c.expectNothing()
+}
+
+func (s *Suite) testUnsubscribe(t *testing.T) {
+
+	a, b := s.topic(t, "a"), s.topic(t, "b")
+	c := s.connect(t, "c")
+	c.subscribe(a, 0)
+	c.subscribe(b, 0)
+
+	c.send(encode(mqtt.UNSUBSCRIBE<<4|0x02, id(0x4321), str(a), str(s.topic(t, "unknown"))))
+	c.expectAck(mqtt.UNSUBACK, 0x4321)
+
+	pub := s.connect(t, "pub")
+	pub.publish(a, "a", 0, false)
+	pub.publish(b, "b", 0, false)
+	c.expectPublish(b, "b", 0)
+	c.expectNothing()
+}
+
+func (s *Suite) testWildcards(t *testing.T) {
+
+	base := s.topic(t, "")
+	c := s.connect(t, "c")
+	c.subscribe(base+"a/+/c", 0)
+	c.subscribe(base+"b/#", 0)
+
+	pub := s.connect(t, "pub")
+	for _, topic := range []string{"a/b/c", "a/b/c/d", "a/c", "b", "b/x/y", "c/b"} {
+		pub.publish(base+topic, topic, 0, false)
+	}
+
+	// 'b/#' also matches 'b'
+	c.expectPublish(base+"a/b/c", "a/b/c", 0)
+	c.expectPublish(base+"b", "b", 0)
+	c.expectPublish(base+"b/x/y", "b/x/y", 0)
+	c.expectNothing()
+}
+
+func (s *Suite) testDollarTopics(t *testing.T) {
+
+	// wildcards at the first level do not match topics starting with '$'
+	topic := "$" + s.topic(t, "x")
+	c := s.connect(t, "c")
+	c.subscribe("#", 0)
+	c.subscribe("+/"+strings.SplitN(topic, "/", 2)[1], 0)
+	c.subscribe(topic, 0)
+
+	pub := s.connect(t, "pub")
+	pub.publish(topic, "hello", 0, false)
+
+	for {
+		p, err := c.expect(mqtt.PUBLISH).publish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// other clients may publish to '#'
+		if strings.HasPrefix(p.topic, "$") {
+			if p.topic != topic {
+				t.Fatalf("unexpected message to %s", p.topic)
+			}
+			break
+		}
+	}
+	for {
+		select {
+		case p, ok := <-c.packets:
+			if !ok {
+				t.Fatalf("connection closed: %v", c.err)
+			}
+			if pub, err := p.publish(); err == nil && pub.topic == topic {
+				t.Fatal("wildcard at the first level matched a '$' topic")
+			}
+			continue
+		case <-time.After(s.Timeout):
+		}
+		break
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// retained messages
+
+func (s *Suite) testRetained(t *testing.T) {
+
+	topic := s.topic(t, "x")
+	pub := s.connect(t, "pub")
+	pub.publish(topic, "first", 1, true)
+	pub.publish(topic, "second", 1, true)
+
+	// new subscribers get the last retained message, with the retain flag
+	sub := s.connect(t, "sub")
+	sub.subscribe(topic, 1)
+	p := sub.expectPublish(topic, "second", 1)
+	if !p.retain {
+		t.Error("retained message without retain flag")
+	}
+	sub.send(encode(mqtt.PUBACK<<4, id(p.mid)))
+	sub.expectNothing()
+
+	pub.publish(topic, "", 0, true)
+}
+
+func (s *Suite) testRetainedWildcard(t *testing.T) {
+
+	base := s.topic(t, "")
+	pub := s.connect(t, "pub")
+	pub.publish(base+"a/1", "1", 0, true)
+	pub.publish(base+"a/2", "2", 0, true)
+	pub.publish(base+"b", "b", 0, true)
+
+	sub := s.connect(t, "sub")
+	sub.subscribe(base+"a/+", 0)
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		p, err := sub.expect(mqtt.PUBLISH).publish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.retain {
+			t.Errorf("%s without retain flag", p.topic)
+		}
+		got[p.topic] = true
+	}
+	if !got[base+"a/1"] || !got[base+"a/2"] {
+		t.Errorf("got retained messages %v", got)
+	}
+	sub.expectNothing()
+
+	for _, topic := range []string{"a/1", "a/2", "b"} {
+		pub.publish(base+topic, "", 0, true)
+	}
+}
+
+func (s *Suite) testRetainedClear(t *testing.T) {
+
+	// a retained message with an empty payload clears the retained message
+	topic := s.topic(t, "x")
+	pub := s.connect(t, "pub")
+	pub.publish(topic, "hello", 0, true)
+	pub.publish(topic, "", 0, true)
+
+	sub := s.connect(t, "sub")
+	sub.subscribe(topic, 0)
+	sub.expectNothing()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// wills
+
+func (s *Suite) testWill(t *testing.T) {
+
+	topic := s.topic(t, "will")
+	sub := s.connect(t, "sub")
+	sub.subscribe(topic, 1)
+
+	c := s.dial(t, "c")
+	c.connect(&connectOptions{
+		clientID: s.clientID("c"),
+		will:     &publish{topic: topic, payload: "gone", qos: 1},
+	})
+	c.conn.Close() // without DISCONNECT
+
+	p := sub.expectPublish(topic, "gone", 1)
+	sub.send(encode(mqtt.PUBACK<<4, id(p.mid)))
+}
+
+func (s *Suite) testWillRetained(t *testing.T) {
+
+	topic := s.topic(t, "will")
+	c := s.dial(t, "c")
+	c.connect(&connectOptions{
+		clientID: s.clientID("c"),
+		will:     &publish{topic: topic, payload: "gone", retain: true},
+	})
+	c.conn.Close()
+
+	// wait for the will
+	time.Sleep(s.Timeout / 4)
+
+	sub := s.connect(t, "sub")
+	sub.subscribe(topic, 0)
+	if p := sub.expectPublish(topic, "gone", 0); !p.retain {
+		t.Error("retained will without retain flag")
+	}
+	sub.publish(topic, "", 0, true)
+}
+
+func (s *Suite) testNoWillOnDisconnect(t *testing.T) {
+
+	topic := s.topic(t, "will")
+	sub := s.connect(t, "sub")
+	sub.subscribe(topic, 0)
+
+	c := s.dial(t, "c")
+	c.connect(&connectOptions{
+		clientID: s.clientID("c"),
+		will:     &publish{topic: topic, payload: "gone"},
+	})
+	c.disconnect()
+	sub.expectNothing()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// sessions
+
+func (s *Suite) testSession(t *testing.T) {
+
+	// subscriptions and QoS 1 messages of a session without clean flag
+	// survive a reconnect
+	topic := s.topic(t, "x")
+	o := &connectOptions{clientID: s.clientID("c"), dirty: true}
+
+	c := s.dial(t, "c")
+	c.connect(o)
+	c.subscribe(topic, 1)
+	c.disconnect()
+
+	pub := s.connect(t, "pub")
+	pub.publish(topic, "queued", 1, false)
+
+	c = s.dial(t, "c")
+	c.connect(o)
+	p := c.expectPublish(topic, "queued", 1)
+	c.send(encode(mqtt.PUBACK<<4, id(p.mid)))
+	c.disconnect()
+
+	// a clean session discards the session
+	c = s.dial(t, "c")
+	c.connect(&connectOptions{clientID: s.clientID("c")})
+	pub.publish(topic, "lost", 1, false)
+	c.expectNothing()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// keep alive
+
+func (s *Suite) testKeepAlive(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip("keep alive test in short mode")
+	}
+
+	topic := s.topic(t, "will")
+	sub := s.connect(t, "sub")
+	sub.subscribe(topic, 0)
+
+	c := s.dial(t, "c")
+	c.connect(&connectOptions{
+		clientID:  s.clientID("c"),
+		keepAlive: 1,
+		will:      &publish{topic: topic, payload: "timeout"},
+	})
+
+	// pings keep the connection open
+	for i := 0; i < 3; i++ {
+		time.Sleep(700 * time.Millisecond)
+		c.send(encode(mqtt.PINGREQ << 4))
+		c.expect(mqtt.PINGRESP)
+	}
+
+	// the broker closes the connection after 1.5 times the keep alive
+	// period without packets, and publishes the will
+	c.timeout = 2*time.Second + s.Timeout
+	c.expectClosed()
+	sub.expectPublish(topic, "timeout", 0)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// malformed input
+
+func (s *Suite) testMalformed(t *testing.T) {
+
+	topic := s.topic(t, "x")
+	for name, p := range map[string][]byte{
+		"ReservedType0":      encode(0x00),
+		"ReservedType15":     encode(0xf0),
+		"RemainingLength":    {mqtt.PINGREQ << 4, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"PublishQoS3":        encode(mqtt.PUBLISH<<4|3<<1, str(topic), id(1)),
+		"PublishWildcard":    encode(mqtt.PUBLISH<<4, str(s.topic(t, "+"))),
+		"PublishTopicLength": encode(mqtt.PUBLISH<<4, []byte{0xff, 0xff}, []byte("a/b")),
+		"PublishNoMessageID": encode(mqtt.PUBLISH<<4|1<<1, str(topic)),
+		"SubscribeFlags":     encode(mqtt.SUBSCRIBE<<4, id(1), str(topic), []byte{0}),
+		"SubscribeNoTopics":  encode(mqtt.SUBSCRIBE<<4|0x02, id(1)),
+		"SubscribeNoQoS":     encode(mqtt.SUBSCRIBE<<4|0x02, id(1), str(topic)),
+		"SubscribeLength":    encode(mqtt.SUBSCRIBE<<4|0x02, id(1), []byte{0x00, 0x09, 'a'}),
+		"UnsubscribeFlags":   encode(mqtt.UNSUBSCRIBE<<4, id(1), str(topic)),
+		"PubrelFlags":        encode(mqtt.PUBREL<<4, id(1)),
+		"PingreqFlags":       encode(mqtt.PINGREQ<<4 | 0x01),
+		"ServerPacket":       encode(mqtt.CONNACK<<4, []byte{0, 0}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := s.connect(t, "c")
+			c.sendMalformed(p)
+			c.expectClosed()
+		})
+	}
+}
@@ -1,15 +1,25 @@
 package mqtt
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/j-forster/mqtt/topics"
 )
 
 const (
 	CONNECTING = 0
 	CONNECTED  = 1
-	CLOSING    = 3
-	CLOSED     = 4
+	// AUTHENTICATING waits for the decision of an AsyncConnectHandler.
+	AUTHENTICATING = 2
+	CLOSING        = 3
+	CLOSED         = 4
 )
 
 type Publisher interface {
@@ -25,21 +35,80 @@ type Context struct {
 	writer io.Writer
 	closer io.Closer
 	server *Server
+	// the endpoint the client connected to, if any
+	endpoint *Endpoint
+	// the server limits, with the overrides of the endpoint
+	limits Limits
+	// the function of SubscribeFunc, for contexts without connection
+	local *localSubscriber
 	// publisher Publisher
 	// subsHandler SubscriptionHandler
 
 	//	server   *Server
 	ClientID string
+	Username string
+
+	// ProtocolVersion is the protocol level of the CONNECT message.
+	ProtocolVersion byte
+
+	// CleanSession and KeepAlive as requested by the client at CONNECT.
+	CleanSession bool
+	KeepAlive    time.Duration
+
+	// RemoteAddr is the network address of the client, if known.
+	RemoteAddr net.Addr
+
+	// LogPackets enables debug logging of the type and length of every
+	// packet sent to or received from this client. It can be set by the
+	// Handler, e.g. at Connect.
+	LogPackets bool
+
+	// Tracer records the packets of this client byte by byte, see Tracer.
+	// It defaults to the Tracer of the server, and can be changed by the
+	// Handler at Connect.
+	Tracer Tracer
+
+	// the number of the connection, for traces
+	conn int64
+
+	wmu sync.Mutex
+	// rmu serializes the handling of received packets
+	rmu sync.Mutex
+
+	// packets received while authenticating
+	pending []packet
+
+	// messages waiting for the decision of an AsyncPublishHandler
+	dmu       sync.Mutex
+	decisions []pendingPublish
+	deciding  bool
 
 	state int
 
 	mid int
 
+	// Will is published when the connection is lost or closed by the server,
+	// but not after a DISCONNECT, and not when a new connection of the same
+	// client id takes this one over.
 	Will *Message
 
 	messages map[int]*Message
+	inflight map[int]*Message
 	subs     map[string]*Subscription
 	values   map[string]interface{}
+
+	// a connection taken over by a new connection of the same client id
+	// does not publish its will. closed is closed once Close is done.
+	// abandoned is set if the new connection did not wait for Close, its
+	// session is not stored then.
+	takenOver bool
+	abandoned bool
+	closed    chan struct{}
+
+	// a closed context is kept as stored session if persistent is set
+	persistent bool
+	queue      []queued
+	expiry     *time.Timer
 }
 
 func NewContext(w io.Writer, c io.Closer, server *Server) *Context {
@@ -48,9 +117,12 @@ func NewContext(w io.Writer, c io.Closer, server *Server) *Context {
 		writer:   w,
 		closer:   c,
 		server:   server,
+		limits:   server.Limits,
 		messages: make(map[int]*Message),
+		inflight: make(map[int]*Message),
 		values:   make(map[string]interface{}),
-		subs:     make(map[string]*Subscription)}
+		subs:     make(map[string]*Subscription),
+		closed:   make(chan struct{})}
 
 	return ctx
 }
@@ -70,8 +142,26 @@ func (ctx *Context) Set(key string, value interface{}) {
 }
 
 func (ctx *Context) Alive() bool {
+	return ctx.getState() != CLOSED
+}
+
+// getState returns the connection state. The state changes to CLOSED from
+// any goroutine, all other changes are made by the reading goroutine.
+func (ctx *Context) getState() int {
+
+	ctx.wmu.Lock()
+	defer ctx.wmu.Unlock()
+	return ctx.state
+}
+
+// setState changes the connection state unless the connection is closed.
+func (ctx *Context) setState(state int) {
 
-	return ctx.state != CLOSED
+	ctx.wmu.Lock()
+	if ctx.state != CLOSED {
+		ctx.state = state
+	}
+	ctx.wmu.Unlock()
 }
 
 func (ctx *Context) Write(data []byte) (n int, err error) {
@@ -79,18 +169,75 @@ func (ctx *Context) Write(data []byte) (n int, err error) {
 	return
 }
 
-func (ctx *Context) Close() error {
+// Log returns a logger that adds the client id and remote address
+// to every log entry.
+func (ctx *Context) Log() Logger {
+	return contextLogger{ctx}
+}
 
-	if ctx.state != CLOSED {
+// send writes one mqtt message to the client. The first buffer must start
+// with the fixed header. The buffers are written without being interleaved
+// with other messages to this client.
+func (ctx *Context) send(bufs ...[]byte) {
 
+	ctx.wmu.Lock()
+	if ctx.Tracer != nil {
+		ctx.Tracer.Trace(ctx, TraceOut, bytes.Join(bufs, nil))
+	}
+	var n int
+	for _, buf := range bufs {
+		m, _ := ctx.Write(buf)
+		n += m
+	}
+	ctx.wmu.Unlock()
+
+	ctx.server.Metrics.sent(bufs[0][0]>>4, n)
+
+	if ctx.LogPackets {
+		ctx.Log().Debug("packet sent",
+			"type", messageType[bufs[0][0]>>4],
+			"bytes", n)
+	}
+}
+
+func (ctx *Context) Close() error {
+
+	ctx.wmu.Lock()
+	closed := ctx.state == CLOSED
+	if !closed {
+		ctx.persistent = ctx.state == CONNECTED && !ctx.CleanSession && ctx.ClientID != "" && !ctx.abandoned
 		ctx.state = CLOSED
+	}
+	inflight := ctx.inflight
+	ctx.inflight = nil
+	ctx.wmu.Unlock()
 
-		for _, sub := range ctx.subs {
-			//ctx.server
-			ctx.server.Unsubscribe(sub)
+	if !closed {
+
+		ctx.server.cmu.Lock()
+		delete(ctx.server.clients, ctx)
+		if ctx.server.owners[ctx.ClientID] == ctx {
+			delete(ctx.server.owners, ctx.ClientID)
+		}
+		ctx.server.cmu.Unlock()
+
+		ctx.server.Metrics.outbound.Add(-int64(len(inflight)))
+		for _, msg := range inflight {
+			ctx.server.onDrop(ctx, msg, ErrClientOffline)
 		}
 
-		ctx.subs = nil
+		if ctx.persistent {
+
+			ctx.server.storeSession(ctx)
+		} else {
+
+			for _, sub := range ctx.subs {
+				//ctx.server
+				ctx.server.Unsubscribe(sub)
+			}
+
+			ctx.subs = nil
+		}
 
 		if ctx.closer != nil {
 			ctx.closer.Close()
@@ -99,25 +246,69 @@ func (ctx *Context) Close() error {
 		if ctx.server.handler != nil {
 			ctx.server.handler.Disconnect(ctx)
 		}
+
+		ctx.Log().Info("connection closed")
+		close(ctx.closed)
 	}
 	return nil
 }
 
+// Kick closes the connection from another goroutine, e.g. from a timer.
+// The goroutine reading from the connection notices and cleans up. The will
+// message is published, as for every connection that is not closed by the
+// client with a DISCONNECT.
+func (ctx *Context) Kick() {
+
+	if ctx.closer != nil {
+		ctx.closer.Close()
+	} else {
+		ctx.Close()
+	}
+}
+
 func (ctx *Context) Fail(err error) error {
 
 	if ctx.Alive() {
 
-		fmt.Println(err)
+		if errors.Is(err, io.EOF) {
+			ctx.Log().Info("connection lost")
+		} else {
+			ctx.Log().Warn("protocol error", "err", err)
+		}
 		ctx.Close()
 
-		if ctx.Will != nil {
-			ctx.server.Publish(ctx, ctx.Will)
+		ctx.wmu.Lock()
+		will := ctx.Will
+		if ctx.takenOver {
+			will = nil
+		}
+		ctx.wmu.Unlock()
+
+		if will != nil {
+			ctx.Log().Info("publishing will",
+				"topic", will.Topic,
+				"qos", will.QoS)
+			ctx.server.Publish(ctx, will)
+			ctx.server.onWill(ctx, will)
 		}
 	}
 
 	return err
 }
 
+// recoverPanic stops a panic while serving the connection, e.g. caused by a
+// malformed packet or a hook, so that it does not take down the server. The
+// connection is closed.
+func (ctx *Context) recoverPanic() {
+
+	if r := recover(); r != nil {
+		ctx.Log().Error("panic while serving connection",
+			"panic", r,
+			"stack", string(debug.Stack()))
+		ctx.Kick()
+	}
+}
+
 func (ctx *Context) Failf(format string, a ...interface{}) error {
 	return ctx.Fail(fmt.Errorf(format, a...))
 }
@@ -132,7 +323,7 @@ func Head(b0 byte, length int, total int) ([]byte, []byte) {
 		return buf, buf[2:]
 	}
 
-	if length < 0x8000 {
+	if length < 0x4000 {
 		buf := make([]byte, 3+total)
 		buf[0] = b0
 		buf[1] = byte(length&127) | 0x80
@@ -140,7 +331,7 @@ func Head(b0 byte, length int, total int) ([]byte, []byte) {
 		return buf, buf[3:]
 	}
 
-	if length < 0x800000 {
+	if length < 0x200000 {
 		buf := make([]byte, 4+total)
 		buf[0] = b0
 		buf[1] = byte(length&127) | 0x80
@@ -149,7 +340,7 @@ func Head(b0 byte, length int, total int) ([]byte, []byte) {
 		return buf, buf[4:]
 	}
 
-	if length < 0x80000000 {
+	if length < 0x10000000 {
 		buf := make([]byte, 5+total)
 		buf[0] = b0
 		buf[1] = byte(length&127) | 0x80
@@ -170,69 +361,134 @@ func (ctx *Context) ConnAck(code byte) {
 	buf[1] = 0x02 // remaining length: 2
 	buf[3] = code
 
-	ctx.Write(buf)
+	ctx.send(buf)
 	if code != 0 {
 		ctx.Close()
 	}
 }
 
+// Subscribe subscribes the client to a topic, or updates the qos if the
+// client already subscribed to that topic. It returns the granted qos or
+// SUBSCRIBE_FAILURE if the handler rejected the subscription or a limit is
+// exceeded. A rejected resubscription keeps the existing subscription.
 func (ctx *Context) Subscribe(topic string, qos byte) byte {
 
 	sub, ok := ctx.subs[topic]
-	if !ok {
-		//sub = new(Subscription)
-		//sub.ctx = ctx
-		//sub.qos = qos
-		//ctx.server.Subscribe(topic, sub)
-		sub = ctx.server.Subscribe(ctx, topic, qos)
-
-		if sub != nil {
+	if ok {
+		return ctx.server.Resubscribe(ctx, topic, sub, qos)
+	}
 
-			ctx.subs[topic] = sub
-		} else {
+	err := ctx.limits.checkTopic(topic)
+	if err == nil && !topics.ValidFilter(topic) {
+		err = ErrInvalidFilter
+	}
+	if err == nil && len(ctx.subs) >= ctx.limits.maxSubscriptions() {
+		err = fmt.Errorf("%w: %d subscriptions", ErrLimitExceeded, len(ctx.subs))
+	}
+	if err != nil {
+		ctx.Log().Warn("subscription rejected", "topic", topic, "err", err)
+		return SUBSCRIBE_FAILURE
+	}
 
-			// could not subscribe (the server is closing)
-			ctx.Close()
-			return 0
-		}
+	if !ctx.server.Alive() {
+		// could not subscribe (the server is closing)
+		ctx.Close()
+		return SUBSCRIBE_FAILURE
 	}
 
-	//TODO it's not qos, but sub.qos
-	// need to update the qos at the stored subscription
-	// (the client may subscribe to an already subscribed topic)
-	return qos // granted qos
+	sub, granted := ctx.server.Subscribe(ctx, topic, qos)
+	if sub != nil {
+		ctx.subs[topic] = sub
+	}
+	return granted
 }
 
 func (ctx *Context) Publish(sub *Subscription, msg *Message) {
 
+	ctx.wmu.Lock()
+	closed := ctx.state == CLOSED
+	ctx.wmu.Unlock()
+
+	if closed {
+		ctx.enqueue(sub, msg)
+		return
+	}
+
 	// qos = Min(sub.qos, msg.qos)
 	qos := sub.qos
 	if msg.QoS < qos {
 		qos = msg.QoS
 	}
 
+	if ctx.local != nil {
+		// the payload is shared with the other subscribers
+		m := *msg
+		m.QoS = qos
+		if !ctx.deliver(&m) {
+			ctx.server.onDrop(ctx, msg, ErrQueueFull)
+			return
+		}
+		ctx.server.Metrics.deliver(qos)
+		ctx.server.onDeliver(ctx, msg, qos)
+		return
+	}
+
 	switch qos {
 	case 0:
 		l := len(msg.Topic)
-		head, vhead := Head(0x30|bool2byte(msg.retain), 2+l+len(msg.Buf), 2+l)
+		head, vhead := Head(0x30|bool2byte(msg.Retain), 2+l+len(msg.Buf), 2+l)
 		vhead[0] = byte(l >> 8)
 		vhead[1] = byte(l & 0xff)
 		copy(vhead[2:], msg.Topic)
-		ctx.Write(head)
-		ctx.Write(msg.Buf)
+		ctx.send(head, msg.Buf)
 	case 1, 2:
 		l := len(msg.Topic)
-		head, vhead := Head(0x30|(qos<<1)|bool2byte(msg.retain), 2+l+2+len(msg.Buf), 2+l+2)
+		head, vhead := Head(0x30|(qos<<1)|bool2byte(msg.Retain), 2+l+2+len(msg.Buf), 2+l+2)
 		vhead[0] = byte(l >> 8)
 		vhead[1] = byte(l & 0xff)
 		copy(vhead[2:], msg.Topic)
-		ctx.mid++
-		vhead[2+l] = byte(ctx.mid >> 8)
-		vhead[2+l+1] = byte(ctx.mid & 0xff)
-		ctx.Write(head)
-		ctx.Write(msg.Buf)
 
-		//TODO store message and retry if timeout
+		ctx.wmu.Lock()
+		if ctx.inflight != nil && len(ctx.inflight) >= ctx.limits.maxInflight() {
+			ctx.wmu.Unlock()
+			ctx.server.onDrop(ctx, msg, ErrQueueFull)
+			return
+		}
+		ctx.mid = ctx.mid%0xffff + 1 // message ids are 1..65535
+		mid := ctx.mid
+		if ctx.inflight != nil {
+			if _, ok := ctx.inflight[mid]; !ok {
+				ctx.server.Metrics.outbound.Add(1)
+			}
+			ctx.inflight[mid] = msg
+		}
+		ctx.wmu.Unlock()
+
+		vhead[2+l] = byte(mid >> 8)
+		vhead[2+l+1] = byte(mid & 0xff)
+		ctx.send(head, msg.Buf)
+
+		//TODO retry if timeout
+	}
+
+	ctx.server.Metrics.deliver(qos)
+	ctx.server.onDeliver(ctx, msg, qos)
+}
+
+// acknowledged removes an outgoing message from the inflight messages
+// once the client has acknowledged it (PUBACK or PUBCOMP).
+func (ctx *Context) acknowledged(mid int) {
+
+	ctx.wmu.Lock()
+	msg, ok := ctx.inflight[mid]
+	if ok {
+		delete(ctx.inflight, mid)
+	}
+	ctx.wmu.Unlock()
+
+	if ok {
+		ctx.server.Metrics.outbound.Add(-1)
+		ctx.server.onAck(ctx, msg)
 	}
 }
 
@@ -240,7 +496,9 @@ func (ctx *Context) Unsubscribe(topic string) {
 
 	sub, ok := ctx.subs[topic]
 	if ok {
+		delete(ctx.subs, topic)
 		ctx.server.Unsubscribe(sub)
+		ctx.server.onUnsubscribe(ctx, topic)
 	}
 }
 
@@ -249,7 +507,7 @@ func (ctx *Context) PingResp() {
 	buf := make([]byte, 2)
 	buf[0] = 0xD0 // PINGRESP
 	buf[1] = 0x00 // remaining length: 0
-	ctx.Write(buf)
+	ctx.send(buf)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,204 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// str encodes a string as a length-prefixed mqtt string.
+func str(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func FuzzFixedHeaderRead(f *testing.F) {
+
+	f.Add([]byte{0x10, 0x00})
+	f.Add([]byte{0x30, 0x7f})
+	f.Add([]byte{0x32, 0x80, 0x01})
+	f.Add([]byte{0x82, 0xff, 0x7f})
+	f.Add([]byte{0x30, 0x80, 0x80, 0x01})
+	f.Add([]byte{0x30, 0xff, 0x00}) // non-minimal length
+	f.Add([]byte{0x62, 0xff, 0xff, 0x7f})
+	f.Add([]byte{0x30, 0xff, 0xff, 0xff, 0x7f})
+	f.Add([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Add([]byte{0x36, 0x00})
+	f.Add([]byte{0xc1, 0x00})
+	f.Add([]byte{0xf0, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		var fh FixedHeader
+		if err := fh.Read(bytes.NewReader(data)); err != nil {
+			return
+		}
+		if fh.mtype == 0 || fh.mtype == 15 || !fh.validFlags(data[0]&0x0f) {
+			t.Fatalf("accepted header %x", data[0])
+		}
+		if fh.length < 0 || fh.length >= 0x10000000 {
+			t.Fatalf("length %d out of range", fh.length)
+		}
+
+		// Head must encode the length so that it reads back the same
+		head, _ := Head(data[0], fh.length, 0)
+		var fh2 FixedHeader
+		if err := fh2.Read(bytes.NewReader(head)); err != nil || fh2 != fh {
+			t.Fatalf("Head(%d) = %x: read back %+v, %v", fh.length, head, fh2, err)
+		}
+	})
+}
+
+// fuzzPacket fuzzes the parser of one message type with the flags of the
+// fixed header and the message body.
+func fuzzPacket(f *testing.F, mtype byte, read func(ctx *Context, fh *FixedHeader, buf []byte), seeds ...[]byte) {
+
+	var flags byte
+	switch mtype {
+	case PUBLISH, PUBREL, SUBSCRIBE, UNSUBSCRIBE:
+		flags = 0x02 // QoS 1
+	}
+	for _, seed := range seeds {
+		f.Add(flags, seed)
+	}
+
+	server := NewServer(nil, nil)
+	go server.Run()
+	f.Cleanup(server.Close)
+
+	f.Fuzz(func(t *testing.T, flags byte, buf []byte) {
+
+		fh := FixedHeader{
+			mtype:  mtype,
+			dup:    flags&0x08 != 0,
+			qos:    flags & 0x06 >> 1,
+			retain: flags&0x01 != 0,
+			length: len(buf),
+		}
+		if !fh.validFlags(flags & 0x0f) {
+			return
+		}
+
+		ctx := NewContext(io.Discard, nil, server)
+		if mtype != CONNECT {
+			ctx.state = CONNECTED
+		}
+		defer ctx.Close()
+
+		ctx.rmu.Lock()
+		defer ctx.rmu.Unlock()
+		read(ctx, &fh, buf)
+	})
+}
+
+func FuzzReadConnectMessage(f *testing.F) {
+
+	fuzzPacket(f, CONNECT, func(ctx *Context, fh *FixedHeader, buf []byte) {
+		ctx.ReadConnectMessage(nil, fh, buf)
+	},
+		join(str("MQIsdp"), []byte{3, 0x02, 0, 60}, str("client")),
+		join(str("MQIsdp"), []byte{3, 0xee, 0, 60}, str("c"), str("will"), str("bye"), str("user"), str("pass")),
+		join(str("MQIsdp"), []byte{3, 0xc0, 0, 0}, str("c"), str("user")),
+		join(str("MQIsdp"), []byte{4, 0, 0, 0}),
+		join(str("MQTT"), []byte{4, 0, 0, 0}),
+		str("MQIsdp"),
+	)
+}
+
+func FuzzReadSubscribeMessage(f *testing.F) {
+
+	fuzzPacket(f, SUBSCRIBE, func(ctx *Context, fh *FixedHeader, buf []byte) {
+		ctx.ReadSubscribeMessage(nil, fh, buf)
+	},
+		join([]byte{0, 1}, str("a/+"), []byte{1}, str("#"), []byte{2}),
+		join([]byte{0, 1}, str("a/#/b"), []byte{0}),
+		join([]byte{0, 1}, str("a")),
+		[]byte{0, 1, 0, 9, 'a'},
+		[]byte{0, 1},
+	)
+}
+
+func FuzzReadUnsubscribeMessage(f *testing.F) {
+
+	fuzzPacket(f, UNSUBSCRIBE, func(ctx *Context, fh *FixedHeader, buf []byte) {
+		ctx.ReadUnsubscribeMessage(nil, fh, buf)
+	},
+		join([]byte{0, 1}, str("a/+"), str("#")),
+		[]byte{0, 1, 0, 9, 'a'},
+		[]byte{0, 1},
+	)
+}
+
+func FuzzReadPublishMessage(f *testing.F) {
+
+	fuzzPacket(f, PUBLISH, func(ctx *Context, fh *FixedHeader, buf []byte) {
+		ctx.ReadPublishMessage(nil, fh, buf)
+	},
+		join(str("a/b"), []byte{0, 1}, []byte("payload")),
+		join(str("a/+"), []byte{0, 1}),
+		[]byte{0, 9, 'a'},
+		str("a"),
+	)
+}
+
+func FuzzReadPubackMessage(f *testing.F) {
+
+	fuzzPacket(f, PUBACK, func(ctx *Context, fh *FixedHeader, buf []byte) {
+		ctx.ReadPubackMessage(nil, fh, buf)
+	}, []byte{0, 1}, []byte{0})
+}
+
+func FuzzReadPubrecMessage(f *testing.F) {
+
+	fuzzPacket(f, PUBREC, func(ctx *Context, fh *FixedHeader, buf []byte) {
+		ctx.ReadPubrecMessage(nil, fh, buf)
+	}, []byte{0, 1}, []byte{0})
+}
+
+func FuzzReadPubrelMessage(f *testing.F) {
+
+	fuzzPacket(f, PUBREL, func(ctx *Context, fh *FixedHeader, buf []byte) {
+		ctx.ReadPubrelMessage(nil, fh, buf)
+	}, []byte{0, 1}, []byte{0})
+}
+
+func FuzzReadPubcompMessage(f *testing.F) {
+
+	fuzzPacket(f, PUBCOMP, func(ctx *Context, fh *FixedHeader, buf []byte) {
+		ctx.ReadPubcompMessage(nil, fh, buf)
+	}, []byte{0, 1}, []byte{0})
+}
+
+// FuzzContextRead feeds a stream of packets to a connection.
+func FuzzContextRead(f *testing.F) {
+
+	connect := join(str("MQIsdp"), []byte{3, 0x02, 0, 60}, str("client"))
+	f.Add(join(
+		encode(0x10, connect),
+		encode(0x82, join([]byte{0, 1}, str("a/#"), []byte{2})),
+		encode(0x34, join(str("a/b"), []byte{0, 2}, []byte("x"))),
+		encode(0x62, []byte{0, 2}),
+		encode(0xc0, nil),
+		encode(0xe0, nil),
+	))
+	f.Add(join(encode(0x10, connect), []byte{0x82, 0x03, 0, 1, 0}))
+	f.Add(join(encode(0x10, connect), []byte{0x30, 0xff, 0xff, 0xff, 0xff}))
+
+	server := NewServer(nil, nil)
+	go server.Run()
+	f.Cleanup(server.Close)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		ctx := NewContext(io.Discard, nil, server)
+		defer ctx.Close()
+
+		r := bytes.NewReader(data)
+		for ctx.Alive() && r.Len() != 0 {
+			ctx.Read(r)
+		}
+	})
+}
@@ -1,8 +1,203 @@
 package mqtt
 
+import (
+	"errors"
+)
+
 type Handler interface {
 	Connect(ctx *Context, username, password string) error
 	Disconnect(ctx *Context)
 	Publish(ctx *Context, msg *Message) error
 	Subscribe(ctx *Context, topic string, qos byte) error
 }
+
+// GrantHandler is an optional hook that decides about each topic of a
+// SUBSCRIBE message. It is called after Handler.Subscribe has accepted the
+// topic and returns the granted QoS, which may be lower than the requested
+// qos, or SUBSCRIBE_FAILURE to reject this topic only. It is called again if
+// the client subscribes to a topic it has already subscribed to.
+type GrantHandler interface {
+	Grant(ctx *Context, topic string, qos byte) byte
+}
+
+// RewriteHandler is an optional hook that is called for every message after
+// Handler.Publish has accepted it. It can change the message before it is
+// routed (topic, payload, QoS, retain flag) and returns the messages that are
+// published instead of msg: []*Message{msg} to publish the (changed) message,
+// additional messages to fan out, or none to drop it. Use msg.Copy() to derive
+// new messages. Returned messages must have a valid topic without wildcards.
+//
+// Example: normalize 'dev/123/t' to 'devices/123/temperature'
+//
+//	func (h *Legacy) Rewrite(ctx *mqtt.Context, msg *mqtt.Message) ([]*mqtt.Message, error) {
+//		s := strings.Split(msg.Topic, "/")
+//		if len(s) == 3 && s[0] == "dev" && s[2] == "t" {
+//			msg.Topic = "devices/" + s[1] + "/temperature"
+//		}
+//		return []*mqtt.Message{msg}, nil
+//	}
+type RewriteHandler interface {
+	Rewrite(ctx *Context, msg *Message) ([]*Message, error)
+}
+
+// Optional lifecycle hooks. A Handler can implement any of these interfaces
+// in addition to the Handler methods. Deliver, Ack and Drop may be called
+// concurrently: Deliver mostly from the goroutine that routes all messages,
+// but also from the connection that resumes a session with queued messages,
+// Ack from the connection of the acknowledging client, and Drop from either
+// of them, e.g. for a full queue or a closed connection. They hold up the
+// routing or the connection, so they should return quickly.
+type (
+	// DeliverHandler is told about every message sent to a subscriber,
+	// with the QoS it has been sent with.
+	DeliverHandler interface {
+		Deliver(ctx *Context, msg *Message, qos byte)
+	}
+	// AckHandler is told when a client acknowledged a QoS 1 (PUBACK) or
+	// QoS 2 (PUBCOMP) message sent by the server.
+	AckHandler interface {
+		Ack(ctx *Context, msg *Message)
+	}
+	// DropHandler is told about messages that have not been published or
+	// delivered, and why.
+	DropHandler interface {
+		Drop(ctx *Context, msg *Message, reason error)
+	}
+	// UnsubscribeHandler is told when a client unsubscribes from a topic.
+	UnsubscribeHandler interface {
+		Unsubscribe(ctx *Context, topic string)
+	}
+	// WillHandler is told when the will message of a client is published.
+	WillHandler interface {
+		Will(ctx *Context, msg *Message)
+	}
+	// SessionHandler is told when a client resumes its previous session
+	// (clean session flag not set) and when a stored session expires.
+	SessionHandler interface {
+		SessionResumed(ctx *Context)
+		SessionExpired(clientID string)
+	}
+	// KeepAliveHandler is told when a client did not send anything within
+	// one and a half times its keep alive period.
+	KeepAliveHandler interface {
+		KeepAliveTimeout(ctx *Context)
+	}
+)
+
+// Reasons passed to DropHandler.Drop.
+var (
+	ErrServerClosing    = errors.New("server closing")
+	ErrClientOffline    = errors.New("client offline")
+	ErrQueueFull        = errors.New("session queue full")
+	ErrKeepAliveTimeout = errors.New("keep alive timeout")
+	ErrDiscarded        = errors.New("discarded by handler")
+	ErrInvalidMessage   = errors.New("invalid topic or qos")
+)
+
+// Errors for the Connect hook. The server answers them with the matching
+// CONNACK return code, see ConnAckCode. Handlers may wrap them to add
+// details, e.g. fmt.Errorf("ldap: %w", mqtt.ErrServerUnavailable).
+var (
+	ErrBadCredentials     = errors.New("bad username or password")
+	ErrNotAuthorized      = errors.New("not authorized")
+	ErrServerUnavailable  = errors.New("server unavailable")
+	ErrIdentifierRejected = errors.New("client identifier rejected")
+	ErrBanned             = errors.New("client banned")
+)
+
+// ConnAckCode returns the MQTT v3 CONNACK return code for an error of the
+// Connect hook. ErrBanned is answered with NOT_AUTHORIZED and ErrHookTimeout
+// with SERVER_UNAVAIL, as v3 has no better codes. Any other error is
+// answered with BAD_USER_OR_PASS if the client sent a username, or with
+// NOT_AUTHORIZED otherwise.
+func ConnAckCode(err error, username bool) byte {
+
+	switch {
+	case err == nil:
+		return ACCEPTED
+	case errors.Is(err, ErrBadCredentials):
+		return BAD_USER_OR_PASS
+	case errors.Is(err, ErrNotAuthorized), errors.Is(err, ErrBanned):
+		return NOT_AUTHORIZED
+	case errors.Is(err, ErrServerUnavailable), errors.Is(err, ErrHookTimeout):
+		return SERVER_UNAVAIL
+	case errors.Is(err, ErrIdentifierRejected):
+		return IDENTIFIER_REJ
+	case username:
+		return BAD_USER_OR_PASS
+	}
+	return NOT_AUTHORIZED
+}
+
+// ReasonCode returns the MQTT v5 CONNACK reason code for an error of the
+// Connect hook, for code that answers MQTT v5 clients with the same hooks;
+// the server itself uses ConnAckCode. Unknown errors are REASON_UNSPECIFIED.
+func ReasonCode(err error) byte {
+
+	switch {
+	case err == nil:
+		return REASON_SUCCESS
+	case errors.Is(err, ErrBadCredentials):
+		return REASON_BAD_USER_OR_PASS
+	case errors.Is(err, ErrNotAuthorized):
+		return REASON_NOT_AUTHORIZED
+	case errors.Is(err, ErrBanned):
+		return REASON_BANNED
+	case errors.Is(err, ErrServerUnavailable), errors.Is(err, ErrHookTimeout):
+		return REASON_SERVER_UNAVAIL
+	case errors.Is(err, ErrIdentifierRejected):
+		return REASON_IDENTIFIER_INVALID
+	}
+	return REASON_UNSPECIFIED
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func (svr *Server) onDeliver(ctx *Context, msg *Message, qos byte) {
+	if h, ok := svr.handler.(DeliverHandler); ok {
+		h.Deliver(ctx, msg, qos)
+	}
+}
+
+func (svr *Server) onAck(ctx *Context, msg *Message) {
+	if h, ok := svr.handler.(AckHandler); ok {
+		h.Ack(ctx, msg)
+	}
+}
+
+func (svr *Server) onDrop(ctx *Context, msg *Message, reason error) {
+	svr.Metrics.dropped.Add(1)
+	if h, ok := svr.handler.(DropHandler); ok {
+		h.Drop(ctx, msg, reason)
+	}
+}
+
+func (svr *Server) onUnsubscribe(ctx *Context, topic string) {
+	if h, ok := svr.handler.(UnsubscribeHandler); ok {
+		h.Unsubscribe(ctx, topic)
+	}
+}
+
+func (svr *Server) onWill(ctx *Context, msg *Message) {
+	if h, ok := svr.handler.(WillHandler); ok {
+		h.Will(ctx, msg)
+	}
+}
+
+func (svr *Server) onSessionResumed(ctx *Context) {
+	if h, ok := svr.handler.(SessionHandler); ok {
+		h.SessionResumed(ctx)
+	}
+}
+
+func (svr *Server) onSessionExpired(clientID string) {
+	if h, ok := svr.handler.(SessionHandler); ok {
+		h.SessionExpired(clientID)
+	}
+}
+
+func (svr *Server) onKeepAliveTimeout(ctx *Context) {
+	if h, ok := svr.handler.(KeepAliveHandler); ok {
+		h.KeepAliveTimeout(ctx)
+	}
+}
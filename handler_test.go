@@ -0,0 +1,381 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// recorder implements all lifecycle hooks and records them as events like
+// "deliver client a/b 1".
+type recorder chan string
+
+func (r recorder) Deliver(ctx *Context, msg *Message, qos byte) {
+	r <- fmt.Sprintf("deliver %s %s %d", ctx.ClientID, msg.Topic, qos)
+}
+
+func (r recorder) Ack(ctx *Context, msg *Message) {
+	r <- fmt.Sprintf("ack %s %s", ctx.ClientID, msg.Topic)
+}
+
+func (r recorder) Drop(ctx *Context, msg *Message, reason error) {
+	r <- fmt.Sprintf("drop %s %s %v", ctx.ClientID, msg.Topic, reason)
+}
+
+func (r recorder) Unsubscribe(ctx *Context, topic string) {
+	r <- fmt.Sprintf("unsubscribe %s %s", ctx.ClientID, topic)
+}
+
+func (r recorder) Will(ctx *Context, msg *Message) {
+	r <- fmt.Sprintf("will %s %s", ctx.ClientID, msg.Topic)
+}
+
+func (r recorder) SessionResumed(ctx *Context) {
+	r <- fmt.Sprintf("resumed %s", ctx.ClientID)
+}
+
+func (r recorder) SessionExpired(clientID string) {
+	r <- fmt.Sprintf("expired %s", clientID)
+}
+
+func (r recorder) KeepAliveTimeout(ctx *Context) {
+	r <- fmt.Sprintf("keepalive %s", ctx.ClientID)
+}
+
+// expect fails the test if the next event is not want.
+func (r recorder) expect(t *testing.T, want string) {
+
+	t.Helper()
+	select {
+	case event := <-r:
+		if event != want {
+			t.Fatalf("event %q, want %q", event, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no event, want %q", want)
+	}
+}
+
+// none fails the test if there is an event.
+func (r recorder) none(t *testing.T) {
+
+	t.Helper()
+	select {
+	case event := <-r:
+		t.Fatalf("unexpected event %q", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// newHookServer returns a running server with the plugins and a recorder of
+// the lifecycle hooks.
+func newHookServer(t *testing.T, plugins ...interface{}) (*Server, recorder) {
+
+	r := make(recorder, 100)
+	server := NewServer(nil, NewChain(append(plugins, r)...))
+	go server.Run()
+	t.Cleanup(server.Close)
+	return server, r
+}
+
+// publish reads a PUBLISH and returns its topic and message id.
+func (c *testConn) publish() (string, []byte) {
+
+	fh, buf, err := c.read()
+	if err != nil || fh.mtype != PUBLISH {
+		c.t.Fatalf("no PUBLISH: %+v %v", fh, err)
+	}
+	l, topic := readString(buf)
+	if fh.qos == 0 {
+		return topic, nil
+	}
+	return topic, buf[l : l+2]
+}
+
+// expect reads the next packet and fails the test if it is not of the type.
+func (c *testConn) expect(mtype byte) []byte {
+
+	fh, buf, err := c.read()
+	if err != nil || fh.mtype != mtype {
+		c.t.Fatalf("no %s: %+v %v", messageType[mtype], fh, err)
+	}
+	return buf
+}
+
+// nothing fails the test if the server sends a packet.
+func (c *testConn) nothing() {
+
+	c.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var fh FixedHeader
+	if err := fh.Read(c.r); !errors.Is(err, os.ErrDeadlineExceeded) {
+		c.t.Fatalf("unexpected %s: %v", messageType[fh.mtype], err)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func TestDeliverAndAckHooks(t *testing.T) {
+
+	server, r := newHookServer(t)
+
+	c := dial(t, server)
+	c.write(connectPacket)
+	c.connack()
+	c.subscribe("a/#", 2)
+
+	server.PublishLocal("a/0", []byte("x"), 0, false)
+	c.publish()
+	r.expect(t, "deliver client a/0 0")
+
+	server.PublishLocal("a/1", []byte("x"), 1, false)
+	_, mid := c.publish()
+	r.expect(t, "deliver client a/1 1")
+	r.none(t)
+	c.write(encode(0x40, mid))
+	r.expect(t, "ack client a/1")
+
+	server.PublishLocal("a/2", []byte("x"), 2, false)
+	_, mid = c.publish()
+	r.expect(t, "deliver client a/2 2")
+	c.write(encode(0x50, mid))
+	c.expect(PUBREL)
+	r.none(t)
+	c.write(encode(0x70, mid))
+	r.expect(t, "ack client a/2")
+}
+
+func TestDropHook(t *testing.T) {
+
+	server, r := newHookServer(t, PublishFunc(func(ctx *Context, msg *Message) error {
+		if msg.Topic == "forbidden" {
+			return ErrNotAuthorized
+		}
+		return nil
+	}))
+
+	c := dial(t, server)
+	c.write(connectPacket, encode(0x30, join(str("forbidden"), []byte("x"))))
+	c.connack()
+	r.expect(t, "drop client forbidden "+ErrNotAuthorized.Error())
+
+	// QoS 0 messages are not queued for offline clients
+	p := dial(t, server)
+	p.write(connectAs("p", 0))
+	p.connack()
+	p.subscribe("a/#", 0)
+	p.write(encode(0xe0, nil))
+	p.closed()
+
+	server.PublishLocal("a/1", []byte("x"), 1, false)
+	r.expect(t, "drop p a/1 "+ErrClientOffline.Error())
+}
+
+func TestUnsubscribeHook(t *testing.T) {
+
+	server, r := newHookServer(t)
+
+	c := dial(t, server)
+	c.write(connectPacket)
+	c.connack()
+	c.subscribe("a/#", 0)
+	c.write(encode(0xa2, join([]byte{0, 2}, str("a/#"), str("b/#"))))
+	c.expect(UNSUBACK)
+	r.expect(t, "unsubscribe client a/#")
+	r.none(t)
+
+	server.PublishLocal("a/1", []byte("x"), 0, false)
+	c.nothing()
+}
+
+func TestWillHook(t *testing.T) {
+
+	server, r := newHookServer(t)
+	will := func(id string) []byte {
+		return connectAs(id, 0x02|0x04, str("will/"+id), str("gone"))
+	}
+
+	// no will after a DISCONNECT
+	c := dial(t, server)
+	c.write(will("a"))
+	c.connack()
+	c.write(encode(0xe0, nil))
+	c.closed()
+	r.none(t)
+
+	c = dial(t, server)
+	c.write(will("b"))
+	c.connack()
+	c.conn.Close()
+	r.expect(t, "will b will/b")
+}
+
+func TestKeepAliveHook(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip("waits for the keep alive timeout")
+	}
+	server, r := newHookServer(t)
+
+	// keep alive 1s
+	c := dial(t, server)
+	c.write(encode(0x10, join(str("MQIsdp"), []byte{3, 0x02 | 0x04, 0, 1}, str("k"), str("will/k"), str("gone"))))
+	c.connack()
+
+	start := time.Now()
+	r.expect(t, "keepalive k")
+	if d := time.Since(start); d < time.Second {
+		t.Fatalf("timeout after %v", d)
+	}
+	r.expect(t, "will k will/k")
+
+	_, _, err := c.read()
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("connection not closed: %v", err)
+	}
+}
+
+func TestGrant(t *testing.T) {
+
+	server, r := newHookServer(t, grantFunc(func(ctx *Context, topic string, qos byte) byte {
+		switch topic {
+		case "forbidden/#":
+			return SUBSCRIBE_FAILURE
+		case "low/#":
+			return 0
+		}
+		return qos
+	}))
+
+	c := dial(t, server)
+	c.write(connectPacket, encode(0x82, join([]byte{0, 1},
+		str("low/#"), []byte{1},
+		str("forbidden/#"), []byte{1},
+		str("high/#"), []byte{2})))
+	c.connack()
+	if buf := c.expect(SUBACK); string(buf) != "\x00\x01\x00\x80\x02" {
+		t.Fatalf("SUBACK %x", buf)
+	}
+
+	// deliveries use the granted qos
+	server.PublishLocal("forbidden/a", []byte("x"), 1, false)
+	server.PublishLocal("low/a", []byte("x"), 1, false)
+	if topic, mid := c.publish(); topic != "low/a" || mid != nil {
+		t.Fatalf("received %s, message id %x", topic, mid)
+	}
+	r.expect(t, "deliver client low/a 0")
+	server.PublishLocal("high/a", []byte("x"), 2, false)
+	c.publish()
+	r.expect(t, "deliver client high/a 2")
+	r.none(t)
+}
+
+type rewriteFunc func(ctx *Context, msg *Message) ([]*Message, error)
+
+func (f rewriteFunc) Rewrite(ctx *Context, msg *Message) ([]*Message, error) {
+	return f(ctx, msg)
+}
+
+func TestRewrite(t *testing.T) {
+
+	server, r := newHookServer(t, rewriteFunc(func(ctx *Context, msg *Message) ([]*Message, error) {
+		switch msg.Topic {
+		case "dev/1/t":
+			return []*Message{{Topic: "devices/1/temperature", Buf: bytes.ToUpper(msg.Buf), QoS: msg.QoS}}, nil
+		case "both":
+			return []*Message{{Topic: "a/1", Buf: msg.Buf}, {Topic: "a/2", Buf: msg.Buf}}, nil
+		case "invalid":
+			return []*Message{{Topic: "a/#", Buf: msg.Buf}, {Topic: "a/3", Buf: msg.Buf}}, nil
+		case "none":
+			return nil, nil
+		}
+		return []*Message{msg}, nil
+	}))
+
+	c := dial(t, server)
+	c.write(connectPacket)
+	c.connack()
+	c.subscribe("#", 0)
+
+	receive := func(topic, payload string) {
+		t.Helper()
+		fh, buf, err := c.read()
+		if err != nil || fh.mtype != PUBLISH {
+			t.Fatalf("no PUBLISH: %+v %v", fh, err)
+		}
+		l, got := readString(buf)
+		if got != topic || string(buf[l:]) != payload {
+			t.Fatalf("received %s %q, want %s %q", got, buf[l:], topic, payload)
+		}
+		r.expect(t, "deliver client "+topic+" 0")
+	}
+
+	server.PublishLocal("dev/1/t", []byte("hot"), 0, false)
+	receive("devices/1/temperature", "HOT")
+
+	// the test reads the first message while the second one is routed
+	go server.PublishLocal("both", []byte("x"), 0, false)
+	receive("a/1", "x")
+	receive("a/2", "x")
+
+	// invalid messages of the rewrite hook are dropped, the others routed
+	go server.PublishLocal("invalid", []byte("x"), 0, false)
+	r.expect(t, "drop "+LocalClientID+" a/# "+ErrInvalidMessage.Error())
+	receive("a/3", "x")
+
+	server.PublishLocal("none", []byte("x"), 0, false)
+	r.expect(t, "drop "+LocalClientID+" none "+ErrDiscarded.Error())
+	c.nothing()
+}
+
+func TestConnAckCode(t *testing.T) {
+
+	for _, test := range []struct {
+		err      error
+		username bool
+		code     byte
+	}{
+		{nil, true, ACCEPTED},
+		{ErrBadCredentials, false, BAD_USER_OR_PASS},
+		{ErrNotAuthorized, true, NOT_AUTHORIZED},
+		{ErrBanned, true, NOT_AUTHORIZED},
+		{ErrServerUnavailable, true, SERVER_UNAVAIL},
+		{ErrHookTimeout, true, SERVER_UNAVAIL},
+		{ErrIdentifierRejected, true, IDENTIFIER_REJ},
+		{fmt.Errorf("ldap: %w", ErrServerUnavailable), true, SERVER_UNAVAIL},
+		{fmt.Errorf("jwt: %w", ErrBadCredentials), false, BAD_USER_OR_PASS},
+		{fmt.Errorf("acl: %w", fmt.Errorf("deny: %w", ErrNotAuthorized)), true, NOT_AUTHORIZED},
+		{errors.New("other"), true, BAD_USER_OR_PASS},
+		{errors.New("other"), false, NOT_AUTHORIZED},
+	} {
+		if code := ConnAckCode(test.err, test.username); code != test.code {
+			t.Errorf("ConnAckCode(%v, %v) = %d, want %d", test.err, test.username, code, test.code)
+		}
+	}
+}
+
+func TestReasonCode(t *testing.T) {
+
+	for _, test := range []struct {
+		err  error
+		code byte
+	}{
+		{nil, REASON_SUCCESS},
+		{ErrBadCredentials, REASON_BAD_USER_OR_PASS},
+		{ErrNotAuthorized, REASON_NOT_AUTHORIZED},
+		{ErrBanned, REASON_BANNED},
+		{ErrServerUnavailable, REASON_SERVER_UNAVAIL},
+		{ErrHookTimeout, REASON_SERVER_UNAVAIL},
+		{ErrIdentifierRejected, REASON_IDENTIFIER_INVALID},
+		{fmt.Errorf("jwt: %w", ErrBadCredentials), REASON_BAD_USER_OR_PASS},
+		{fmt.Errorf("acl: %w", fmt.Errorf("deny: %w", ErrBanned)), REASON_BANNED},
+		{errors.New("other"), REASON_UNSPECIFIED},
+	} {
+		if code := ReasonCode(test.err); code != test.code {
+			t.Errorf("ReasonCode(%v) = %#x, want %#x", test.err, code, test.code)
+		}
+	}
+}
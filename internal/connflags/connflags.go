@@ -0,0 +1,116 @@
+// Package connflags defines the connection flags of the mqttpub and mqttsub
+// commands.
+package connflags
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/client"
+)
+
+// Flags are the connection flags.
+type Flags struct {
+	Addr      string
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	Timeout   time.Duration
+
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	Insecure bool
+
+	WillTopic   string
+	WillPayload string
+	WillQoS     uint
+	WillRetain  bool
+}
+
+// Register defines the flags in fs.
+func Register(fs *flag.FlagSet) *Flags {
+
+	f := new(Flags)
+	fs.StringVar(&f.Addr, "addr", "tcp://localhost:1883", "broker address: tcp://, tls://, ws://, wss:// or unix:// URL")
+	fs.StringVar(&f.ClientID, "i", "", "client id (default: empty, with a clean session)")
+	fs.StringVar(&f.Username, "u", "", "username")
+	fs.StringVar(&f.Password, "P", "", "password (visible to other users!), or the MQTT_PASSWORD environment variable")
+	fs.DurationVar(&f.KeepAlive, "k", 60*time.Second, "keep alive interval, 0 to disable")
+	fs.DurationVar(&f.Timeout, "timeout", 10*time.Second, "timeout for the connection and acknowledgements")
+
+	fs.StringVar(&f.CAFile, "cafile", "", "PEM file with the CA certificates to verify the broker (default: system CAs)")
+	fs.StringVar(&f.CertFile, "cert", "", "PEM file with the client certificate")
+	fs.StringVar(&f.KeyFile, "key", "", "PEM file with the key of the client certificate (default: the -cert file)")
+	fs.BoolVar(&f.Insecure, "insecure", false, "do not verify the certificate of the broker")
+
+	fs.StringVar(&f.WillTopic, "will-topic", "", "topic of the will message")
+	fs.StringVar(&f.WillPayload, "will-payload", "", "payload of the will message")
+	fs.UintVar(&f.WillQoS, "will-qos", 0, "QoS of the will message")
+	fs.BoolVar(&f.WillRetain, "will-retain", false, "retain the will message")
+	return f
+}
+
+// Options returns the client options for the flags.
+func (f *Flags) Options() (*client.Options, error) {
+
+	opts := &client.Options{
+		ClientID:  f.ClientID,
+		Username:  f.Username,
+		Password:  f.Password,
+		KeepAlive: f.KeepAlive,
+		Timeout:   f.Timeout,
+	}
+	if opts.Password == "" {
+		opts.Password = os.Getenv("MQTT_PASSWORD")
+	}
+
+	if f.WillTopic != "" {
+		if !mqtt.ValidTopic(f.WillTopic) || f.WillQoS > 2 {
+			return nil, errors.New("invalid will topic or QoS")
+		}
+		opts.Will = &mqtt.Message{
+			Topic:  f.WillTopic,
+			Buf:    []byte(f.WillPayload),
+			QoS:    byte(f.WillQoS),
+			Retain: f.WillRetain,
+		}
+	}
+
+	if f.KeyFile != "" && f.CertFile == "" {
+		return nil, errors.New("-key needs -cert")
+	}
+	if f.CAFile != "" || f.CertFile != "" || f.Insecure {
+		config := &tls.Config{InsecureSkipVerify: f.Insecure}
+		if f.CAFile != "" {
+			pem, err := os.ReadFile(f.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: no certificates", f.CAFile)
+			}
+		}
+		if f.CertFile != "" {
+			key := f.KeyFile
+			if key == "" {
+				key = f.CertFile
+			}
+			cert, err := tls.LoadX509KeyPair(f.CertFile, key)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		opts.TLSConfig = config
+	}
+	return opts, nil
+}
@@ -0,0 +1,133 @@
+package connflags
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// certFile writes a self-signed certificate and its key to one PEM file.
+func certFile(t *testing.T) string {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// parse registers the flags and parses the arguments.
+func parse(t *testing.T, args ...string) *Flags {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := Register(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestOptions(t *testing.T) {
+
+	t.Setenv("MQTT_PASSWORD", "env")
+
+	opts, err := parse(t, "-i", "client", "-u", "alice", "-k", "30s").Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.ClientID != "client" || opts.Username != "alice" || opts.Password != "env" || opts.KeepAlive != 30*time.Second {
+		t.Errorf("options %+v", opts)
+	}
+	if opts.Will != nil || opts.TLSConfig != nil {
+		t.Errorf("will %v, TLS %v", opts.Will, opts.TLSConfig)
+	}
+	if opts, _ := parse(t, "-P", "flag").Options(); opts.Password != "flag" {
+		t.Errorf("password %q", opts.Password)
+	}
+}
+
+func TestOptionsWill(t *testing.T) {
+
+	opts, err := parse(t, "-will-topic", "status/client", "-will-payload", "gone", "-will-qos", "1", "-will-retain").Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := opts.Will; w == nil || w.Topic != "status/client" || string(w.Buf) != "gone" || w.QoS != 1 || !w.Retain {
+		t.Errorf("will %+v", opts.Will)
+	}
+
+	for _, args := range [][]string{
+		{"-will-topic", "status/#"},
+		{"-will-topic", "status/+/x"},
+		{"-will-topic", "status", "-will-qos", "3"},
+	} {
+		if _, err := parse(t, args...).Options(); err == nil || err.Error() != "invalid will topic or QoS" {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+}
+
+func TestOptionsTLS(t *testing.T) {
+
+	if _, err := parse(t, "-key", "key.pem").Options(); err == nil || err.Error() != "-key needs -cert" {
+		t.Errorf("key without cert: %v", err)
+	}
+
+	opts, err := parse(t, "-insecure").Options()
+	if err != nil || opts.TLSConfig == nil || !opts.TLSConfig.InsecureSkipVerify {
+		t.Errorf("insecure: %+v, %v", opts, err)
+	}
+
+	cert := certFile(t)
+	opts, err = parse(t, "-cafile", cert, "-cert", cert).Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := opts.TLSConfig; c == nil || c.RootCAs == nil || len(c.Certificates) != 1 || c.InsecureSkipVerify {
+		t.Errorf("TLS config %+v", opts.TLSConfig)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, nil, 0600)
+	if _, err := parse(t, "-cafile", empty).Options(); err == nil || !strings.HasSuffix(err.Error(), ": no certificates") {
+		t.Errorf("CA file without certificates: %v", err)
+	}
+	if _, err := parse(t, "-cafile", filepath.Join(t.TempDir(), "missing.pem")).Options(); !os.IsNotExist(err) {
+		t.Errorf("missing CA file: %v", err)
+	}
+	if _, err := parse(t, "-cert", empty).Options(); err == nil {
+		t.Error("invalid certificate accepted")
+	}
+}
@@ -0,0 +1,209 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Limits protect the server from clients that use too many resources.
+// Zero values mean the default.
+//
+// When a limit is exceeded, the server answers as the protocol asks for:
+// CONNACK with IDENTIFIER_REJ or SERVER_UNAVAIL at CONNECT, SUBACK with
+// SUBSCRIBE_FAILURE for the topic filter at SUBSCRIBE, and otherwise it
+// closes the connection.
+type Limits struct {
+	// MaxMessageLength is the maximum remaining length of a packet.
+	// Larger packets close the connection. Default: 6 MB.
+	MaxMessageLength int
+	// MaxClientIDLength is the maximum length of a client id. Longer ids are
+	// rejected with IDENTIFIER_REJ. The specification asks for 23 characters
+	// but many clients ignore this. Default: 128.
+	MaxClientIDLength int
+	// MaxTopicLength is the maximum length of topics and topic filters.
+	// Default: 65535, the protocol maximum.
+	MaxTopicLength int
+	// MaxTopicLevels is the maximum number of levels of topics and topic
+	// filters, e.g. 3 for 'a/b/c'. Default: no limit.
+	MaxTopicLevels int
+	// MaxSubscriptions is the maximum number of subscriptions of a client.
+	// Default: no limit.
+	MaxSubscriptions int
+	// MaxInflight is the maximum number of QoS 1 and 2 messages sent to a
+	// client and not acknowledged yet. More messages are dropped with
+	// ErrQueueFull. Default: 65535, the number of message ids.
+	MaxInflight int
+	// MaxAwaitingRelease is the maximum number of QoS 2 messages received
+	// from a client and waiting for the PUBREL. Default: 65535.
+	MaxAwaitingRelease int
+	// MaxQueuedMessages is the maximum number of messages stored for an
+	// offline client with a persistent session. Default: 1000.
+	MaxQueuedMessages int
+	// MaxRetained is the maximum number of retained messages. More retained
+	// messages are published but not retained. Default: no limit.
+	// This limit applies to the whole server only.
+	MaxRetained int
+	// MaxConnections is the maximum number of connections. More clients are
+	// rejected with SERVER_UNAVAIL. Default: no limit.
+	// For an Endpoint it limits the connections of that Endpoint.
+	MaxConnections int
+}
+
+// ErrLimitExceeded is the reason for closing a connection or dropping a
+// message when a limit is exceeded.
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// default limits
+const (
+	defaultMaxMessageLength  = 1024 * 1024 * 6
+	defaultMaxClientIDLength = 128
+	defaultMaxTopicLength    = 0xffff
+	defaultMaxInflight       = 0xffff
+	defaultMaxAwaiting       = 0xffff
+	defaultMaxQueuedMessages = 1000
+	noLimit                  = math.MaxInt
+)
+
+// limit returns value, or def if value is not set.
+func limit(value, def int) int {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
+
+func (l *Limits) maxMessageLength() int {
+	return limit(l.MaxMessageLength, defaultMaxMessageLength)
+}
+
+func (l *Limits) maxClientIDLength() int {
+	return limit(l.MaxClientIDLength, defaultMaxClientIDLength)
+}
+
+func (l *Limits) maxTopicLength() int {
+	return limit(l.MaxTopicLength, defaultMaxTopicLength)
+}
+
+func (l *Limits) maxTopicLevels() int {
+	return limit(l.MaxTopicLevels, noLimit)
+}
+
+func (l *Limits) maxSubscriptions() int {
+	return limit(l.MaxSubscriptions, noLimit)
+}
+
+func (l *Limits) maxInflight() int {
+	return limit(l.MaxInflight, defaultMaxInflight)
+}
+
+func (l *Limits) maxAwaitingRelease() int {
+	return limit(l.MaxAwaitingRelease, defaultMaxAwaiting)
+}
+
+func (l *Limits) maxQueuedMessages() int {
+	return limit(l.MaxQueuedMessages, defaultMaxQueuedMessages)
+}
+
+func (l *Limits) maxRetained() int {
+	return limit(l.MaxRetained, noLimit)
+}
+
+func (l *Limits) maxConnections() int {
+	return limit(l.MaxConnections, noLimit)
+}
+
+// Override returns the limits with all limits set in o replaced.
+func (l Limits) Override(o Limits) Limits {
+
+	override := func(v *int, o int) {
+		if o > 0 {
+			*v = o
+		}
+	}
+	override(&l.MaxMessageLength, o.MaxMessageLength)
+	override(&l.MaxClientIDLength, o.MaxClientIDLength)
+	override(&l.MaxTopicLength, o.MaxTopicLength)
+	override(&l.MaxTopicLevels, o.MaxTopicLevels)
+	override(&l.MaxSubscriptions, o.MaxSubscriptions)
+	override(&l.MaxInflight, o.MaxInflight)
+	override(&l.MaxAwaitingRelease, o.MaxAwaitingRelease)
+	override(&l.MaxQueuedMessages, o.MaxQueuedMessages)
+	override(&l.MaxRetained, o.MaxRetained)
+	override(&l.MaxConnections, o.MaxConnections)
+	return l
+}
+
+// checkTopic checks the length and levels of a topic or topic filter.
+func (l *Limits) checkTopic(topic string) error {
+
+	if len(topic) > l.maxTopicLength() {
+		return fmt.Errorf("%w: topic length %d", ErrLimitExceeded, len(topic))
+	}
+	if max := l.maxTopicLevels(); max != noLimit {
+		if levels := strings.Count(topic, "/") + 1; levels > max {
+			return fmt.Errorf("%w: %d topic levels", ErrLimitExceeded, levels)
+		}
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Endpoint serves connections with their own limits, e.g. all connections of
+// one net.Listener or WebSocket path. Limits that are not set for the
+// Endpoint are the limits of the server.
+type Endpoint struct {
+	server      *Server
+	limits      Limits
+	connections atomic.Int64
+}
+
+// NewEndpoint creates an Endpoint with limits that override the server limits.
+func (svr *Server) NewEndpoint(limits Limits) *Endpoint {
+
+	return &Endpoint{server: svr, limits: limits}
+}
+
+// Serve serves one connection, like Server.Serve.
+func (e *Endpoint) Serve(rwc io.ReadWriteCloser) {
+
+	e.connections.Add(1)
+	defer e.connections.Add(-1)
+	e.server.serve(rwc, e)
+}
+
+// ServeListener accepts connections on the listener and serves each of them
+// in a new goroutine, like Server.ServeListener.
+func (e *Endpoint) ServeListener(l net.Listener) error {
+
+	svr := e.server
+	svr.log().Info("listening", "addr", l.Addr().String())
+
+	for {
+
+		conn, err := l.Accept()
+		if err != nil {
+
+			if svr.Alive() {
+				svr.log().Error("accept failed", "addr", l.Addr().String(), "err", err)
+			}
+			return err
+		}
+
+		go e.Serve(conn)
+	}
+}
+
+// full reports whether another client may connect to the endpoint.
+func (e *Endpoint) full() bool {
+
+	if e == nil {
+		return false
+	}
+	return e.connections.Load() > int64(e.limits.maxConnections())
+}
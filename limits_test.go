@@ -0,0 +1,146 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientIDLimit(t *testing.T) {
+
+	server, _ := newTestServer(t, nil)
+	server.Limits.MaxClientIDLength = 4
+
+	c := dial(t, server)
+	c.write(connectAs("abcde", 0x02))
+	if code := c.connack(); code != IDENTIFIER_REJ {
+		t.Fatalf("code %d", code)
+	}
+
+	c = dial(t, server)
+	c.write(connectAs("abcd", 0x02))
+	if code := c.connack(); code != ACCEPTED {
+		t.Fatalf("code %d", code)
+	}
+}
+
+func TestSubscriptionLimit(t *testing.T) {
+
+	server, _ := newTestServer(t, nil)
+	server.Limits.MaxSubscriptions = 2
+
+	c := dial(t, server)
+	c.write(connectPacket)
+	c.connack()
+	c.subscribe("a", 0)
+	c.subscribe("b", 0)
+	c.write(encode(0x82, join([]byte{0, 1}, str("c"), []byte{0}, str("a"), []byte{1})))
+	if buf := c.expect(SUBACK); string(buf) != "\x00\x01\x80\x01" {
+		t.Fatalf("SUBACK %x", buf)
+	}
+
+	// a subscription can be replaced by another one
+	c.write(encode(0xa2, join([]byte{0, 2}, str("b"))))
+	c.expect(UNSUBACK)
+	c.subscribe("c", 0)
+}
+
+func TestTopicLimits(t *testing.T) {
+
+	server, routed := newTestServer(t, nil)
+	server.Limits.MaxTopicLength = 8
+	server.Limits.MaxTopicLevels = 2
+
+	c := dial(t, server)
+	c.write(connectPacket)
+	c.connack()
+	c.subscribe("a/+", 0)
+	c.write(encode(0x82, join([]byte{0, 1}, str("a/b/c"), []byte{0}, str("abcdefghi"), []byte{0})))
+	if buf := c.expect(SUBACK); string(buf) != "\x00\x01\x80\x80" {
+		t.Fatalf("SUBACK %x", buf)
+	}
+
+	for _, topic := range []string{"a/b/c", "abcdefghi"} {
+		c := dial(t, server)
+		c.write(connectPacket, encode(0x30, join(str(topic), []byte("x"))))
+		c.connack()
+		c.closed()
+	}
+	notRouted(t, routed)
+}
+
+func TestEndpointConnections(t *testing.T) {
+
+	server, _ := newTestServer(t, nil)
+	e := server.NewEndpoint(Limits{MaxConnections: 1})
+	dialEndpoint := func() *testConn {
+		conn, pipe := net.Pipe()
+		go e.Serve(pipe)
+		t.Cleanup(func() { conn.Close() })
+		return &testConn{t, conn, bufio.NewReader(conn)}
+	}
+
+	c := dialEndpoint()
+	c.write(connectPacket)
+	if code := c.connack(); code != ACCEPTED {
+		t.Fatalf("code %d", code)
+	}
+	d := dialEndpoint()
+	d.write(connectAs("other", 0x02))
+	if code := d.connack(); code != SERVER_UNAVAIL {
+		t.Fatalf("code %d", code)
+	}
+
+	// the server has no limit
+	s := dial(t, server)
+	s.write(connectAs("other", 0x02))
+	if code := s.connack(); code != ACCEPTED {
+		t.Fatalf("code %d", code)
+	}
+
+	c.write(encode(0xe0, nil))
+	c.closed()
+	for start := time.Now(); e.connections.Load() != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("%d connections", e.connections.Load())
+		}
+	}
+	d = dialEndpoint()
+	d.write(connectAs("other", 0x02))
+	if code := d.connack(); code != ACCEPTED {
+		t.Fatalf("code %d", code)
+	}
+}
+
+func TestRetainedLimit(t *testing.T) {
+
+	server, routed := newTestServer(t, nil)
+	server.Limits.MaxRetained = 2
+
+	for _, topic := range []string{"r/1", "r/2", "r/3"} {
+		server.PublishLocal(topic, []byte("x"), 0, true)
+		// messages that are not retained are published anyway
+		if msg := receive(t, routed); msg.Topic != topic {
+			t.Fatalf("routed %s", msg.Topic)
+		}
+	}
+	retained := func(want string) {
+		t.Helper()
+		var topics []string
+		for _, msg := range server.Retained() {
+			topics = append(topics, msg.Topic)
+		}
+		if got := strings.Join(topics, " "); got != want {
+			t.Fatalf("retained %s, want %s", got, want)
+		}
+	}
+	retained("r/1 r/2")
+
+	// retained messages can be replaced and removed
+	server.PublishLocal("r/1", []byte("y"), 0, true)
+	server.PublishLocal("r/2", nil, 0, true)
+	server.PublishLocal("r/3", []byte("x"), 0, true)
+	retained("r/1 r/3")
+}
@@ -0,0 +1,159 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// LocalClientID is the client id of the Context that handlers see for
+// messages and subscriptions of PublishLocal and SubscribeFunc, e.g. to
+// write ACL rules for in-process code.
+const LocalClientID = "$local"
+
+// ErrSubscriptionRejected is returned by SubscribeFunc if the handler or a
+// limit rejected the subscription.
+var ErrSubscriptionRejected = errors.New("subscription rejected")
+
+// localSubscriber calls the function of SubscribeFunc in its own goroutine,
+// so that slow functions, or functions that publish, do not block the Run
+// goroutine. Messages are delivered in order.
+type localSubscriber struct {
+	fn func(*Message)
+
+	mu      sync.Mutex
+	queue   []*Message
+	running bool
+	closed  bool
+}
+
+// newLocalContext creates a connected Context without connection.
+func (svr *Server) newLocalContext() *Context {
+
+	ctx := NewContext(nil, nil, svr)
+	ctx.ClientID = LocalClientID
+	ctx.ProtocolVersion = 3
+	ctx.state = CONNECTED
+	ctx.inflight = nil
+	return ctx
+}
+
+// PublishLocal publishes a message from Go code running in the same process.
+// The message passes the same hooks and ACLs as messages of network
+// clients, with a Context of client id LocalClientID. Rejected messages are
+// dropped, as for network clients; the returned error only reports invalid
+// messages and a closed server.
+//
+// PublishLocal waits for the goroutine that routes all messages, so it must
+// not be called from hooks that this goroutine calls (DeliverHandler,
+// AckHandler, DropHandler): they would deadlock. Start a goroutine there.
+func (svr *Server) PublishLocal(topic string, payload []byte, qos byte, retain bool) error {
+
+	if !ValidTopic(topic) || qos > 2 {
+		return fmt.Errorf("%w: %q", ErrInvalidMessage, topic)
+	}
+	if !svr.Alive() {
+		return ErrServerClosing
+	}
+
+	svr.localOnce.Do(func() {
+		svr.local = svr.newLocalContext()
+	})
+	svr.Publish(svr.local, &Message{Topic: topic, Buf: payload, QoS: qos, Retain: retain})
+	return nil
+}
+
+// SubscribeFunc subscribes fn to the topic filter. Every subscription has its
+// own Context of client id LocalClientID, so the subscribe, unsubscribe and
+// deliver hooks and the ACLs apply as for network clients. Retained messages
+// are delivered too.
+//
+// fn is called from one goroutine per subscription, in the order of the
+// messages. The message has the qos of the subscription and must not be
+// modified. Up to Limits.MaxInflight messages wait for fn, more are dropped
+// with ErrQueueFull.
+//
+// The returned function unsubscribes. Messages that are still waiting for fn
+// are discarded then.
+//
+// As PublishLocal, SubscribeFunc and the returned function must not be called
+// from hooks of the goroutine that routes all messages. fn itself may call
+// them.
+func (svr *Server) SubscribeFunc(filter string, qos byte, fn func(*Message)) (unsubscribe func(), err error) {
+
+	if !svr.Alive() {
+		return nil, ErrServerClosing
+	}
+
+	ctx := svr.newLocalContext()
+	ctx.local = &localSubscriber{fn: fn}
+
+	ctx.rmu.Lock()
+	granted := ctx.Subscribe(filter, qos)
+	ctx.rmu.Unlock()
+	if granted == SUBSCRIBE_FAILURE {
+		return nil, fmt.Errorf("%w: %q", ErrSubscriptionRejected, filter)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ctx.rmu.Lock()
+			ctx.Unsubscribe(filter)
+			ctx.rmu.Unlock()
+
+			ctx.wmu.Lock()
+			ctx.state = CLOSED
+			ctx.wmu.Unlock()
+
+			ctx.local.close()
+		})
+	}, nil
+}
+
+// deliver queues a message for the function of a local subscriber.
+func (ctx *Context) deliver(msg *Message) bool {
+
+	l := ctx.local
+	l.mu.Lock()
+	ok := !l.closed && len(l.queue) < ctx.limits.maxInflight()
+	if ok {
+		l.queue = append(l.queue, msg)
+	}
+	start := ok && !l.running
+	if start {
+		l.running = true
+	}
+	l.mu.Unlock()
+
+	if start {
+		go l.run()
+	}
+	return ok
+}
+
+func (l *localSubscriber) run() {
+
+	for {
+		l.mu.Lock()
+		if len(l.queue) == 0 || l.closed {
+			l.running = false
+			l.mu.Unlock()
+			return
+		}
+		msg := l.queue[0]
+		l.queue[0] = nil
+		l.queue = l.queue[1:]
+		l.mu.Unlock()
+
+		l.fn(msg)
+	}
+}
+
+func (l *localSubscriber) close() {
+
+	l.mu.Lock()
+	l.closed = true
+	l.queue = nil
+	l.mu.Unlock()
+}
@@ -0,0 +1,171 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receive returns the next message of a channel, or fails the test.
+func receive(t *testing.T, msgs chan *Message) *Message {
+
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+		return nil
+	}
+}
+
+func TestPublishLocal(t *testing.T) {
+
+	server, routed := newTestServer(t, nil)
+
+	c := dial(t, server)
+	c.write(connectPacket)
+	c.connack()
+	c.subscribe("a/#", 1)
+
+	if err := server.PublishLocal("a/b", []byte("hello"), 1, false); err != nil {
+		t.Fatal(err)
+	}
+	fh, buf, err := c.read()
+	if err != nil || fh.mtype != PUBLISH || fh.qos != 1 || !strings.Contains(string(buf), "a/b") {
+		t.Fatalf("not delivered: %+v %q %v", fh, buf, err)
+	}
+	if msg := receive(t, routed); msg.Topic != "a/b" || string(msg.Buf) != "hello" {
+		t.Fatalf("routed %s %q", msg.Topic, msg.Buf)
+	}
+
+	for _, topic := range []string{"", "a/#", "a/+"} {
+		if err := server.PublishLocal(topic, nil, 0, false); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%q: %v", topic, err)
+		}
+	}
+	if err := server.PublishLocal("a/b", nil, 3, false); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("qos 3: %v", err)
+	}
+
+	server.Close()
+	if err := server.PublishLocal("a/b", nil, 0, false); !errors.Is(err, ErrServerClosing) {
+		t.Errorf("closed server: %v", err)
+	}
+	if _, err := server.SubscribeFunc("a/b", 0, func(*Message) {}); !errors.Is(err, ErrServerClosing) {
+		t.Errorf("closed server: %v", err)
+	}
+}
+
+func TestSubscribeFunc(t *testing.T) {
+
+	server, _ := newTestServer(t, nil)
+
+	msgs := make(chan *Message, 10)
+	unsubscribe, err := server.SubscribeFunc("a/+", 1, func(msg *Message) {
+		msgs <- msg
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// messages of network clients arrive in order, with the lower qos
+	c := dial(t, server)
+	c.write(connectPacket,
+		encode(0x30, join(str("a/1"), []byte("one"))),
+		encode(0x32, join(str("a/2"), []byte{0, 1}, []byte("two"))),
+		encode(0x30, join(str("b/3"), []byte("three"))),
+		encode(0x34, join(str("a/4"), []byte{0, 2}, []byte("four"))))
+	c.connack()
+	for _, ack := range []byte{PUBACK, PUBREC, PUBCOMP} {
+		if ack == PUBCOMP {
+			c.write(encode(0x62, []byte{0, 2}))
+		}
+		if fh, _, err := c.read(); err != nil || fh.mtype != ack {
+			t.Fatalf("no %s: %v", messageType[ack], err)
+		}
+	}
+
+	for _, want := range []struct {
+		topic string
+		qos   byte
+	}{{"a/1", 0}, {"a/2", 1}, {"a/4", 1}} {
+		msg := receive(t, msgs)
+		if msg.Topic != want.topic || msg.QoS != want.qos {
+			t.Fatalf("received %s at qos %d, want %s at qos %d", msg.Topic, msg.QoS, want.topic, want.qos)
+		}
+	}
+
+	unsubscribe()
+	unsubscribe()
+	server.PublishLocal("a/5", nil, 0, false)
+	notRouted(t, msgs)
+}
+
+func TestSubscribeFuncRetained(t *testing.T) {
+
+	server, _ := newTestServer(t, nil)
+
+	server.PublishLocal("r/1", []byte("one"), 1, true)
+	server.PublishLocal("r/2", []byte("two"), 0, true)
+	server.PublishLocal("s/3", []byte("three"), 0, true)
+	if n := len(server.Retained()); n != 3 {
+		t.Fatalf("%d retained messages", n)
+	}
+
+	msgs := make(chan *Message, 10)
+	if _, err := server.SubscribeFunc("r/#", 0, func(msg *Message) { msgs <- msg }); err != nil {
+		t.Fatal(err)
+	}
+	topics := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg := receive(t, msgs)
+		if !msg.Retain {
+			t.Errorf("%s: retain flag not set", msg.Topic)
+		}
+		topics[msg.Topic] = true
+	}
+	if !topics["r/1"] || !topics["r/2"] {
+		t.Fatalf("retained messages %v", topics)
+	}
+	notRouted(t, msgs)
+}
+
+func TestLocalACL(t *testing.T) {
+
+	// local code must not use secret/#
+	var clientIDs []string
+	server, routed := newTestServer(t, NewChain(
+		PublishFunc(func(ctx *Context, msg *Message) error {
+			clientIDs = append(clientIDs, ctx.ClientID)
+			if ctx.ClientID == LocalClientID && strings.HasPrefix(msg.Topic, "secret/") {
+				return ErrNotAuthorized
+			}
+			return nil
+		}),
+		SubscribeFunc(func(ctx *Context, topic string, qos byte) error {
+			if ctx.ClientID == LocalClientID && strings.HasPrefix(topic, "secret/") {
+				return ErrNotAuthorized
+			}
+			return nil
+		}),
+	))
+
+	if err := server.PublishLocal("secret/a", nil, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	notRouted(t, routed)
+
+	server.PublishLocal("public/a", nil, 0, false)
+	if msg := receive(t, routed); msg.Topic != "public/a" {
+		t.Fatalf("routed %s", msg.Topic)
+	}
+	if len(clientIDs) != 2 || clientIDs[0] != LocalClientID || clientIDs[1] != LocalClientID {
+		t.Fatalf("client ids %q", clientIDs)
+	}
+
+	if _, err := server.SubscribeFunc("secret/#", 0, func(*Message) {}); !errors.Is(err, ErrSubscriptionRejected) {
+		t.Fatalf("subscription: %v", err)
+	}
+}
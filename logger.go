@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"log/slog"
+)
+
+// Logger is used by the server to report connections, protocol errors,
+// rejected clients and dropped messages. The methods take a message and
+// a list of alternating key/value pairs, just like log/slog does.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// SlogLogger returns a Logger that writes to the given slog logger.
+// If l is nil, slog.Default() is used.
+func SlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return l
+}
+
+// NopLogger discards everything. This is the default logger of a server.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// contextLogger adds the client id and remote address to every entry.
+type contextLogger struct {
+	ctx *Context
+}
+
+func (l contextLogger) args(args []interface{}) []interface{} {
+	fields := make([]interface{}, 0, 4+len(args))
+	fields = append(fields, "client", l.ctx.ClientID)
+	if l.ctx.RemoteAddr != nil {
+		fields = append(fields, "remote", l.ctx.RemoteAddr.String())
+	}
+	return append(fields, args...)
+}
+
+func (l contextLogger) Debug(msg string, args ...interface{}) {
+	l.ctx.server.log().Debug(msg, l.args(args)...)
+}
+
+func (l contextLogger) Info(msg string, args ...interface{}) {
+	l.ctx.server.log().Info(msg, l.args(args)...)
+}
+
+func (l contextLogger) Warn(msg string, args ...interface{}) {
+	l.ctx.server.log().Warn(msg, l.args(args)...)
+}
+
+func (l contextLogger) Error(msg string, args ...interface{}) {
+	l.ctx.server.log().Error(msg, l.args(args)...)
+}
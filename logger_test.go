@@ -0,0 +1,129 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects the entries of a JSON slog handler.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entry waits for the first entry with the message and returns its fields.
+func (b *logBuffer) entry(t *testing.T, msg string) map[string]interface{} {
+
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.mu.Lock()
+		lines := bytes.Split(b.buf.Bytes(), []byte("\n"))
+		b.mu.Unlock()
+		for _, line := range lines {
+			var fields map[string]interface{}
+			if json.Unmarshal(line, &fields) == nil && fields["msg"] == msg {
+				return fields
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no entry %q in %s", msg, b.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (b *logBuffer) String() string {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSlogLogger(t *testing.T) {
+
+	errRejected := errors.New("rejected")
+	server := NewServer(nil, NewChain(rewriteFunc(func(ctx *Context, msg *Message) ([]*Message, error) {
+		return nil, errRejected
+	})))
+	var buf logBuffer
+	server.Logger = SlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	go server.Run()
+	t.Cleanup(server.Close)
+
+	c := dial(t, server)
+	c.write(connectPacket, publishPacket)
+	c.connack()
+	c.write(encode(0xf0, nil)) // reserved packet type
+	c.closed()
+
+	for _, test := range []struct {
+		msg    string
+		level  string
+		fields map[string]interface{}
+	}{
+		{"client connected", "INFO", nil},
+		{"message dropped", "INFO", map[string]interface{}{"topic": "a/b", "reason": "rejected"}},
+		{"protocol error", "WARN", nil},
+	} {
+		fields := buf.entry(t, test.msg)
+		if fields["level"] != test.level {
+			t.Errorf("%s: level %v", test.msg, fields["level"])
+		}
+		// the fields of the connection
+		if fields["client"] != "client" || fields["remote"] != "pipe" {
+			t.Errorf("%s: client %v, remote %v", test.msg, fields["client"], fields["remote"])
+		}
+		for key, value := range test.fields {
+			if fields[key] != value {
+				t.Errorf("%s: %s = %v, want %v", test.msg, key, fields[key], value)
+			}
+		}
+	}
+	if fields := buf.entry(t, "protocol error"); fields["err"] == nil {
+		t.Errorf("protocol error without err: %v", fields)
+	}
+}
+
+func TestNopLogger(t *testing.T) {
+
+	// the default logger of a server
+	server, _ := newTestServer(t, nil)
+	if server.Logger != NopLogger {
+		t.Fatalf("Logger = %T", server.Logger)
+	}
+	c := dial(t, server)
+	c.write(connectPacket)
+	c.connack()
+	c.write(encode(0xf0, nil))
+	c.closed()
+
+	NopLogger.Debug("debug", "key", "value")
+	NopLogger.Info("info")
+	NopLogger.Warn("warn", "odd")
+	NopLogger.Error("error", "err", errors.New("ignored"))
+}
+
+func TestSlogLoggerDefault(t *testing.T) {
+
+	var buf logBuffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	SlogLogger(nil).Info("hello", "key", "value")
+	if fields := buf.entry(t, "hello"); fields["key"] != "value" {
+		t.Fatalf("fields %v", fields)
+	}
+}
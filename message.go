@@ -3,7 +3,10 @@ package mqtt
 import (
 	"errors"
 	"io"
-	"log"
+	"os"
+	"time"
+
+	"github.com/j-forster/mqtt/topics"
 )
 
 // errors
@@ -18,9 +21,18 @@ var (
 	ConnectProtocolUnexp    = errors.New("connect message protocol is not 'MQIsdp'")
 	TooLongClientID         = errors.New("connect client id is too long")
 	UnknownMessageID        = errors.New("unknown message id")
-)
 
-const maxMessageLength = 1024 * 1024 * 6
+	ErrReservedFlags   = errors.New("reserved fixed header flags")
+	ErrMalformedPacket = errors.New("malformed packet")
+	ErrInvalidFilter   = errors.New("invalid topic filter")
+
+	// ErrProtocolViolation is the reason for closing connections that send
+	// packets in the wrong state, e.g. a PUBLISH before the CONNECT.
+	ErrProtocolViolation = errors.New("protocol violation")
+
+	// Deprecated: a server without handler accepts all clients.
+	NoHandler = errors.New("server has no handler")
+)
 
 // CONNACK return codes
 const (
@@ -32,6 +44,20 @@ const (
 	NOT_AUTHORIZED      = 5
 )
 
+// MQTT v5 CONNACK reason codes, see ReasonCode
+const (
+	REASON_SUCCESS            = 0x00
+	REASON_UNSPECIFIED        = 0x80
+	REASON_IDENTIFIER_INVALID = 0x85
+	REASON_BAD_USER_OR_PASS   = 0x86
+	REASON_NOT_AUTHORIZED     = 0x87
+	REASON_SERVER_UNAVAIL     = 0x88
+	REASON_BANNED             = 0x8A
+)
+
+// SUBACK return code for a rejected subscription
+const SUBSCRIBE_FAILURE = 0x80
+
 // message types
 const (
 	CONNECT     = 1
@@ -61,7 +87,19 @@ type Message struct {
 	Topic  string
 	Buf    []byte
 	QoS    byte
-	retain bool
+	Retain bool
+}
+
+// Copy returns a copy of the message that shares the payload buffer.
+func (msg *Message) Copy() *Message {
+	m := *msg
+	return &m
+}
+
+// ValidTopic reports whether the topic name can be published to:
+// it must not be empty and must not contain wildcards.
+func ValidTopic(topic string) bool {
+	return topics.ValidTopic(topic)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -112,6 +150,9 @@ func (fh *FixedHeader) Read(reader io.Reader) error {
 	if fh.mtype == 0 || fh.mtype == 15 {
 		return ReservedMessageType // reserved type
 	}
+	if !fh.validFlags(headBuf[0] & 0x0f) {
+		return ErrReservedFlags
+	}
 
 	var multiplier int = 1
 	var length int
@@ -127,10 +168,6 @@ func (fh *FixedHeader) Read(reader io.Reader) error {
 
 		length += int(headBuf[0]&127) * multiplier
 
-		if length > maxMessageLength {
-			return MaxMessageLength // server maximum message size exceeded
-		}
-
 		if headBuf[0]&128 == 0 {
 			break
 		}
@@ -146,49 +183,145 @@ func (fh *FixedHeader) Read(reader io.Reader) error {
 	return nil
 }
 
+// validFlags reports whether the flags (the lower 4 bits of the first header
+// byte) are allowed for the message type. PUBREL, SUBSCRIBE and UNSUBSCRIBE
+// are sent at QoS 1 and may be redelivered with the DUP flag, PUBLISH must
+// not use QoS 3, and all other types have no flags.
+func (fh *FixedHeader) validFlags(flags byte) bool {
+
+	switch fh.mtype {
+	case PUBLISH:
+		return fh.qos != 3
+	case PUBREL, SUBSCRIBE, UNSUBSCRIBE:
+		return flags&^0x08 == 0x02
+	default:
+		return flags == 0
+	}
+}
+
+// headReader keeps the bytes read through it, to trace the fixed header.
+type headReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (h *headReader) Read(p []byte) (int, error) {
+
+	n, err := h.r.Read(p)
+	h.buf = append(h.buf, p[:n]...)
+	return n, err
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
 // read from a reader (input stream) a new mqtt message
 func (ctx *Context) Read(reader io.Reader) {
 
+	// the client must send something within 1.5 times the keep alive period
+	if d, ok := reader.(interface{ SetReadDeadline(time.Time) error }); ok && ctx.KeepAlive > 0 {
+		d.SetReadDeadline(time.Now().Add(ctx.KeepAlive * 3 / 2))
+	}
+
 	var fh FixedHeader
-	if err := fh.Read(reader); err != nil {
+	var buf []byte
+	// the tracer gets the header as received
+	tracer := ctx.Tracer
+	head := headReader{r: reader}
+	var err error
+	if tracer != nil {
+		err = fh.Read(&head)
+	} else {
+		err = fh.Read(reader)
+	}
+	if err == nil && fh.length > ctx.limits.maxMessageLength() {
+		err = MaxMessageLength // server maximum message size exceeded
+	}
+	if err == nil {
+		buf = make([]byte, fh.length)
+		if _, err = io.ReadFull(reader, buf); err != nil {
+			err = IncompleteMessage
+		}
+	}
+
+	ctx.rmu.Lock()
+	defer ctx.rmu.Unlock()
+
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			ctx.server.onKeepAliveTimeout(ctx)
+			err = ErrKeepAliveTimeout
+		}
 		ctx.Fail(err)
 		return
 	}
 
-	buf := make([]byte, fh.length)
+	ctx.server.Metrics.received(fh.mtype, headerLength(fh.length)+fh.length)
 
-	_, err := io.ReadFull(reader, buf)
-	if err != nil {
-		ctx.Fail(IncompleteMessage)
+	if tracer != nil {
+		tracer.Trace(ctx, TraceIn, append(head.buf, buf...))
+	}
+
+	if ctx.LogPackets {
+		ctx.Log().Debug("packet received",
+			"type", messageType[fh.mtype],
+			"length", fh.length,
+			"qos", fh.qos,
+			"dup", fh.dup,
+			"retain", fh.retain)
+	}
+
+	// packets are queued while the connect decision is pending
+	if ctx.getState() == AUTHENTICATING {
+		if len(ctx.pending) >= maxPending {
+			ctx.Fail(ErrTooManyPending)
+			return
+		}
+		ctx.pending = append(ctx.pending, packet{fh, buf})
 		return
 	}
 
-	// log.Printf("Message: %s (length:%d qos:%d dup:%t retain:%t)",
-	//   messageType[fh.mtype],
-	//   fh.length,
-	//   fh.qos,
-	//   fh.dup,
-	//   fh.retain)
+	ctx.handle(reader, &fh, buf)
+}
+
+// handle dispatches a received mqtt message by its type. The first message
+// must be a CONNECT, and there must be no other CONNECT.
+func (ctx *Context) handle(reader io.Reader, fh *FixedHeader, buf []byte) {
+
+	switch state := ctx.getState(); {
+	case state == CLOSED:
+		return
+	case state == CONNECTING && fh.mtype != CONNECT:
+		ctx.Failf("%w: %s before CONNECT", ErrProtocolViolation, messageType[fh.mtype])
+		return
+	case state != CONNECTING && fh.mtype == CONNECT:
+		ctx.Failf("%w: second CONNECT", ErrProtocolViolation)
+		return
+	}
 
 	switch fh.mtype {
 	case CONNECT:
-		ctx.ReadConnectMessage(reader, &fh, buf)
+		ctx.ReadConnectMessage(reader, fh, buf)
 	case SUBSCRIBE:
-		ctx.ReadSubscribeMessage(reader, &fh, buf)
+		ctx.ReadSubscribeMessage(reader, fh, buf)
+	case UNSUBSCRIBE:
+		ctx.ReadUnsubscribeMessage(reader, fh, buf)
 	case PUBLISH:
-		ctx.ReadPublishMessage(reader, &fh, buf)
+		ctx.ReadPublishMessage(reader, fh, buf)
+	case PUBACK:
+		ctx.ReadPubackMessage(reader, fh, buf)
 	case PUBREL:
-		ctx.ReadPubrelMessage(reader, &fh, buf)
+		ctx.ReadPubrelMessage(reader, fh, buf)
 	case PUBREC:
-		ctx.ReadPubrecMessage(reader, &fh, buf)
+		ctx.ReadPubrecMessage(reader, fh, buf)
 	case PUBCOMP:
-		ctx.ReadPubcompMessage(reader, &fh, buf)
+		ctx.ReadPubcompMessage(reader, fh, buf)
 	case PINGREQ:
 		ctx.PingResp()
 	case DISCONNECT:
 		ctx.Close()
+	default:
+		// CONNACK, SUBACK, UNSUBACK and PINGRESP are sent by servers only
+		ctx.Failf("%w: unexpected %s", ErrProtocolViolation, messageType[fh.mtype])
 	}
 }
 
@@ -218,6 +351,7 @@ func (ctx *Context) ReadConnectMessage(reader io.Reader, fh *FixedHeader, buf []
 		ctx.ConnAck(UNACCEPTABLE_PROTOV)
 		return
 	}
+	ctx.ProtocolVersion = version
 	buf = buf[1:]
 
 	//
@@ -229,12 +363,13 @@ func (ctx *Context) ReadConnectMessage(reader io.Reader, fh *FixedHeader, buf []
 	connFlags := buf[0]
 	// log.Printf("Connection Flags: %d", connFlags)
 
-	// cleanSession := connFlags&0x02 != 0
-	// if cleanSession {
-	// 	log.Println("Clean Session: true")
-	// }
+	ctx.CleanSession = connFlags&0x02 != 0
 	willFlag := connFlags&0x04 != 0
 	willQoS := connFlags & 0x18 >> 3
+	if willQoS == 3 {
+		ctx.Fail(ErrMalformedPacket)
+		return
+	}
 	willRetain := connFlags&0x20 != 0
 	passwordFlag := connFlags&0x40 != 0
 	usernameFlag := connFlags&0x80 != 0
@@ -247,9 +382,8 @@ func (ctx *Context) ReadConnectMessage(reader io.Reader, fh *FixedHeader, buf []
 		ctx.Fail(IncompleteMessage)
 		return
 	}
-	// keepAliveTimer := int(buf[0])<<8 + int(buf[1])
-	// log.Printf("KeepAlive Timer: %d", keepAliveTimer)
-	// TODO set SetDeadline() to conn
+	keepAliveTimer := int(buf[0])<<8 + int(buf[1])
+	ctx.KeepAlive = time.Duration(keepAliveTimer) * time.Second
 	buf = buf[2:]
 
 	//
@@ -259,12 +393,17 @@ func (ctx *Context) ReadConnectMessage(reader io.Reader, fh *FixedHeader, buf []
 		ctx.Fail(IncompleteMessage)
 		return
 	}
-	if l > 128 {
+	if len(ctx.ClientID) > ctx.limits.maxClientIDLength() {
 		// should be max 23, but some client implementations ignore this
-		// so we increase the size to 128
+		// so the limit is 128 by default
 		ctx.ConnAck(IDENTIFIER_REJ)
 		return
 	}
+	if ctx.server.Metrics.connections.Load() > int64(ctx.server.Limits.maxConnections()) || ctx.endpoint.full() {
+		ctx.Log().Warn("connection rejected", "err", ErrLimitExceeded)
+		ctx.ConnAck(SERVER_UNAVAIL)
+		return
+	}
 	buf = buf[l:]
 
 	//
@@ -273,7 +412,7 @@ func (ctx *Context) ReadConnectMessage(reader io.Reader, fh *FixedHeader, buf []
 
 		var will Message
 
-		will.retain = willRetain
+		will.Retain = willRetain
 		will.QoS = willQoS
 
 		l, will.Topic = readString(buf)
@@ -289,7 +428,10 @@ func (ctx *Context) ReadConnectMessage(reader io.Reader, fh *FixedHeader, buf []
 			return
 		}
 
-		log.Printf("Will: topic:%q qos:%d %q\n", will.Topic, will.QoS, will.Buf)
+		ctx.Log().Debug("will registered",
+			"topic", will.Topic,
+			"qos", will.QoS,
+			"retain", will.Retain)
 
 		ctx.Will = &will
 		buf = buf[l:]
@@ -317,16 +459,65 @@ func (ctx *Context) ReadConnectMessage(reader io.Reader, fh *FixedHeader, buf []
 		}
 	}
 
-	if ctx.server.handler != nil && ctx.server.handler.Connect(ctx, username, password) == nil {
+	ctx.Username = username
+
+	if ctx.server.Banned(ctx.ClientID) {
+		ctx.connected(username, usernameFlag, ErrBanned)
+		return
+	}
+
+	if h, ok := ctx.server.asyncConnect(); ok {
+		ctx.connectAsync(h, username, password, usernameFlag)
+		return
+	}
 
+	var err error
+	if ctx.server.handler != nil {
+		err = ctx.server.handler.Connect(ctx, username, password)
+	}
+	ctx.connected(username, usernameFlag, err)
+}
+
+// connected answers the CONNECT message with the decision of the handler.
+func (ctx *Context) connected(username string, usernameFlag bool, err error) {
+
+	// the newest connection of a client id takes over older ones
+	var old *Context
+	ctx.wmu.Lock()
+	closed := ctx.state == CLOSED
+	if !closed && err == nil {
+		ctx.state = CONNECTED
+		ctx.server.cmu.Lock()
+		ctx.server.clients[ctx] = struct{}{}
+		if ctx.ClientID != "" {
+			old = ctx.server.owners[ctx.ClientID]
+			ctx.server.owners[ctx.ClientID] = ctx
+		}
+		ctx.server.cmu.Unlock()
+	}
+	ctx.wmu.Unlock()
+
+	if closed {
+		// the client has gone while waiting for the decision
+		return
+	}
+
+	if err == nil {
+
+		if old != nil {
+			ctx.server.takeover(old)
+		}
+		ctx.Log().Info("client connected",
+			"username", username,
+			"clean", ctx.CleanSession,
+			"keepalive", ctx.KeepAlive)
 		ctx.ConnAck(ACCEPTED)
+		ctx.server.resumeSession(ctx)
 	} else {
 
-		if !usernameFlag {
-			ctx.ConnAck(NOT_AUTHORIZED)
-		} else {
-			ctx.ConnAck(BAD_USER_OR_PASS)
-		}
+		ctx.server.Metrics.authFailures.Add(1)
+		ctx.Log().Warn("authentication failed", "username", username, "err", err)
+		ctx.ConnAck(ConnAckCode(err, usernameFlag))
 	}
 }
 
@@ -341,33 +532,76 @@ func (ctx *Context) ReadSubscribeMessage(reader io.Reader, fh *FixedHeader, buf
 	}
 	mid := int(buf[0])<<8 + int(buf[1])
 	buf = buf[2:]
-	var s int
-	for i, l := 0, len(buf); i != l; s++ {
 
-		i += (int(buf[i]) << 8) + int(buf[i+1]) + 2 + 1
-		if i > l {
+	// parse all topics before subscribing to any of them
+	var filters []string
+	var qos []byte
+	for len(buf) != 0 {
+		l, topic := readString(buf)
+		if l == 0 || l == len(buf) {
 			ctx.Fail(IncompleteMessage)
 			return
 		}
+		if buf[l] > 2 {
+			ctx.Fail(ErrMalformedPacket)
+			return
+		}
+		filters = append(filters, topic)
+		qos = append(qos, buf[l])
+		buf = buf[l+1:]
+	}
+	if len(filters) == 0 {
+		ctx.Fail(ErrMalformedPacket)
+		return
 	}
 
-	l := 2 + s
+	l := 2 + len(filters)
 	head, body := Head(0x90, l, l) // SUBACK
 	body[0] = byte(mid >> 8)       // mid MSB
 	body[1] = byte(mid & 0xff)     // mid LSB
-	s = 2
+
+	for i, filter := range filters {
+		// grantedQos
+		body[2+i] = ctx.Subscribe(filter, qos[i])
+	}
+
+	ctx.send(head)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// parse an UNSUBSCRIBE message and send UNSUBACK
+func (ctx *Context) ReadUnsubscribeMessage(reader io.Reader, fh *FixedHeader, buf []byte) {
+
+	if len(buf) < 2 {
+		ctx.Fail(IncompleteMessage)
+		return
+	}
+	mid := int(buf[0])<<8 + int(buf[1])
+	buf = buf[2:]
+	if len(buf) == 0 {
+		ctx.Fail(ErrMalformedPacket)
+		return
+	}
 
 	for len(buf) != 0 {
 		l, topic := readString(buf)
-		qos := buf[l] & 0x03
-		buf = buf[l+1:]
+		if l == 0 {
+			ctx.Fail(IncompleteMessage)
+			return
+		}
+		buf = buf[l:]
 
-		// grantedQos
-		body[s] = ctx.Subscribe(topic, qos)
-		s++
+		ctx.Unsubscribe(topic)
 	}
 
-	ctx.Write(head)
+	// send UNSUBACK message
+	buf = make([]byte, 4)
+	buf[0] = 0xB0 // UNSUBACK
+	buf[1] = 0x02 // remaining length: 2
+	buf[2] = byte(mid >> 8)
+	buf[3] = byte(mid & 0xff)
+	ctx.send(buf)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -385,6 +619,14 @@ func (ctx *Context) ReadPublishMessage(reader io.Reader, fh *FixedHeader, buf []
 		return
 	}
 	buf = buf[l:]
+	if !ValidTopic(topic) {
+		ctx.Failf("%w: invalid topic %q", ErrMalformedPacket, topic)
+		return
+	}
+	if err := ctx.limits.checkTopic(topic); err != nil {
+		ctx.Fail(err)
+		return
+	}
 
 	if fh.qos == 0 { // QoS 0
 
@@ -411,9 +653,13 @@ func (ctx *Context) ReadPublishMessage(reader io.Reader, fh *FixedHeader, buf []
 			buf[1] = 0x02 // remaining length: 2
 			buf[2] = byte(mid >> 8)
 			buf[3] = byte(mid & 0xff)
-			ctx.Write(buf)
+			ctx.send(buf)
 		} else {
 
+			if _, ok := ctx.messages[mid]; !ok && len(ctx.messages) >= ctx.limits.maxAwaitingRelease() {
+				ctx.Failf("%w: %d messages awaiting release", ErrLimitExceeded, len(ctx.messages))
+				return
+			}
 			ctx.messages[mid] = msg // store
 
 			// send PUBREC message
@@ -422,13 +668,27 @@ func (ctx *Context) ReadPublishMessage(reader io.Reader, fh *FixedHeader, buf []
 			buf[1] = 0x02 // remaining length: 2
 			buf[2] = byte(mid >> 8)
 			buf[3] = byte(mid & 0xff)
-			ctx.Write(buf)
+			ctx.send(buf)
 		}
 	}
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 
+// parse a PUBACK message
+// (a response to a publish from this server to a client on qos 1)
+func (ctx *Context) ReadPubackMessage(reader io.Reader, fh *FixedHeader, buf []byte) {
+
+	if len(buf) < 2 {
+		ctx.Fail(IncompleteMessage)
+		return
+	}
+	mid := int(buf[0])<<8 + int(buf[1])
+	ctx.acknowledged(mid)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
 // parse a PUBREL message (a response to a PUBREC at QoS 2)
 // the message has alredy been stored at the previous PUBREC message
 func (ctx *Context) ReadPubrelMessage(reader io.Reader, fh *FixedHeader, buf []byte) {
@@ -454,7 +714,7 @@ func (ctx *Context) ReadPubrelMessage(reader io.Reader, fh *FixedHeader, buf []b
 	buf[1] = 0x02 // remaining length: 2
 	buf[2] = byte(mid >> 8)
 	buf[3] = byte(mid & 0xff)
-	ctx.Write(buf)
+	ctx.send(buf)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -475,7 +735,7 @@ func (ctx *Context) ReadPubrecMessage(reader io.Reader, fh *FixedHeader, buf []b
 	buf[1] = 0x02 // remaining length: 2
 	buf[2] = byte(mid >> 8)
 	buf[3] = byte(mid & 0xff)
-	ctx.Write(buf)
+	ctx.send(buf)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -488,7 +748,8 @@ func (ctx *Context) ReadPubcompMessage(reader io.Reader, fh *FixedHeader, buf []
 		ctx.Fail(IncompleteMessage)
 		return
 	}
-	// mid := int(buf[0])<<8 + int(buf[1])
+	mid := int(buf[0])<<8 + int(buf[1])
+	ctx.acknowledged(mid)
 }
 
 //////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Metrics collects the counters and gauges of a server.
+// Use WriteTo or ServeHTTP to export them in the Prometheus text format.
+type Metrics struct {
+	packetsReceived [16]atomic.Int64
+	packetsSent     [16]atomic.Int64
+	bytesReceived   atomic.Int64
+	bytesSent       atomic.Int64
+
+	published [3]atomic.Int64
+	delivered [3]atomic.Int64
+	dropped   atomic.Int64
+
+	connectionsTotal atomic.Int64
+	connections      atomic.Int64
+	authFailures     atomic.Int64
+
+	subscriptions atomic.Int64
+	retained      atomic.Int64
+	outbound      atomic.Int64
+}
+
+func NewMetrics() *Metrics {
+	return new(Metrics)
+}
+
+// metric types
+const (
+	counter = "counter"
+	gauge   = "gauge"
+)
+
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw *metricsWriter) head(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (mw *metricsWriter) value(name string, v int64) {
+	fmt.Fprintf(mw.w, "%s %d\n", name, v)
+}
+
+func (mw *metricsWriter) metric(name, typ, help string, v int64) {
+	mw.head(name, typ, help)
+	mw.value(name, v)
+}
+
+func (mw *metricsWriter) byType(name, help string, values *[16]atomic.Int64) {
+	mw.head(name, counter, help)
+	for t := CONNECT; t <= DISCONNECT; t++ {
+		mw.value(name+`{type="`+messageType[t]+`"}`, values[t].Load())
+	}
+}
+
+func (mw *metricsWriter) byQoS(name, help string, values *[3]atomic.Int64) {
+	mw.head(name, counter, help)
+	for qos := range values {
+		mw.value(fmt.Sprintf(`%s{qos="%d"}`, name, qos), values[qos].Load())
+	}
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+
+	cw := &countWriter{w: w}
+	mw := &metricsWriter{w: bufio.NewWriter(cw)}
+
+	mw.byType("mqtt_packets_received_total", "MQTT packets received by packet type.", &m.packetsReceived)
+	mw.byType("mqtt_packets_sent_total", "MQTT packets sent by packet type.", &m.packetsSent)
+	mw.metric("mqtt_received_bytes_total", counter, "Bytes received from clients.", m.bytesReceived.Load())
+	mw.metric("mqtt_sent_bytes_total", counter, "Bytes sent to clients.", m.bytesSent.Load())
+
+	mw.byQoS("mqtt_messages_published_total", "Messages published to the topic tree by QoS.", &m.published)
+	mw.byQoS("mqtt_messages_delivered_total", "Messages delivered to subscribers by QoS.", &m.delivered)
+	mw.metric("mqtt_messages_dropped_total", counter, "Messages that have not been published or delivered.", m.dropped.Load())
+
+	mw.metric("mqtt_connections_total", counter, "Connections accepted.", m.connectionsTotal.Load())
+	mw.metric("mqtt_connections", gauge, "Open connections.", m.connections.Load())
+	mw.metric("mqtt_auth_failures_total", counter, "Rejected CONNECT attempts.", m.authFailures.Load())
+
+	mw.metric("mqtt_subscriptions", gauge, "Active subscriptions.", m.subscriptions.Load())
+	mw.metric("mqtt_retained_messages", gauge, "Retained messages.", m.retained.Load())
+	mw.metric("mqtt_outbound_queue_depth", gauge, "Outgoing QoS 1 and 2 messages waiting for acknowledgement.", m.outbound.Load())
+
+	err := mw.w.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics to Prometheus.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// ListenMetrics serves the server metrics at http://addr/metrics.
+// It blocks until the listener fails.
+func (svr *Server) ListenMetrics(addr string) error {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", svr.Metrics)
+	svr.log().Info("metrics listening", "addr", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func (m *Metrics) received(mtype byte, n int) {
+	m.packetsReceived[mtype&0xf].Add(1)
+	m.bytesReceived.Add(int64(n))
+}
+
+func (m *Metrics) sent(mtype byte, n int) {
+	m.packetsSent[mtype&0xf].Add(1)
+	m.bytesSent.Add(int64(n))
+}
+
+func (m *Metrics) publish(qos byte) {
+	if qos < 3 {
+		m.published[qos].Add(1)
+	}
+}
+
+func (m *Metrics) deliver(qos byte) {
+	if qos < 3 {
+		m.delivered[qos].Add(1)
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// headerLength returns the size of a fixed header for a message
+// with the given remaining length.
+func headerLength(length int) int {
+	n := 2
+	for length >= 128 {
+		length >>= 7
+		n++
+	}
+	return n
+}
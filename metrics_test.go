@@ -0,0 +1,106 @@
+package mqtt
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// samples parses the Prometheus text format into the values by metric.
+func samples(t *testing.T, text string) map[string]int64 {
+
+	t.Helper()
+	values := make(map[string]int64)
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, v, ok := strings.Cut(line, " ")
+		n, err := strconv.ParseInt(v, 10, 64)
+		if !ok || err != nil {
+			t.Fatalf("invalid sample %q", line)
+		}
+		values[name] = n
+	}
+	return values
+}
+
+func TestMetrics(t *testing.T) {
+
+	server, routed := newTestServer(t, nil)
+
+	c := dial(t, server)
+	c.write(connectPacket, publishPacket)
+	c.connack()
+	if msg := receive(t, routed); msg.Topic != "a/b" {
+		t.Fatalf("routed %s", msg.Topic)
+	}
+
+	want := map[string]int64{
+		`mqtt_packets_received_total{type="CONNECT"}`:   1,
+		`mqtt_packets_received_total{type="PUBLISH"}`:   1,
+		`mqtt_packets_received_total{type="SUBSCRIBE"}`: 0,
+		`mqtt_packets_sent_total{type="CONNACK"}`:       1,
+		`mqtt_received_bytes_total`:                     int64(len(connectPacket) + len(publishPacket)),
+		`mqtt_sent_bytes_total`:                         4,
+		`mqtt_messages_published_total{qos="0"}`:        1,
+		`mqtt_messages_published_total{qos="1"}`:        0,
+		`mqtt_messages_delivered_total{qos="0"}`:        1,
+		`mqtt_messages_dropped_total`:                   0,
+		`mqtt_connections_total`:                        1,
+		`mqtt_connections`:                              1,
+		`mqtt_auth_failures_total`:                      0,
+		`mqtt_retained_messages`:                        0,
+		`mqtt_outbound_queue_depth`:                     0,
+	}
+
+	// the message is counted as published after it has been delivered
+	var values map[string]int64
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		var buf bytes.Buffer
+		n, err := server.Metrics.WriteTo(&buf)
+		if err != nil || n != int64(buf.Len()) {
+			t.Fatalf("WriteTo = %d, %v; wrote %d bytes", n, err, buf.Len())
+		}
+		values = samples(t, buf.String())
+		if values[`mqtt_messages_published_total{qos="0"}`] == 1 || time.Now().After(deadline) {
+			break
+		}
+	}
+	for name, v := range want {
+		if got, ok := values[name]; !ok || got != v {
+			t.Errorf("%s = %d (%v), want %d", name, got, ok, v)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	server.Metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE mqtt_packets_received_total counter",
+		"# TYPE mqtt_connections gauge",
+		"# HELP mqtt_connections_total Connections accepted.",
+		`mqtt_packets_received_total{type="CONNECT"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("no line %q", line)
+		}
+	}
+
+	// the gauge goes down when the connection is closed
+	c.conn.Close()
+	for deadline := time.Now().Add(time.Second); samples(t, w.Body.String())["mqtt_connections"] != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection still counted")
+		}
+		w = httptest.NewRecorder()
+		server.Metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	}
+}
@@ -0,0 +1,338 @@
+// Command mqttbench measures the throughput and latency of an mqtt broker.
+//
+//	mqttbench [-addr tcp://host:1883] [-pub 1] [-sub 1] [-topics 1] [-qos 0]
+//	          [-size 64] [-rate 0] [-count 0] [-duration 10s]
+//
+// It connects the publishers and subscribers, subscribes subscriber i to
+// topic i % topics, and publishes from every publisher to all topics in turn.
+// Without -addr the broker is a Server in this process, listening on a
+// loopback port.
+//
+// Each payload starts with the time it has been published at, so the latency
+// is the time from Publish to the arrival at a subscriber. Publish waits for
+// the acknowledgement at QoS 1 and 2, which limits the rate of a publisher
+// to one message per round trip. At QoS 0 without -rate the
+// publishers outrun the broker, and the latency includes the time in the send
+// queue of the client.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/client"
+)
+
+// options of a benchmark run
+type options struct {
+	addr     string
+	pubs     int
+	subs     int
+	topics   int
+	qos      byte
+	size     int
+	rate     float64
+	count    int
+	duration time.Duration
+	wait     time.Duration
+	prefix   string
+	username string
+	password string
+}
+
+func main() {
+
+	var o options
+	var qos uint
+	flag.StringVar(&o.addr, "addr", "", "broker address, e.g. tcp://localhost:1883 (default: a broker in this process)")
+	flag.IntVar(&o.pubs, "pub", 1, "number of publishers")
+	flag.IntVar(&o.subs, "sub", 1, "number of subscribers")
+	flag.IntVar(&o.topics, "topics", 1, "number of topics")
+	flag.UintVar(&qos, "qos", 0, "QoS of messages and subscriptions")
+	flag.IntVar(&o.size, "size", 64, "payload size in bytes, at least 8")
+	flag.Float64Var(&o.rate, "rate", 0, "messages per second per publisher (0: as fast as possible)")
+	flag.IntVar(&o.count, "count", 0, "messages per publisher (0: no limit)")
+	flag.DurationVar(&o.duration, "duration", 10*time.Second, "maximum time to publish")
+	flag.DurationVar(&o.wait, "wait", 2*time.Second, "time to wait for outstanding messages after publishing")
+	flag.StringVar(&o.prefix, "prefix", "mqttbench", "topic prefix")
+	flag.StringVar(&o.username, "username", "", "username")
+	flag.StringVar(&o.password, "password", "", "password")
+	flag.Parse()
+
+	o.qos = byte(qos)
+	switch {
+	case qos > 2:
+		fail(errors.New("-qos must be 0, 1 or 2"))
+	case o.pubs < 1 || o.topics < 1:
+		fail(errors.New("-pub and -topics must be at least 1"))
+	case o.subs < 0:
+		fail(errors.New("-sub must not be negative"))
+	case o.size < 8:
+		fail(errors.New("-size must be at least 8"))
+	}
+
+	if o.addr == "" {
+		addr, err := serve()
+		if err != nil {
+			fail(err)
+		}
+		o.addr = addr
+	}
+
+	r, err := run(&o)
+	if err != nil {
+		fail(err)
+	}
+	r.print(os.Stdout, &o)
+}
+
+func fail(err error) {
+
+	fmt.Fprintln(os.Stderr, "mqttbench:", err)
+	os.Exit(1)
+}
+
+// serve starts a Server in this process and returns its address.
+func serve() (string, error) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	server := mqtt.NewServer(l, nil)
+	go server.Run()
+	go server.ServeListener(l)
+	return l.Addr().String(), nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// subscriber counts the messages of one subscriber and their latencies.
+type subscriber struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	last      time.Time
+}
+
+func (s *subscriber) receive(msg *mqtt.Message) {
+
+	now := time.Now()
+	if len(msg.Buf) < 8 {
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(msg.Buf)))
+
+	s.mu.Lock()
+	s.latencies = append(s.latencies, now.Sub(sent))
+	s.last = now
+	s.mu.Unlock()
+}
+
+func (s *subscriber) received() int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.latencies)
+}
+
+// result of a benchmark run
+type result struct {
+	published int64
+	errors    int64
+	expected  int64
+	received  int
+	pubTime   time.Duration
+	subTime   time.Duration
+	latencies []time.Duration // sorted
+}
+
+func run(o *options) (*result, error) {
+
+	topic := func(i int) string {
+		return o.prefix + "/" + strconv.Itoa(i)
+	}
+	clientOpts := func(name string, i int) *client.Options {
+		return &client.Options{
+			ClientID:     fmt.Sprintf("%s-%s-%d", o.prefix, name, i),
+			Username:     o.username,
+			Password:     o.password,
+			CleanSession: true,
+			KeepAlive:    30 * time.Second,
+		}
+	}
+
+	// subscribers per topic, to know how many messages to expect
+	perTopic := make([]int64, o.topics)
+	subs := make([]*subscriber, o.subs)
+	for i := range subs {
+		s := new(subscriber)
+		opts := clientOpts("sub", i)
+		opts.OnMessage = s.receive
+		c, err := client.Dial(o.addr, opts)
+		if err != nil {
+			return nil, fmt.Errorf("subscriber %d: %w", i, err)
+		}
+		defer c.Disconnect()
+		if _, err := c.Subscribe(topic(i%o.topics), o.qos); err != nil {
+			return nil, fmt.Errorf("subscriber %d: %w", i, err)
+		}
+		subs[i] = s
+		perTopic[i%o.topics]++
+	}
+
+	pubs := make([]*client.Client, o.pubs)
+	for i := range pubs {
+		c, err := client.Dial(o.addr, clientOpts("pub", i))
+		if err != nil {
+			return nil, fmt.Errorf("publisher %d: %w", i, err)
+		}
+		defer c.Disconnect()
+		pubs[i] = c
+	}
+
+	var r result
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(o.duration)
+
+	for i, c := range pubs {
+		wg.Add(1)
+		go func(i int, c *client.Client) {
+			defer wg.Done()
+
+			payload := make([]byte, o.size)
+			var interval time.Duration
+			if o.rate > 0 {
+				interval = time.Duration(float64(time.Second) / o.rate)
+			}
+			for n := 0; o.count == 0 || n < o.count; n++ {
+
+				now := time.Now()
+				if now.After(deadline) {
+					return
+				}
+				if interval > 0 {
+					if next := start.Add(time.Duration(n) * interval); next.After(now) {
+						time.Sleep(next.Sub(now))
+					}
+				}
+
+				t := (i + n) % o.topics
+				binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+				if err := c.Publish(topic(t), payload, o.qos, false); err != nil {
+					atomic.AddInt64(&r.errors, 1)
+					if errors.Is(err, client.ErrClosed) {
+						return
+					}
+					continue
+				}
+				atomic.AddInt64(&r.published, 1)
+				atomic.AddInt64(&r.expected, perTopic[t])
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	r.pubTime = time.Since(start)
+
+	// wait for outstanding messages, until no message arrived for o.wait
+	for {
+		var received int
+		for _, s := range subs {
+			received += s.received()
+		}
+		if int64(received) >= r.expected {
+			break
+		}
+		idle := true
+		for _, s := range subs {
+			s.mu.Lock()
+			idle = idle && time.Since(s.last) > o.wait
+			s.mu.Unlock()
+		}
+		if idle && time.Since(start)-r.pubTime > o.wait {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var last time.Time
+	for _, s := range subs {
+		s.mu.Lock()
+		r.latencies = append(r.latencies, s.latencies...)
+		if s.last.After(last) {
+			last = s.last
+		}
+		s.mu.Unlock()
+	}
+	r.received = len(r.latencies)
+	if !last.IsZero() {
+		r.subTime = last.Sub(start)
+	}
+	sort.Slice(r.latencies, func(i, j int) bool {
+		return r.latencies[i] < r.latencies[j]
+	})
+	return &r, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// percentile returns the latency that p percent of the sorted latencies do
+// not exceed.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(latencies) {
+		i = len(latencies) - 1
+	}
+	return latencies[i]
+}
+
+func rate(n int64, d time.Duration) float64 {
+
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+func (r *result) print(w io.Writer, o *options) {
+
+	fmt.Fprintf(w, "%d publishers, %d subscribers, %d topics, QoS %d, %d byte payloads\n",
+		o.pubs, o.subs, o.topics, o.qos, o.size)
+	fmt.Fprintf(w, "published  %9d msgs in %8v  %10.0f msg/s",
+		r.published, r.pubTime.Round(time.Millisecond), rate(r.published, r.pubTime))
+	if r.errors != 0 {
+		fmt.Fprintf(w, "  (%d errors)", r.errors)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "received   %9d msgs in %8v  %10.0f msg/s",
+		r.received, r.subTime.Round(time.Millisecond), rate(int64(r.received), r.subTime))
+	if lost := r.expected - int64(r.received); lost > 0 {
+		fmt.Fprintf(w, "  (%d of %d lost)", lost, r.expected)
+	}
+	fmt.Fprintln(w)
+	if r.received != 0 {
+		fmt.Fprintf(w, "latency    p50 %v  p99 %v  p99.9 %v  max %v\n",
+			percentile(r.latencies, 50).Round(time.Microsecond),
+			percentile(r.latencies, 99).Round(time.Microsecond),
+			percentile(r.latencies, 99.9).Round(time.Microsecond),
+			r.latencies[len(r.latencies)-1].Round(time.Microsecond))
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+
+	var latencies []time.Duration
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	for _, test := range []struct {
+		latencies []time.Duration
+		p         float64
+		want      time.Duration
+	}{
+		{nil, 50, 0},
+		{latencies, 50, 50 * time.Millisecond},
+		{latencies, 90, 90 * time.Millisecond},
+		{latencies, 99, 99 * time.Millisecond},
+		{latencies, 100, 100 * time.Millisecond},
+		{latencies, 0, 1 * time.Millisecond},
+		{latencies[:1], 99, 1 * time.Millisecond},
+		{latencies[:3], 50, 2 * time.Millisecond},
+		{latencies[:10], 95, 10 * time.Millisecond},
+	} {
+		if got := percentile(test.latencies, test.p); got != test.want {
+			t.Errorf("percentile of %d latencies, %v%% = %v, want %v", len(test.latencies), test.p, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Command mqttpasswd manages password files for the auth.PasswordFile
+// authenticator.
+//
+//	mqttpasswd [-c] [-alg bcrypt|argon2id|pbkdf2] [-b password] passwordfile username
+//	mqttpasswd -D passwordfile username
+//
+// The first form adds a user or updates its password. The password is read
+// from the terminal, or from the first line of stdin if it is not a terminal,
+// unless it is given with -b. The second form removes a user.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/j-forster/mqtt/auth"
+	"golang.org/x/term"
+)
+
+func main() {
+
+	create := flag.Bool("c", false, "create a new password file, overwriting an existing one")
+	remove := flag.Bool("D", false, "delete the user")
+	alg := flag.String("alg", auth.Bcrypt, "hash algorithm: bcrypt, argon2id or pbkdf2")
+	batch := flag.String("b", "", "take the password from the command line (visible to other users!)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mqttpasswd [-c] [-alg bcrypt|argon2id|pbkdf2] [-b password] passwordfile username")
+		fmt.Fprintln(os.Stderr, "       mqttpasswd -D passwordfile username")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path, username := flag.Arg(0), flag.Arg(1)
+
+	if username == "" || strings.ContainsAny(username, ":\r\n") {
+		fail(errors.New("the username must not be empty or contain ':'"))
+	}
+
+	var lines []string
+	if !*create {
+		var err error
+		lines, err = readLines(path)
+		if err != nil && !(errors.Is(err, os.ErrNotExist) && !*remove) {
+			fail(err)
+		}
+	}
+
+	if *remove {
+		lines, found := setUser(lines, username, "")
+		if !found {
+			fail(fmt.Errorf("user %q not found", username))
+		}
+		if err := writeLines(path, lines); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	password := *batch
+	if password == "" {
+		var err error
+		password, err = readPassword()
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	hash, err := auth.HashPassword(password, *alg)
+	if err != nil {
+		fail(err)
+	}
+
+	lines, _ = setUser(lines, username, hash)
+	if err := writeLines(path, lines); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "mqttpasswd:", err)
+	os.Exit(1)
+}
+
+// setUser replaces the line of the user, or removes it if hash is empty.
+// A new user is appended.
+func setUser(lines []string, username, hash string) ([]string, bool) {
+
+	prefix := username + ":"
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), prefix) {
+			if hash == "" {
+				return append(lines[:i], lines[i+1:]...), true
+			}
+			lines[i] = prefix + hash
+			return lines, true
+		}
+	}
+	if hash == "" {
+		return lines, false
+	}
+	return append(lines, prefix+hash), false
+}
+
+func readLines(path string) ([]string, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimRight(string(data), "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// writeLines replaces the file atomically, so that a server watching the
+// file never reads it half written.
+func writeLines(path string, lines []string) error {
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".mqttpasswd-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, line := range lines {
+		w.WriteString(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readPassword() (string, error) {
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("no password on stdin")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	p1, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Reenter password: ")
+	p2, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(p1) != string(p2) {
+		return "", errors.New("passwords do not match")
+	}
+	if len(p1) == 0 {
+		return "", errors.New("empty password")
+	}
+	return string(p1), nil
+}
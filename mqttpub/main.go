@@ -0,0 +1,129 @@
+// Command mqttpub publishes messages to an mqtt broker.
+//
+//	mqttpub [-addr url] -t topic [-q qos] [-r] (-m message | -f file | -s | -l | -n)
+//
+// The payload is the -m message, the content of a file, all of stdin (-s),
+// or empty (-n). With -l every line of stdin is published as a message, until
+// stdin is closed. See -h for the connection flags, e.g. for credentials,
+// TLS and the will message.
+//
+//	mqttpub -t sensors/1/temp -m 21.5
+//	mqttpub -addr tls://broker:8883 -cafile ca.pem -u alice -t logs -q 1 -l < app.log
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/client"
+	"github.com/j-forster/mqtt/internal/connflags"
+)
+
+func main() {
+
+	conn := connflags.Register(flag.CommandLine)
+	topic := flag.String("t", "", "topic to publish to")
+	qos := flag.Uint("q", 0, "QoS: 0, 1 or 2")
+	retain := flag.Bool("r", false, "retain the message")
+	message := flag.String("m", "", "publish the message")
+	file := flag.String("f", "", "publish the content of the file")
+	stdin := flag.Bool("s", false, "publish all of stdin as one message")
+	lines := flag.Bool("l", false, "publish each line of stdin as a message")
+	null := flag.Bool("n", false, "publish an empty message, e.g. to clear a retained message")
+	repeat := flag.Int("repeat", 1, "publish the message this many times")
+	delay := flag.Duration("repeat-delay", 0, "time between repeated messages")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mqttpub [flags] -t topic (-m message | -f file | -s | -l | -n)")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	sources := 0
+	for _, set := range []bool{isSet("m"), *file != "", *stdin, *lines, *null} {
+		if set {
+			sources++
+		}
+	}
+	switch {
+	case flag.NArg() != 0 || sources != 1:
+		flag.Usage()
+		os.Exit(2)
+	case !mqtt.ValidTopic(*topic):
+		fail(errors.New("-t must be a topic without wildcards"))
+	case *qos > 2:
+		fail(errors.New("-q must be 0, 1 or 2"))
+	}
+
+	var payload []byte
+	var err error
+	switch {
+	case isSet("m"):
+		payload = []byte(*message)
+	case *file != "":
+		payload, err = os.ReadFile(*file)
+	case *stdin:
+		payload, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	opts, err := conn.Options()
+	if err != nil {
+		fail(err)
+	}
+	c, err := client.Dial(conn.Addr, opts)
+	if err != nil {
+		fail(err)
+	}
+
+	publish := func(payload []byte) {
+		if err := c.Publish(*topic, payload, byte(*qos), *retain); err != nil {
+			fail(err)
+		}
+	}
+
+	if *lines {
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(nil, 256<<20)
+		for scanner.Scan() {
+			publish(scanner.Bytes())
+		}
+		if err := scanner.Err(); err != nil {
+			fail(err)
+		}
+	} else {
+		for i := 0; i < *repeat; i++ {
+			if i != 0 {
+				time.Sleep(*delay)
+			}
+			publish(payload)
+		}
+	}
+
+	if err := c.Disconnect(); err != nil {
+		fail(err)
+	}
+}
+
+// isSet reports whether the flag has been given, e.g. -m "".
+func isSet(name string) bool {
+
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+func fail(err error) {
+
+	fmt.Fprintln(os.Stderr, "mqttpub:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,257 @@
+// Command mqttreplay plays a connection of a packet trace back against an
+// mqtt broker, to reproduce bugs of clients.
+//
+//	mqttreplay [-addr url] [-conn n | -client id] [-speed 1] [-wait 2s] [-o file] trace
+//
+// The trace is a file recorded by the server with -trace or log.trace_file,
+// see mqtt.TraceRecord for the format, or - for stdin. mqttreplay sends the
+// packets the client sent in the connection, with the recorded time between
+// them divided by -speed, or as fast as possible with -speed 0. It selects
+// the connection by -conn, by the client id of its CONNECT, or else takes the
+// first connection of the trace.
+//
+// The packets are sent as recorded, so the packet ids of acknowledgements for
+// messages from the broker only match if the broker sends the same messages
+// in the same order. The replayed connection is written as a trace to -o
+// (default stdout), to compare it with the recording.
+//
+//	mqttreplay -client sensor-17 -speed 10 mqtt.trace
+//	mqttreplay -addr tls://broker:8883 -conn 12 -o replay.trace mqtt.trace
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/client"
+)
+
+func main() {
+
+	addr := flag.String("addr", "tcp://localhost:1883", "broker address: tcp://, tls://, ws://, wss:// or unix:// URL")
+	conn := flag.Int64("conn", 0, "number of the connection to replay")
+	clientID := flag.String("client", "", "replay the first connection of this client id")
+	speed := flag.Float64("speed", 1, "replay speed, 0 for as fast as possible")
+	wait := flag.Duration("wait", 2*time.Second, "time to wait for packets from the broker after the last packet")
+	output := flag.String("o", "", "write the replayed connection to this trace file (default: stdout)")
+	caFile := flag.String("cafile", "", "PEM file with the CA certificates to verify the broker (default: system CAs)")
+	insecure := flag.Bool("insecure", false, "do not verify the certificate of the broker")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mqttreplay [flags] trace")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch {
+	case flag.NArg() != 1:
+		flag.Usage()
+		os.Exit(2)
+	case *conn != 0 && *clientID != "":
+		fail(errors.New("-conn and -client exclude each other"))
+	case *speed < 0:
+		fail(errors.New("-speed must not be negative"))
+	}
+
+	records, err := load(flag.Arg(0), *conn, *clientID)
+	if err != nil {
+		fail(err)
+	}
+
+	var tlsConfig *tls.Config
+	if *caFile != "" || *insecure {
+		tlsConfig = &tls.Config{InsecureSkipVerify: *insecure}
+		if *caFile != "" {
+			pem, err := os.ReadFile(*caFile)
+			if err != nil {
+				fail(err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				fail(fmt.Errorf("%s: no certificates", *caFile))
+			}
+		}
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			fail(err)
+		}
+		defer out.Close()
+	}
+
+	r := &replay{records: records, out: bufio.NewWriter(out)}
+	err = r.run(*addr, tlsConfig, *speed, *wait)
+	r.out.Flush()
+	fmt.Fprintf(os.Stderr, "mqttreplay: connection %d: %d packets sent, %d received\n",
+		records[0].Conn, r.sent, r.received)
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+
+	fmt.Fprintln(os.Stderr, "mqttreplay:", err)
+	os.Exit(1)
+}
+
+// load returns the packets sent by the client of one connection of a trace:
+// connection conn, the first connection of the client id, or else the first
+// connection.
+func load(path string, conn int64, clientID string) ([]*mqtt.TraceRecord, error) {
+
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	var records []*mqtt.TraceRecord
+	tr := mqtt.NewTraceReader(in)
+	for {
+		r, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if r.Dir != mqtt.TraceIn {
+			continue
+		}
+		if conn == 0 && (clientID == "" || r.ClientID() == clientID) {
+			conn = r.Conn
+		}
+		if r.Conn == conn {
+			records = append(records, r)
+		}
+	}
+
+	if len(records) == 0 {
+		switch {
+		case clientID != "":
+			return nil, fmt.Errorf("%s: no connection of client %q", path, clientID)
+		case conn != 0:
+			return nil, fmt.Errorf("%s: no packets of connection %d", path, conn)
+		default:
+			return nil, fmt.Errorf("%s: no packets", path)
+		}
+	}
+	return records, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// replay sends the recorded packets and writes the packets of both
+// directions to out.
+type replay struct {
+	records []*mqtt.TraceRecord
+
+	mu       sync.Mutex
+	out      *bufio.Writer
+	sent     int
+	received int
+}
+
+func (r *replay) trace(dir mqtt.Direction, packet []byte) {
+
+	r.mu.Lock()
+	rec := mqtt.TraceRecord{Time: time.Now(), Conn: r.records[0].Conn, Dir: dir, Packet: packet}
+	fmt.Fprintln(r.out, rec.String())
+	if dir == mqtt.TraceIn {
+		r.sent++
+	} else {
+		r.received++
+	}
+	r.mu.Unlock()
+}
+
+func (r *replay) run(addr string, tlsConfig *tls.Config, speed float64, wait time.Duration) error {
+
+	conn, err := client.DialConn(addr, tlsConfig, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// the broker closes the connection after a DISCONNECT or a bad packet
+	closed := make(chan error, 1)
+	go func() {
+		reader := bufio.NewReader(conn)
+		for {
+			packet, err := readPacket(reader)
+			if err != nil {
+				closed <- err
+				return
+			}
+			r.trace(mqtt.TraceOut, packet)
+		}
+	}()
+
+	start := time.Now()
+	first := r.records[0].Time
+	for _, rec := range r.records {
+		if speed > 0 {
+			at := start.Add(time.Duration(float64(rec.Time.Sub(first)) / speed))
+			time.Sleep(time.Until(at))
+		}
+		select {
+		case err := <-closed:
+			return fmt.Errorf("connection closed by the broker: %w", err)
+		default:
+		}
+		r.trace(mqtt.TraceIn, rec.Packet)
+		if _, err := conn.Write(rec.Packet); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(wait):
+	}
+	return nil
+}
+
+// readPacket reads one packet, including its fixed header.
+func readPacket(reader *bufio.Reader) ([]byte, error) {
+
+	b0, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	packet := []byte{b0}
+	length, multiplier := 0, 1
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		packet = append(packet, b)
+		length += int(b&127) * multiplier
+		if b&128 == 0 {
+			break
+		}
+		if multiplier > 0x4000 {
+			return nil, errors.New("malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	packet = append(packet, make([]byte, length)...)
+	_, err = io.ReadFull(reader, packet[len(packet)-length:])
+	return packet, err
+}
@@ -0,0 +1,181 @@
+// Command mqttsub subscribes to topics of an mqtt broker and prints the
+// messages it receives.
+//
+//	mqttsub [-addr url] -t filter [-t filter ...] [-q qos] [-v] [-F text|json|hex] [-C count] [-W timeout]
+//
+// The output format is one of
+//
+//	text  the payload, one message per line, with -v after the topic
+//	json  one JSON object per line: topic, qos, retain and payload, or
+//	      payload_base64 for payloads that are not UTF-8
+//	hex   a hex dump of the payload, with -v after the topic
+//
+// mqttsub stops after -C messages, or after the -W timeout. It exits with
+// status 1 if the timeout expires before -C messages have been received.
+// See -h for the connection flags, e.g. for credentials, TLS and the will
+// message.
+//
+//	mqttsub -t 'sensors/#' -v
+//	mqttsub -addr wss://broker/mqtt -u alice -t 'logs/+' -F json -C 10 -W 30s
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/client"
+	"github.com/j-forster/mqtt/internal/connflags"
+)
+
+// filters is a repeatable -t flag.
+type filters []string
+
+func (f *filters) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *filters) Set(filter string) error {
+
+	*f = append(*f, filter)
+	return nil
+}
+
+func main() {
+
+	var topics filters
+	conn := connflags.Register(flag.CommandLine)
+	flag.Var(&topics, "t", "topic filter to subscribe to, can be repeated")
+	qos := flag.Uint("q", 0, "QoS of the subscriptions: 0, 1 or 2")
+	verbose := flag.Bool("v", false, "print the topic before the payload")
+	format := flag.String("F", "text", "output format: text, json or hex")
+	count := flag.Int("C", 0, "exit after this many messages (0: no limit)")
+	timeout := flag.Duration("W", 0, "exit after this time (0: no limit)")
+	noRetained := flag.Bool("R", false, "do not print retained messages")
+	persistent := flag.Bool("c", false, "resume the session of the client id (no clean session)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mqttsub [flags] -t filter [-t filter ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch {
+	case flag.NArg() != 0 || len(topics) == 0:
+		flag.Usage()
+		os.Exit(2)
+	case *qos > 2:
+		fail(errors.New("-q must be 0, 1 or 2"))
+	case *format != "text" && *format != "json" && *format != "hex":
+		fail(fmt.Errorf("unknown output format %q", *format))
+	case *persistent && conn.ClientID == "":
+		fail(errors.New("-c needs a client id (-i)"))
+	}
+
+	opts, err := conn.Options()
+	if err != nil {
+		fail(err)
+	}
+	opts.CleanSession = !*persistent
+
+	// messages are printed by the main goroutine; if the output is slower
+	// than the broker, the client stops reading until there is room again
+	messages := make(chan *mqtt.Message, 1000)
+	opts.OnMessage = func(msg *mqtt.Message) {
+		messages <- msg
+	}
+
+	c, err := client.Dial(conn.Addr, opts)
+	if err != nil {
+		fail(err)
+	}
+	for _, filter := range topics {
+		if _, err := c.Subscribe(filter, byte(*qos)); err != nil {
+			fail(fmt.Errorf("%s: %w", filter, err))
+		}
+	}
+
+	var expired <-chan time.Time
+	if *timeout > 0 {
+		expired = time.After(*timeout)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	out := bufio.NewWriter(os.Stdout)
+	n := 0
+	for *count == 0 || n < *count {
+		select {
+		case msg := <-messages:
+			if *noRetained && msg.Retain {
+				continue
+			}
+			printMessage(out, msg, *format, *verbose)
+			out.Flush()
+			n++
+		case <-expired:
+			c.Disconnect()
+			if *count != 0 {
+				fail(fmt.Errorf("timeout after %d of %d messages", n, *count))
+			}
+			return
+		case <-interrupt:
+			c.Disconnect()
+			return
+		case <-c.Done():
+			fail(c.Err())
+		}
+	}
+	c.Disconnect()
+}
+
+// jsonMessage is a message in the json output format.
+type jsonMessage struct {
+	Topic         string  `json:"topic"`
+	QoS           byte    `json:"qos"`
+	Retain        bool    `json:"retain"`
+	Payload       *string `json:"payload,omitempty"`
+	PayloadBase64 *string `json:"payload_base64,omitempty"`
+}
+
+func printMessage(out *bufio.Writer, msg *mqtt.Message, format string, verbose bool) {
+
+	switch format {
+	case "json":
+		m := jsonMessage{Topic: msg.Topic, QoS: msg.QoS, Retain: msg.Retain}
+		if utf8.Valid(msg.Buf) {
+			s := string(msg.Buf)
+			m.Payload = &s
+		} else {
+			s := base64.StdEncoding.EncodeToString(msg.Buf)
+			m.PayloadBase64 = &s
+		}
+		json.NewEncoder(out).Encode(m)
+	case "hex":
+		if verbose {
+			fmt.Fprintln(out, msg.Topic)
+		}
+		out.WriteString(hex.Dump(msg.Buf))
+	default:
+		if verbose {
+			fmt.Fprint(out, msg.Topic, " ")
+		}
+		out.Write(msg.Buf)
+		out.WriteByte('\n')
+	}
+}
+
+func fail(err error) {
+
+	fmt.Fprintln(os.Stderr, "mqttsub:", err)
+	os.Exit(1)
+}
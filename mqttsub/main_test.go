@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/j-forster/mqtt"
+)
+
+func TestPrintMessage(t *testing.T) {
+
+	msg := &mqtt.Message{Topic: "a/b", Buf: []byte("hello"), QoS: 1, Retain: true}
+	binary := &mqtt.Message{Topic: "a/c", Buf: []byte{0xff, 0x00}}
+
+	for _, test := range []struct {
+		msg     *mqtt.Message
+		format  string
+		verbose bool
+		want    string
+	}{
+		{msg, "json", false, `{"topic":"a/b","qos":1,"retain":true,"payload":"hello"}` + "\n"},
+		{binary, "json", false, `{"topic":"a/c","qos":0,"retain":false,"payload_base64":"/wA="}` + "\n"},
+		{msg, "hex", false, "00000000  68 65 6c 6c 6f                                    |hello|\n"},
+		{msg, "hex", true, "a/b\n00000000  68 65 6c 6c 6f                                    |hello|\n"},
+		{msg, "text", false, "hello\n"},
+		{msg, "text", true, "a/b hello\n"},
+	} {
+		var b strings.Builder
+		out := bufio.NewWriter(&b)
+		printMessage(out, test.msg, test.format, test.verbose)
+		out.Flush()
+		if b.String() != test.want {
+			t.Errorf("%s, verbose %v: %q, want %q", test.format, test.verbose, b.String(), test.want)
+		}
+	}
+}
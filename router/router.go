@@ -0,0 +1,377 @@
+// Package router dispatches mqtt messages to handlers by topic patterns with
+// named parameters, like an HTTP request router:
+//
+//	r := router.New()
+//	r.Use(logRequests)
+//	r.Handle("devices/{id}/telemetry/{metric}", func(req *router.Request) error {
+//		return store(req.Param("id"), req.Param("metric"), req.Message.Buf)
+//	})
+//
+// A pattern is a topic with these levels:
+//
+//	literal      matches this level only
+//	{name}       matches one level, like '+'
+//	{name...}    matches all remaining levels, like '#' (last level only)
+//	+ and #      like {name} and {name...}, without parameter
+//
+// If several patterns match a topic, the pattern that is more specific at the
+// first level where they differ wins: a literal level before {name} before
+// {name...}. For 'devices/42/telemetry/temp' the pattern
+// 'devices/42/{rest...}' wins over 'devices/{id}/telemetry/temp', which wins
+// over 'devices/{id}/{rest...}'. As with topic filters, parameters at the
+// first level do not match topics starting with '$'.
+//
+// A Router is a plugin for mqtt.Chain that handles messages as they are
+// published (see Publish), or a local subscriber of a server (see Listen).
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/j-forster/mqtt"
+)
+
+// Request is a message that matched a pattern.
+type Request struct {
+	// Context is the client that published the message. It is nil for
+	// messages received with Listen.
+	Context *mqtt.Context
+	Message *mqtt.Message
+	// Pattern is the matched pattern.
+	Pattern string
+
+	names  []string
+	values []string
+}
+
+// Param returns the value of the parameter, or "" if the pattern has no such
+// parameter. The value of {name...} is the remaining topic, e.g. 'b/c'.
+func (req *Request) Param(name string) string {
+
+	for i, n := range req.names {
+		if n == name {
+			return req.values[i]
+		}
+	}
+	return ""
+}
+
+// Params returns all named parameters of the pattern.
+func (req *Request) Params() map[string]string {
+
+	params := make(map[string]string, len(req.names))
+	for i, n := range req.names {
+		if n != "" {
+			params[n] = req.values[i]
+		}
+	}
+	return params
+}
+
+// HandlerFunc handles the messages of a pattern. Used as Chain plugin, an
+// error rejects the message.
+type HandlerFunc func(req *Request) error
+
+// Middleware wraps the handlers of a Router, e.g. to log or authorize
+// requests.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// ErrNoRoute can be returned by Router.NotFound to reject messages without
+// matching pattern.
+var ErrNoRoute = errors.New("router: no matching pattern")
+
+// Router dispatches messages to the handler of the most specific pattern that
+// matches the topic. It is safe for concurrent use.
+type Router struct {
+	mu         sync.RWMutex
+	root       *node
+	middleware []Middleware
+
+	// NotFound handles messages without matching pattern, without middleware.
+	// If nil, the messages are accepted.
+	NotFound HandlerFunc
+}
+
+type node struct {
+	children map[string]*node
+	param    *node // {name} or +
+	rest     *node // {name...} or #
+
+	// set if a pattern ends here
+	pattern string
+	names   []string
+	handler HandlerFunc
+}
+
+// New creates a Router without patterns.
+func New() *Router {
+	return &Router{root: new(node)}
+}
+
+// Use adds middleware to all handlers, also to the handlers added before.
+// The first middleware is the outermost.
+func (r *Router) Use(middleware ...Middleware) {
+
+	r.mu.Lock()
+	r.middleware = append(r.middleware, middleware...)
+	r.mu.Unlock()
+}
+
+// Handle adds the handler for the pattern. It panics if the pattern is
+// invalid or matches the same topics as another pattern, e.g.
+// 'a/{x}' and 'a/+'.
+func (r *Router) Handle(pattern string, handler HandlerFunc) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.root
+	var names []string
+	levels := strings.Split(pattern, "/")
+	for i, level := range levels {
+
+		name, kind, err := parseLevel(level)
+		if err == nil && kind == rest && i != len(levels)-1 {
+			err = errors.New("multi-level parameter is not the last level")
+		}
+		if err == nil && name != "" {
+			for _, n := range names {
+				if n == name {
+					err = fmt.Errorf("duplicate parameter %q", name)
+				}
+			}
+		}
+		if err != nil {
+			panic(fmt.Sprintf("router: pattern %q: %v", pattern, err))
+		}
+
+		switch kind {
+		case literal:
+			if n.children == nil {
+				n.children = make(map[string]*node)
+			}
+			if n.children[level] == nil {
+				n.children[level] = new(node)
+			}
+			n = n.children[level]
+		case param:
+			if n.param == nil {
+				n.param = new(node)
+			}
+			n = n.param
+			names = append(names, name)
+		case rest:
+			if n.rest == nil {
+				n.rest = new(node)
+			}
+			n = n.rest
+			names = append(names, name)
+		}
+	}
+
+	if n.handler != nil {
+		panic(fmt.Sprintf("router: pattern %q conflicts with %q", pattern, n.pattern))
+	}
+	n.pattern = pattern
+	n.names = names
+	n.handler = handler
+}
+
+// HandleFunc is Handle for functions with the signature of a PublishHandler.
+func (r *Router) HandleFunc(pattern string, fn func(ctx *mqtt.Context, msg *mqtt.Message) error) {
+
+	r.Handle(pattern, func(req *Request) error {
+		return fn(req.Context, req.Message)
+	})
+}
+
+// level kinds of a pattern
+const (
+	literal = iota
+	param
+	rest
+)
+
+func parseLevel(level string) (name string, kind int, err error) {
+
+	switch {
+	case level == "+":
+		return "", param, nil
+	case level == "#":
+		return "", rest, nil
+	case strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}"):
+		name = level[1 : len(level)-1]
+		kind = param
+		if n, ok := strings.CutSuffix(name, "..."); ok {
+			name, kind = n, rest
+		}
+		if name == "" || strings.ContainsAny(name, "{}+#") {
+			return "", 0, fmt.Errorf("invalid parameter %q", level)
+		}
+		return name, kind, nil
+	case strings.ContainsAny(level, "{}+#"):
+		return "", 0, fmt.Errorf("invalid level %q", level)
+	}
+	return "", literal, nil
+}
+
+// Match returns the request for the most specific pattern that matches the
+// topic, or nil if no pattern matches.
+func (r *Router) Match(topic string) *Request {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n, values := r.root.match(strings.Split(topic, "/"), 0, nil)
+	if n == nil {
+		return nil
+	}
+	return &Request{Pattern: n.pattern, names: n.names, values: values}
+}
+
+func (n *node) match(levels []string, i int, values []string) (*node, []string) {
+
+	if i == len(levels) {
+		if n.handler != nil {
+			return n, values
+		}
+		// 'a/#' also matches 'a'
+		if n.rest != nil && n.rest.handler != nil {
+			return n.rest, append(values, "")
+		}
+		return nil, nil
+	}
+
+	level := levels[i]
+	// wildcards at the first level do not match topics starting with '$'
+	wildcard := i != 0 || !strings.HasPrefix(level, "$")
+
+	if c := n.children[level]; c != nil {
+		if m, v := c.match(levels, i+1, values); m != nil {
+			return m, v
+		}
+	}
+	if n.param != nil && wildcard {
+		if m, v := n.param.match(levels, i+1, append(values, level)); m != nil {
+			return m, v
+		}
+	}
+	if n.rest != nil && n.rest.handler != nil && wildcard {
+		return n.rest, append(values, strings.Join(levels[i:], "/"))
+	}
+	return nil, nil
+}
+
+// Dispatch calls the handler of the most specific pattern that matches the
+// topic of the message, or NotFound.
+func (r *Router) Dispatch(ctx *mqtt.Context, msg *mqtt.Message) error {
+
+	r.mu.RLock()
+	n, values := r.root.match(strings.Split(msg.Topic, "/"), 0, nil)
+	middleware := r.middleware
+	notFound := r.NotFound
+	r.mu.RUnlock()
+
+	if n == nil {
+		if notFound == nil {
+			return nil
+		}
+		return notFound(&Request{Context: ctx, Message: msg})
+	}
+
+	h := n.handler
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h(&Request{
+		Context: ctx,
+		Message: msg,
+		Pattern: n.pattern,
+		names:   n.names,
+		values:  values,
+	})
+}
+
+// Publish implements mqtt.PublishHandler, so that a Router can be used as
+// plugin of a mqtt.Chain. The handlers are called for every published
+// message before it is routed to the subscribers. An error of the handler
+// rejects the message.
+func (r *Router) Publish(ctx *mqtt.Context, msg *mqtt.Message) error {
+
+	return r.Dispatch(ctx, msg)
+}
+
+// Listen subscribes the router to the topic filters of all patterns with
+// Server.SubscribeFunc, so that the handlers receive the messages after they
+// have passed the hooks of the server. Patterns added later are not
+// subscribed. The errors of the handlers are ignored.
+// The messages of one pattern are handled in order, but the handlers of
+// different patterns run concurrently.
+// The returned function unsubscribes again.
+func (r *Router) Listen(server *mqtt.Server, qos byte) (unsubscribe func(), err error) {
+
+	r.mu.RLock()
+	var patterns []string
+	r.root.walk(func(n *node) {
+		patterns = append(patterns, n.pattern)
+	})
+	r.mu.RUnlock()
+
+	var unsubscribes []func()
+	unsubscribe = func() {
+		for _, u := range unsubscribes {
+			u()
+		}
+	}
+
+	for _, pattern := range patterns {
+		pattern := pattern
+		u, err := server.SubscribeFunc(filter(pattern), qos, func(msg *mqtt.Message) {
+			// a message matching several filters is dispatched once, by the
+			// subscription of the pattern that wins
+			if req := r.Match(msg.Topic); req != nil && req.Pattern == pattern {
+				r.Dispatch(nil, msg)
+			}
+		})
+		if err != nil {
+			unsubscribe()
+			return nil, err
+		}
+		unsubscribes = append(unsubscribes, u)
+	}
+	return unsubscribe, nil
+}
+
+func (n *node) walk(fn func(n *node)) {
+
+	if n.handler != nil {
+		fn(n)
+	}
+	for _, c := range n.children {
+		c.walk(fn)
+	}
+	if n.param != nil {
+		n.param.walk(fn)
+	}
+	if n.rest != nil {
+		n.rest.walk(fn)
+	}
+}
+
+// filter returns the topic filter of a pattern.
+func filter(pattern string) string {
+
+	levels := strings.Split(pattern, "/")
+	for i, level := range levels {
+		switch _, kind, _ := parseLevel(level); kind {
+		case param:
+			levels[i] = "+"
+		case rest:
+			levels[i] = "#"
+		}
+	}
+	return strings.Join(levels, "/")
+}
@@ -0,0 +1,179 @@
+package router
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/j-forster/mqtt"
+)
+
+func TestMatch(t *testing.T) {
+
+	r := New()
+	for _, p := range []string{
+		"devices/{id}/telemetry/{metric}",
+		"devices/{id}/telemetry/temp",
+		"devices/42/{rest...}",
+		"devices/{id}/{rest...}",
+		"devices/{id}",
+		"+/status",
+		"#",
+	} {
+		r.Handle(p, func(req *Request) error { return nil })
+	}
+
+	tests := []struct {
+		topic   string
+		pattern string
+		params  string
+	}{
+		{"devices/7/telemetry/hum", "devices/{id}/telemetry/{metric}", "id=7 metric=hum"},
+		{"devices/7/telemetry/temp", "devices/{id}/telemetry/temp", "id=7"},
+		{"devices/42/telemetry/temp", "devices/42/{rest...}", "rest=telemetry/temp"},
+		{"devices/7/config/a/b", "devices/{id}/{rest...}", "id=7 rest=config/a/b"},
+		{"devices/7", "devices/{id}", "id=7"},
+		{"devices/42", "devices/42/{rest...}", "rest="},
+		{"lamp/status", "+/status", ""},
+		{"other/topic", "#", ""},
+		{"$SYS/status", "", ""}, // wildcards at the first level
+	}
+
+	for _, test := range tests {
+		req := r.Match(test.topic)
+		if req == nil {
+			if test.pattern != "" {
+				t.Errorf("%s: no match, want %s", test.topic, test.pattern)
+			}
+			continue
+		}
+		if req.Pattern != test.pattern {
+			t.Errorf("%s: matched %s, want %s", test.topic, req.Pattern, test.pattern)
+			continue
+		}
+		var params []string
+		for _, name := range req.names {
+			if name != "" {
+				params = append(params, name+"="+req.Param(name))
+			}
+		}
+		if got := strings.Join(params, " "); got != test.params {
+			t.Errorf("%s: params %q, want %q", test.topic, got, test.params)
+		}
+	}
+}
+
+func TestHandlePanics(t *testing.T) {
+
+	r := New()
+	r.Handle("a/{x}", func(req *Request) error { return nil })
+
+	for _, p := range []string{
+		"a/+",        // same topics as a/{x}
+		"a/{x...}/b", // multi-level not last
+		"a/{x}/{x}",  // duplicate parameter
+		"a/b{x}",     // partial level
+		"a/{}",       // no name
+		"a/#/b",      // # not last
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", p)
+				}
+			}()
+			r.Handle(p, func(req *Request) error { return nil })
+		}()
+	}
+}
+
+func TestDispatch(t *testing.T) {
+
+	var calls []string
+	r := New()
+	r.Handle("devices/{id}/cmd", func(req *Request) error {
+		calls = append(calls, "handler "+req.Param("id"))
+		if req.Param("id") == "bad" {
+			return mqtt.ErrNotAuthorized
+		}
+		return nil
+	})
+	r.Use(func(next HandlerFunc) HandlerFunc {
+		return func(req *Request) error {
+			calls = append(calls, "outer")
+			return next(req)
+		}
+	}, func(next HandlerFunc) HandlerFunc {
+		return func(req *Request) error {
+			calls = append(calls, "inner")
+			return next(req)
+		}
+	})
+
+	chain := mqtt.NewChain(r)
+	if err := chain.Publish(nil, &mqtt.Message{Topic: "devices/1/cmd"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(calls, ", "); got != "outer, inner, handler 1" {
+		t.Errorf("calls: %s", got)
+	}
+	if err := chain.Publish(nil, &mqtt.Message{Topic: "devices/bad/cmd"}); !errors.Is(err, mqtt.ErrNotAuthorized) {
+		t.Errorf("err = %v", err)
+	}
+	if err := chain.Publish(nil, &mqtt.Message{Topic: "other"}); err != nil {
+		t.Errorf("no route: %v", err)
+	}
+
+	r.NotFound = func(req *Request) error { return ErrNoRoute }
+	if err := chain.Publish(nil, &mqtt.Message{Topic: "other"}); err != ErrNoRoute {
+		t.Errorf("not found: %v", err)
+	}
+}
+
+func TestListen(t *testing.T) {
+
+	server := mqtt.NewServer(nil, nil)
+	go server.Run()
+	defer server.Close()
+
+	got := make(chan string, 10)
+	r := New()
+	r.Handle("devices/{id}/telemetry/{metric}", func(req *Request) error {
+		got <- "metric " + req.Param("id") + " " + req.Param("metric")
+		return nil
+	})
+	r.Handle("devices/{id}/{rest...}", func(req *Request) error {
+		got <- "rest " + req.Param("id") + " " + req.Param("rest")
+		return nil
+	})
+
+	unsubscribe, err := r.Listen(server, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	server.PublishLocal("devices/1/telemetry/temp", []byte("21"), 0, false)
+	server.PublishLocal("devices/2/config", []byte("{}"), 0, false)
+
+	// the patterns have their own subscriptions, so the order may differ
+	want := map[string]bool{"metric 1 temp": true, "rest 2 config": true}
+	for len(want) != 0 {
+		select {
+		case s := <-got:
+			if !want[s] {
+				t.Errorf("got %q", s)
+			}
+			delete(want, s)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %v", want)
+		}
+	}
+
+	select {
+	case s := <-got:
+		t.Errorf("dispatched twice: %q", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
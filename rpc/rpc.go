@@ -0,0 +1,444 @@
+// Package rpc implements request/response calls over MQTT:
+//
+//	// the device
+//	conn, err := rpc.Dial("tcp://localhost:1883", &client.Options{ClientID: "device-42"})
+//	conn.Serve("devices/42/reboot", func(req *rpc.Request) ([]byte, error) {
+//		return []byte("ok"), reboot(req.Payload)
+//	})
+//
+//	// the caller
+//	conn, err := rpc.Dial("tcp://localhost:1883", &client.Options{ClientID: "app"})
+//	resp, err := conn.Call(ctx, "devices/42/reboot", []byte("now"))
+//
+// MQTT 5 response topic and correlation data properties are not supported:
+// MQTT 3.1, which the client package and this server speak, has no message
+// properties. Both are part of the topics instead:
+//
+//	request   <method>/req/<caller>/<correlation>
+//	response  <method>/res/<caller>/<correlation>
+//	error     <method>/err/<caller>/<correlation>   (payload: error text)
+//
+// The caller is the client id of the calling connection, or a random id if
+// the client id is empty or not a valid topic level. ACLs can restrict
+// callers to their own responses, e.g.
+//
+//	allow write devices/+/reboot/req/%c/+
+//	allow read  devices/+/reboot/res/%c/+
+//	allow read  devices/+/reboot/err/%c/+
+//
+// Requests and responses are published with QoS 1.
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/client"
+)
+
+// topic levels of the convention
+const (
+	kindRequest  = "req"
+	kindResponse = "res"
+	kindError    = "err"
+)
+
+// Error is an error returned by the handler of a method.
+type Error struct {
+	Method  string
+	Message string
+}
+
+func (err *Error) Error() string {
+	return "rpc: " + err.Method + ": " + err.Message
+}
+
+// ErrInvalidMethod is returned for method topics that are empty or contain
+// '#'. Methods of Call must not contain '+' either.
+var ErrInvalidMethod = errors.New("rpc: invalid method topic")
+
+// ErrBusy answers a request if MaxPending requests are waiting already. The
+// caller gets an *Error with its message.
+var ErrBusy = errors.New("too many pending requests")
+
+// Request is a call received by a method handler.
+type Request struct {
+	// Method is the method topic of the call. It differs from the served
+	// method if that contains '+'.
+	Method  string
+	Payload []byte
+	// Caller identifies the calling connection.
+	Caller string
+	// ResponseTopic and CorrelationData are taken from the request topic,
+	// not from MQTT 5 properties.
+	ResponseTopic   string
+	CorrelationData []byte
+}
+
+// HandlerFunc answers a call with a response payload or an error.
+type HandlerFunc func(req *Request) ([]byte, error)
+
+type response struct {
+	payload []byte
+	err     error
+}
+
+// Conn is a client connection that can serve methods and call methods.
+type Conn struct {
+	client *client.Client
+	caller string
+	// prefix of the correlation data, so that late responses to a previous
+	// connection with the same client id are not taken as responses
+	nonce string
+
+	// Timeout is used for calls with a context without deadline.
+	// Default: 10s.
+	Timeout time.Duration
+	// MaxConcurrent limits the number of requests handled at the same time.
+	// More requests wait in order. Set it before Serve. Default: 64.
+	MaxConcurrent int
+	// MaxPending limits the number of waiting requests. More requests are
+	// answered with the error ErrBusy right away. Set it before Serve.
+	// Default: 1024.
+	MaxPending int
+
+	onMessage func(msg *mqtt.Message)
+
+	mu         sync.Mutex
+	seq        uint64
+	calls      map[string]chan response
+	subscribed map[string]bool // methods with response subscriptions
+	methods    []served
+	running    int       // handlers
+	pending    []pending // requests waiting for a handler
+}
+
+type served struct {
+	method  []string
+	handler HandlerFunc
+}
+
+type pending struct {
+	handler HandlerFunc
+	req     *Request
+}
+
+// Dial connects to a broker like client.Dial. The OnMessage function of opts
+// receives all messages that are not requests or responses of this Conn.
+func Dial(addr string, opts *client.Options) (*Conn, error) {
+
+	c, opts := newConn(opts)
+	cl, err := client.Dial(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.client = cl
+	return c, nil
+}
+
+// Connect connects over an existing connection like client.Connect.
+func Connect(conn net.Conn, opts *client.Options) (*Conn, error) {
+
+	c, opts := newConn(opts)
+	cl, err := client.Connect(conn, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.client = cl
+	return c, nil
+}
+
+func newConn(opts *client.Options) (*Conn, *client.Options) {
+
+	var o client.Options
+	if opts != nil {
+		o = *opts
+	}
+
+	c := &Conn{
+		caller:     o.ClientID,
+		nonce:      randomID(4),
+		Timeout:    10 * time.Second,
+		onMessage:  o.OnMessage,
+		calls:      make(map[string]chan response),
+		subscribed: make(map[string]bool),
+	}
+	if c.caller == "" || strings.ContainsAny(c.caller, "/+#") {
+		c.caller = randomID(8)
+	}
+	o.OnMessage = c.receive
+	return c, &o
+}
+
+func randomID(n int) string {
+
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Client returns the client connection, e.g. to publish other messages.
+func (c *Conn) Client() *client.Client {
+	return c.client
+}
+
+// Close disconnects from the broker. Pending calls fail with client.ErrClosed.
+func (c *Conn) Close() error {
+	return c.client.Disconnect()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Serve subscribes to the requests of the method and answers them with the
+// handler. The method may contain '+' to serve several methods. Handlers run
+// in their own goroutines, up to MaxConcurrent at the same time. A panic of
+// a handler is answered with an error.
+func (c *Conn) Serve(method string, handler HandlerFunc) error {
+
+	if method == "" || strings.Contains(method, "#") {
+		return ErrInvalidMethod
+	}
+
+	c.mu.Lock()
+	c.methods = append(c.methods, served{strings.Split(method, "/"), handler})
+	c.mu.Unlock()
+
+	_, err := c.client.Subscribe(method+"/"+kindRequest+"/+/+", 1)
+	return err
+}
+
+// Call calls the method and returns the response payload, or the *Error of
+// the handler. It fails with the error of the context if the context is
+// done before the response arrives.
+// Calls can be made from many goroutines at the same time.
+func (c *Conn) Call(ctx context.Context, method string, payload []byte) ([]byte, error) {
+
+	if method == "" || strings.ContainsAny(method, "+#") {
+		return nil, ErrInvalidMethod
+	}
+
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	if err := c.subscribeResponses(method); err != nil {
+		return nil, err
+	}
+
+	result := make(chan response, 1)
+	c.mu.Lock()
+	c.seq++
+	correlation := c.nonce + strconv.FormatUint(c.seq, 36)
+	c.calls[correlation] = result
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, correlation)
+		c.mu.Unlock()
+	}()
+
+	topic := method + "/" + kindRequest + "/" + c.caller + "/" + correlation
+	if err := c.client.Publish(topic, payload, 1, false); err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-result:
+		return r.payload, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.client.Done():
+		return nil, c.client.Err()
+	}
+}
+
+// subscribeResponses subscribes to the responses of a method once.
+func (c *Conn) subscribeResponses(method string) error {
+
+	c.mu.Lock()
+	ok := c.subscribed[method]
+	c.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	for _, kind := range []string{kindResponse, kindError} {
+		if _, err := c.client.Subscribe(method+"/"+kind+"/"+c.caller+"/+", 1); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.subscribed[method] = true
+	c.mu.Unlock()
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// receive is the OnMessage function of the client.
+func (c *Conn) receive(msg *mqtt.Message) {
+
+	levels := strings.Split(msg.Topic, "/")
+	if n := len(levels); n >= 4 {
+
+		method := levels[:n-3]
+		kind, caller, correlation := levels[n-3], levels[n-2], levels[n-1]
+
+		switch kind {
+		case kindResponse, kindError:
+			if caller == c.caller && c.respond(strings.Join(method, "/"), kind, correlation, msg.Buf) {
+				return
+			}
+		case kindRequest:
+			if h := c.handler(method); h != nil {
+				req := &Request{
+					Method:          strings.Join(method, "/"),
+					Payload:         msg.Buf,
+					Caller:          caller,
+					ResponseTopic:   strings.Join(method, "/") + "/" + kindResponse + "/" + caller + "/" + correlation,
+					CorrelationData: []byte(correlation),
+				}
+				c.dispatch(h, req)
+				return
+			}
+		}
+	}
+
+	if c.onMessage != nil {
+		c.onMessage(msg)
+	}
+}
+
+// respond passes a response to the waiting call.
+func (c *Conn) respond(method, kind, correlation string, payload []byte) bool {
+
+	c.mu.Lock()
+	result, ok := c.calls[correlation]
+	c.mu.Unlock()
+	if !ok {
+		// late response to a call that timed out, or not one of our calls
+		return strings.HasPrefix(correlation, c.nonce)
+	}
+
+	r := response{payload: payload}
+	if kind == kindError {
+		r = response{err: &Error{Method: method, Message: string(payload)}}
+	}
+	select {
+	case result <- r:
+	default: // duplicate response
+	}
+	return true
+}
+
+func (c *Conn) handler(method []string) HandlerFunc {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.methods {
+		if match(s.method, method) {
+			return s.handler
+		}
+	}
+	return nil
+}
+
+// match reports whether a method topic matches a served method with '+'.
+func match(filter, method []string) bool {
+
+	if len(filter) != len(method) {
+		return false
+	}
+	for i, f := range filter {
+		if f != "+" && f != method[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dispatch starts a goroutine for the handler of a request, or queues the
+// request if MaxConcurrent handlers are running. It must not block the
+// client: the responses are published with QoS 1, which needs the reading
+// goroutine. Only the error response to a request that does not fit into the
+// queue is published here, with QoS 0.
+func (c *Conn) dispatch(h HandlerFunc, req *Request) {
+
+	c.mu.Lock()
+	max := c.MaxConcurrent
+	if max <= 0 {
+		max = 64
+	}
+	maxPending := c.MaxPending
+	if maxPending <= 0 {
+		maxPending = 1024
+	}
+	if c.running >= max {
+		if len(c.pending) >= maxPending {
+			c.mu.Unlock()
+			c.client.Publish(errorTopic(req), []byte(ErrBusy.Error()), 0, false)
+			return
+		}
+		c.pending = append(c.pending, pending{h, req})
+		c.mu.Unlock()
+		return
+	}
+	c.running++
+	c.mu.Unlock()
+
+	go c.handle(h, req)
+}
+
+// handle answers a request, and then the queued requests.
+func (c *Conn) handle(h HandlerFunc, req *Request) {
+
+	for {
+		topic := req.ResponseTopic
+		payload, err := call(h, req)
+		if err != nil {
+			topic = errorTopic(req)
+			payload = []byte(err.Error())
+		}
+		c.client.Publish(topic, payload, 1, false)
+
+		c.mu.Lock()
+		if len(c.pending) == 0 {
+			c.running--
+			c.mu.Unlock()
+			return
+		}
+		next := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+		h, req = next.handler, next.req
+	}
+}
+
+// errorTopic returns the topic of an error response to the request.
+func errorTopic(req *Request) string {
+	return req.Method + "/" + kindError + "/" + req.Caller + "/" + string(req.CorrelationData)
+}
+
+// call runs a handler and returns a panic as error.
+func call(h HandlerFunc, req *Request) (payload []byte, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h(req)
+}
@@ -0,0 +1,240 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/client"
+)
+
+func connect(t *testing.T, server *mqtt.Server, clientID string) *Conn {
+
+	conn, pipe := net.Pipe()
+	go server.Serve(pipe)
+	c, err := Connect(conn, &client.Options{ClientID: clientID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCall(t *testing.T) {
+
+	server := mqtt.NewServer(nil, nil)
+	go server.Run()
+	defer server.Close()
+
+	device := connect(t, server, "device")
+	err := device.Serve("devices/+/echo", func(req *Request) ([]byte, error) {
+		if string(req.Payload) == "fail" {
+			return nil, errors.New("failed")
+		}
+		if string(req.Payload) == "panic" {
+			panic("oops")
+		}
+		if string(req.Payload) == "slow" {
+			time.Sleep(time.Second)
+		}
+		return []byte(req.Method + " " + strings.ToUpper(string(req.Payload))), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := connect(t, server, "app")
+	ctx := context.Background()
+
+	resp, err := app.Call(ctx, "devices/1/echo", []byte("hello"))
+	if err != nil || string(resp) != "devices/1/echo HELLO" {
+		t.Fatalf("Call = %q, %v", resp, err)
+	}
+
+	// concurrent calls
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := fmt.Sprint("m", i)
+			resp, err := app.Call(ctx, "devices/2/echo", []byte(payload))
+			if err != nil || string(resp) != "devices/2/echo "+strings.ToUpper(payload) {
+				t.Errorf("Call %d = %q, %v", i, resp, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, err = app.Call(ctx, "devices/1/echo", []byte("fail"))
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) || rpcErr.Message != "failed" {
+		t.Errorf("handler error: %v", err)
+	}
+
+	_, err = app.Call(ctx, "devices/1/echo", []byte("panic"))
+	if !errors.As(err, &rpcErr) || rpcErr.Message != "panic: oops" {
+		t.Errorf("handler panic: %v", err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = app.Call(timeout, "devices/1/echo", []byte("slow")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow call: %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = app.Call(canceled, "nobody/serves/this", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled call: %v", err)
+	}
+
+	if _, err = app.Call(ctx, "devices/+/echo", nil); err != ErrInvalidMethod {
+		t.Errorf("wildcard call: %v", err)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+
+	server := mqtt.NewServer(nil, nil)
+	go server.Run()
+	defer server.Close()
+
+	device := connect(t, server, "device")
+	device.MaxConcurrent = 2
+	var mu sync.Mutex
+	var running, max int
+	err := device.Serve("sleep", func(req *Request) ([]byte, error) {
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := connect(t, server, "app")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := app.Call(context.Background(), "sleep", nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if max != 2 {
+		t.Fatalf("%d handlers at the same time", max)
+	}
+}
+
+func TestMaxPending(t *testing.T) {
+
+	server := mqtt.NewServer(nil, nil)
+	go server.Run()
+	defer server.Close()
+
+	device := connect(t, server, "device")
+	device.MaxConcurrent = 1
+	device.MaxPending = 2
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	err := device.Serve("block", func(req *Request) ([]byte, error) {
+		started <- struct{}{}
+		<-release
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := connect(t, server, "app")
+	results := make(chan error, 10)
+	call := func() {
+		_, err := app.Call(context.Background(), "block", nil)
+		results <- err
+	}
+
+	// one running request, two waiting ones
+	go call()
+	<-started
+	go call()
+	go call()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		device.mu.Lock()
+		n := len(device.pending)
+		device.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d pending requests", n)
+		}
+	}
+
+	go call()
+	var rpcErr *Error
+	select {
+	case err := <-results:
+		if !errors.As(err, &rpcErr) || rpcErr.Message != ErrBusy.Error() {
+			t.Fatalf("call with full queue: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no response with full queue")
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestOtherMessages(t *testing.T) {
+
+	server := mqtt.NewServer(nil, nil)
+	go server.Run()
+	defer server.Close()
+
+	got := make(chan string, 1)
+	conn, pipe := net.Pipe()
+	go server.Serve(pipe)
+	c, err := Connect(conn, &client.Options{OnMessage: func(msg *mqtt.Message) {
+		got <- msg.Topic
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Client().Subscribe("news/#", 0)
+	server.PublishLocal("news/a/req/b/c", nil, 0, false)
+
+	select {
+	case topic := <-got:
+		if topic != "news/a/req/b/c" {
+			t.Errorf("got %s", topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not passed to OnMessage")
+	}
+}
@@ -3,9 +3,12 @@ package mqtt
 import (
 	"io"
 	"net"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/j-forster/mqtt/tools"
+	"github.com/j-forster/mqtt/topics"
 )
 
 type SubscriptionRequest struct {
@@ -16,25 +19,72 @@ type SubscriptionRequest struct {
 const (
 	CREATE = 1
 	REMOVE = 2
+	UPDATE = 3
 )
 
 type SubscriptionChange struct {
 	action int
 	subs   *Subscription
 	topic  string
+	qos    byte
 }
 
 type Server struct {
 
 	//subsReq chan SubscriptionRequest
 	//unsubs chan *Subscription
-	state    int
+	state    atomic.Int32
 	closer   io.Closer
 	sigclose chan (struct{})
 	subs     chan SubscriptionChange
 	pub      chan *Message
-	topics   *Topic
+	exec     chan func()
 	handler  Handler
+
+	// subscriptions by topic filter and retained messages by topic,
+	// owned by the Run goroutine
+	subscriptions *topics.Tree[*Subscription]
+	retained      *topics.Tree[*Message]
+
+	// stored sessions of offline clients by client id
+	sessions map[string]*Context
+	smu      sync.Mutex
+
+	// connected clients, the newest connection of each client id, and banned
+	// client ids
+	clients map[*Context]struct{}
+	owners  map[string]*Context
+	banned  map[string]bool
+	cmu     sync.Mutex
+
+	// the context of PublishLocal
+	local     *Context
+	localOnce sync.Once
+
+	// SessionExpiry is the time a stored session is kept after its client
+	// disconnected. Zero means forever.
+	SessionExpiry time.Duration
+
+	// ConnectTimeout and PublishTimeout limit the time an AsyncConnectHandler
+	// or AsyncPublishHandler may take to decide. Zero means no limit.
+	ConnectTimeout time.Duration
+	PublishTimeout time.Duration
+
+	// TakeoverTimeout limits the time a new connection waits for the older
+	// connection of its client id to close. Zero means no limit.
+	TakeoverTimeout time.Duration
+
+	// Logger receives the server logs. It defaults to NopLogger.
+	Logger Logger
+
+	// Limits protect the server from clients that use too many resources.
+	Limits Limits
+
+	// Metrics counts packets, messages and connections of this server.
+	Metrics *Metrics
+
+	// Tracer records the packets of all connections, see Tracer.
+	Tracer Tracer
 }
 
 func NewServer(closer io.Closer, handler Handler) *Server {
@@ -47,18 +97,47 @@ func NewServer(closer io.Closer, handler Handler) *Server {
 	svr.sigclose = make(chan struct{})
 	svr.subs = make(chan SubscriptionChange)
 	svr.pub = make(chan *Message)
-	svr.topics = NewTopic(nil, "")
+	svr.exec = make(chan func())
+	svr.sessions = make(map[string]*Context)
+	svr.clients = make(map[*Context]struct{})
+	svr.owners = make(map[string]*Context)
+	svr.banned = make(map[string]bool)
+	svr.subscriptions = new(topics.Tree[*Subscription])
+	svr.retained = new(topics.Tree[*Message])
+	svr.Logger = NopLogger
+	svr.Metrics = NewMetrics()
+	svr.ConnectTimeout = defaultConnectTimeout
+	svr.PublishTimeout = defaultPublishTimeout
+	svr.TakeoverTimeout = defaultTakeoverTimeout
 	return svr
 }
 
+func (svr *Server) log() Logger {
+
+	if svr.Logger == nil {
+		return NopLogger
+	}
+	return svr.Logger
+}
+
 func (svr *Server) Alive() bool {
 
-	return svr.state != CLOSING && svr.state != CLOSED
+	state := svr.state.Load()
+	return state != CLOSING && state != CLOSED
 }
 
 func (svr *Server) Publish(ctx *Context, msg *Message) {
 
 	if !svr.Alive() {
+		ctx.Log().Debug("message dropped",
+			"topic", msg.Topic,
+			"reason", ErrServerClosing)
+		svr.onDrop(ctx, msg, ErrServerClosing)
+		return
+	}
+
+	if h, ok := svr.asyncPublish(); ok {
+		ctx.publishAsync(h, msg)
 		return
 	}
 
@@ -66,29 +145,117 @@ func (svr *Server) Publish(ctx *Context, msg *Message) {
 	if svr.handler != nil {
 		err = svr.handler.Publish(ctx, msg)
 	}
-	if err == nil {
+	svr.route(ctx, msg, err)
+}
+
+// route passes a message that has been accepted by the publish hook (err is
+// nil) to the rewrite hook and then to the subscribers.
+func (svr *Server) route(ctx *Context, msg *Message, err error) {
+
+	if err != nil {
+		svr.drop(ctx, msg, err)
+		return
+	}
 
-		svr.pub <- msg
+	msgs := []*Message{msg}
+	if h, ok := svr.handler.(RewriteHandler); ok {
+		msgs, err = h.Rewrite(ctx, msg)
+		if err != nil {
+			svr.drop(ctx, msg, err)
+			return
+		}
+		if len(msgs) == 0 {
+			svr.drop(ctx, msg, ErrDiscarded)
+			return
+		}
+	}
+
+	for _, msg := range msgs {
+		if !ValidTopic(msg.Topic) || msg.QoS > 2 {
+			svr.drop(ctx, msg, ErrInvalidMessage)
+			continue
+		}
+		select {
+		case svr.pub <- msg:
+		case <-svr.sigclose:
+			svr.drop(ctx, msg, ErrServerClosing)
+		}
+	}
+}
+
+func (svr *Server) drop(ctx *Context, msg *Message, reason error) {
+
+	ctx.Log().Info("message dropped",
+		"topic", msg.Topic,
+		"reason", reason)
+	svr.onDrop(ctx, msg, reason)
+}
+
+// grant asks the handler about a subscription. It returns the granted qos,
+// or SUBSCRIBE_FAILURE if the subscription has been rejected.
+func (svr *Server) grant(ctx *Context, topic string, qos byte) byte {
+
+	if svr.handler != nil {
+		if err := svr.handler.Subscribe(ctx, topic, qos); err != nil {
+			ctx.Log().Info("subscription rejected", "topic", topic, "err", err)
+			return SUBSCRIBE_FAILURE
+		}
+	}
+
+	granted := qos
+	if h, ok := svr.handler.(GrantHandler); ok {
+		granted = h.Grant(ctx, topic, qos)
+		if granted == SUBSCRIBE_FAILURE {
+			ctx.Log().Info("subscription rejected", "topic", topic)
+			return SUBSCRIBE_FAILURE
+		}
+		if granted > qos {
+			granted = qos
+		}
 	}
+	return granted
 }
 
-func (svr *Server) Subscribe(ctx *Context, topic string, qos byte) *Subscription {
+// Subscribe creates a new subscription for the context, if the handler grants
+// it. It returns the subscription (nil if rejected) and the granted qos.
+func (svr *Server) Subscribe(ctx *Context, topic string, qos byte) (*Subscription, byte) {
 
 	if !svr.Alive() {
-		return nil
+		return nil, SUBSCRIBE_FAILURE
 	}
 
-	var err error = nil
-	if svr.handler != nil {
-		err = svr.handler.Subscribe(ctx, topic, qos)
+	granted := svr.grant(ctx, topic, qos)
+	if granted == SUBSCRIBE_FAILURE {
+		return nil, granted
+	}
+
+	subs := NewSubscription(ctx, granted)
+	select {
+	case svr.subs <- SubscriptionChange{CREATE, subs, topic, granted}:
+		return subs, granted
+	case <-svr.sigclose:
+		return nil, SUBSCRIBE_FAILURE
+	}
+}
+
+// Resubscribe updates the qos of an existing subscription, if the handler
+// grants it. It returns the granted qos.
+func (svr *Server) Resubscribe(ctx *Context, topic string, subs *Subscription, qos byte) byte {
+
+	if !svr.Alive() {
+		return SUBSCRIBE_FAILURE
 	}
-	if err == nil {
 
-		subs := NewSubscription(ctx, qos)
-		svr.subs <- SubscriptionChange{CREATE, subs, topic}
-		return subs
+	granted := svr.grant(ctx, topic, qos)
+	if granted == SUBSCRIBE_FAILURE {
+		return granted
+	}
+	select {
+	case svr.subs <- SubscriptionChange{UPDATE, subs, topic, granted}:
+		return granted
+	case <-svr.sigclose:
+		return SUBSCRIBE_FAILURE
 	}
-	return nil
 }
 
 func (svr *Server) Unsubscribe(subs *Subscription) {
@@ -97,7 +264,72 @@ func (svr *Server) Unsubscribe(subs *Subscription) {
 		return
 	}
 
-	svr.subs <- SubscriptionChange{REMOVE, subs, ""}
+	select {
+	case svr.subs <- SubscriptionChange{REMOVE, subs, "", 0}:
+	case <-svr.sigclose:
+	}
+}
+
+// do runs fn in the Run goroutine and waits for it to complete. fn is not
+// run if the server is closed.
+func (svr *Server) do(fn func()) {
+
+	done := make(chan struct{})
+	select {
+	case svr.exec <- func() {
+		fn()
+		close(done)
+	}:
+		<-done
+	case <-svr.sigclose:
+	}
+}
+
+// Retained returns all retained messages.
+func (svr *Server) Retained() (msgs []*Message) {
+
+	svr.do(func() {
+		svr.retained.Walk(func(topic string, retained []*Message) bool {
+			msgs = append(msgs, retained...)
+			return true
+		})
+	})
+	return msgs
+}
+
+// Retain stores msg as retained message of its topic without publishing it.
+// A message without payload clears the retained message of the topic.
+func (svr *Server) Retain(msg *Message) {
+
+	svr.do(func() {
+		svr.retain(msg)
+	})
+}
+
+// retain stores or clears a retained message in the Run goroutine. New
+// retained messages beyond Limits.MaxRetained are not stored.
+func (svr *Server) retain(msg *Message) {
+
+	old := svr.retained.Get(msg.Topic)
+	if len(old) != 0 {
+		svr.retained.Remove(msg.Topic, old[0])
+	}
+
+	if len(msg.Buf) == 0 {
+		if len(old) != 0 {
+			svr.Metrics.retained.Add(-1)
+		}
+		return
+	}
+
+	if len(old) == 0 {
+		if svr.Metrics.retained.Load() >= int64(svr.Limits.maxRetained()) {
+			svr.log().Warn("retained message dropped", "topic", msg.Topic, "err", ErrLimitExceeded)
+			return
+		}
+		svr.Metrics.retained.Add(1)
+	}
+	svr.retained.Insert(msg.Topic, msg)
 }
 
 func (svr *Server) Run() {
@@ -107,30 +339,42 @@ RUN:
 		select {
 		case <-svr.sigclose:
 
-			close(svr.subs)
-			close(svr.pub)
-
-			SYSALL := []string{"$SYS", "all"}
-			subs := svr.topics.Find(SYSALL)
-			for ; subs != nil; subs = subs.next {
+			// the channels are not closed: goroutines that send to them
+			// wait for sigclose too
+			for _, sub := range svr.subscriptions.Get("$SYS/all") {
 
-				subs.ctx.Close()
+				sub.ctx.Close()
 			}
 
-			svr.state = CLOSED
+			svr.state.Store(CLOSED)
 			break RUN
 
 		case evt := <-svr.subs:
 
 			switch evt.action {
 			case CREATE:
-				svr.topics.Subscribe(strings.Split(evt.topic, "/"), evt.subs)
+				evt.subs.filter = evt.topic
+				evt.subs.active = true
+				svr.subscriptions.Insert(evt.topic, evt.subs)
+				svr.Metrics.subscriptions.Add(1)
+
+				for _, msg := range svr.retained.Select(evt.topic) {
+					evt.subs.ctx.Publish(evt.subs, msg)
+				}
+
+			case UPDATE:
+				evt.subs.qos = evt.qos
 
 			case REMOVE:
-				evt.subs.Unsubscribe()
+				if evt.subs.active {
+					evt.subs.active = false
+					svr.subscriptions.Remove(evt.subs.filter, evt.subs)
+					svr.Metrics.subscriptions.Add(-1)
+				}
 			}
 
-			// log.Println("Topics:", svr.topics)
+		case fn := <-svr.exec:
+			fn()
 
 		case msg := <-svr.pub:
 
@@ -144,7 +388,14 @@ RUN:
 				// 	n = 30
 				// }
 				// log.Printf("Publish: %s %q", msg.topic, string(msg.buf[:n]))
-				svr.topics.Publish(strings.Split(msg.Topic, "/"), msg)
+				svr.subscriptions.MatchFunc(msg.Topic, func(sub *Subscription) {
+					sub.ctx.Publish(sub, msg)
+				})
+				svr.Metrics.publish(msg.QoS)
+
+				if msg.Retain {
+					svr.retain(msg)
+				}
 			}
 		}
 	}
@@ -152,22 +403,44 @@ RUN:
 
 func (svr *Server) Close() {
 
-	if svr.Alive() {
+	state := svr.state.Load()
+	if state != CLOSING && state != CLOSED && svr.state.CompareAndSwap(state, CLOSING) {
 
 		close(svr.sigclose)
-		svr.state = CLOSING
 		if svr.closer != nil {
 			svr.closer.Close()
 		}
 	}
 }
 
+// Serve serves one connection until it is closed.
 func (svr *Server) Serve(rwc io.ReadWriteCloser) {
 
+	svr.serve(rwc, nil)
+}
+
+// serve serves one connection of an endpoint, or of no endpoint if e is nil.
+func (svr *Server) serve(rwc io.ReadWriteCloser, e *Endpoint) {
+
 	// uconn := tools.Unblock(rwc)
 
 	ctx := NewContext(rwc, rwc, svr)
+	if conn, ok := rwc.(net.Conn); ok {
+		ctx.RemoteAddr = conn.RemoteAddr()
+	}
+	if e != nil {
+		ctx.endpoint = e
+		ctx.limits = svr.Limits.Override(e.limits)
+	}
 	defer ctx.Close()
+	defer ctx.recoverPanic()
+
+	ctx.conn = svr.Metrics.connectionsTotal.Add(1)
+	ctx.Tracer = svr.Tracer
+	svr.Metrics.connections.Add(1)
+	defer svr.Metrics.connections.Add(-1)
+
+	ctx.Log().Debug("connection opened")
 
 	// ctx.Subscribe("$SYS/all", 0)
 
@@ -182,6 +455,7 @@ func Join(conn net.Conn, server *Server) {
 
 	ctx := NewContext(uconn, uconn, server)
 	defer ctx.Close()
+	defer ctx.recoverPanic()
 
 	ctx.Subscribe("$SYS/all", 0)
 
@@ -190,6 +464,14 @@ func Join(conn net.Conn, server *Server) {
 	}
 }
 
+// ServeListener accepts connections on the listener and serves each of them
+// in a new goroutine. It returns when the listener fails or is closed.
+// Use an Endpoint to serve the listener with other limits.
+func (svr *Server) ServeListener(l net.Listener) error {
+
+	return svr.NewEndpoint(Limits{}).ServeListener(l)
+}
+
 func ListenAndServe(addr string, handler Handler) error {
 
 	tcp, err := net.Listen("tcp", addr)
@@ -200,17 +482,5 @@ func ListenAndServe(addr string, handler Handler) error {
 	server := NewServer(tcp, handler)
 	go server.Run()
 
-	for {
-
-		conn, err := tcp.Accept()
-		if err == nil {
-
-			go server.Serve(conn)
-		} else {
-
-			return err
-		}
-	}
-
-	return nil
+	return server.ServeListener(tcp)
 }
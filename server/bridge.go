@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/client"
+	"github.com/j-forster/mqtt/topics"
+)
+
+// A bridge forwards messages between this server and a remote broker.
+// It has two client connections: one to the remote broker, and one to this
+// server over an in-memory pipe, so that bridged messages pass the same auth,
+// ACLs and hooks as other clients.
+type bridge struct {
+	config BridgeConfig
+	server *mqtt.Server
+	log    mqtt.Logger
+	tls    *tls.Config
+
+	// messages forwarded to one side, so they are not sent back when they
+	// come in again through a subscription of the other direction
+	mu         sync.Mutex
+	localEcho  map[string]int
+	remoteEcho map[string]int
+}
+
+// forwarded messages are queued, as client.Options.OnMessage must not block
+type forward struct {
+	topic string
+	msg   *mqtt.Message
+}
+
+func newBridge(server *mqtt.Server, config BridgeConfig, log mqtt.Logger) (*bridge, error) {
+
+	b := &bridge{
+		config:     config,
+		server:     server,
+		log:        log,
+		localEcho:  make(map[string]int),
+		remoteEcho: make(map[string]int),
+	}
+	if b.config.Name == "" {
+		b.config.Name = config.Address
+	}
+
+	if config.CA != "" || config.Cert != "" {
+		b.tls = new(tls.Config)
+		if config.CA != "" {
+			pool, err := loadCA(config.CA)
+			if err != nil {
+				return nil, err
+			}
+			b.tls.RootCAs = pool
+		}
+		if config.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+			if err != nil {
+				return nil, err
+			}
+			b.tls.Certificates = []tls.Certificate{cert}
+		}
+	}
+	return b, nil
+}
+
+// run connects the bridge and reconnects with backoff until the server
+// is closed.
+func (b *bridge) run() {
+
+	backoff := time.Second
+	for b.server.Alive() {
+
+		start := time.Now()
+		err := b.connect()
+		if !b.server.Alive() {
+			return
+		}
+		b.log.Warn("bridge disconnected", "bridge", b.config.Name, "err", err)
+
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// connect runs one session of the bridge. It returns when one of the two
+// connections has been closed.
+func (b *bridge) connect() error {
+
+	toLocal := make(chan forward, 256)
+	toRemote := make(chan forward, 256)
+
+	remote, err := client.Dial(b.config.Address, &client.Options{
+		ClientID:     b.config.ClientID,
+		Username:     b.config.Username,
+		Password:     b.config.Password,
+		CleanSession: b.config.CleanSession,
+		KeepAlive:    b.config.KeepAlive,
+		TLSConfig:    b.tls,
+		OnMessage: func(msg *mqtt.Message) {
+			b.route(msg, "in", toLocal)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	conn, pipe := net.Pipe()
+	go b.server.Serve(pipe)
+
+	clientID := b.config.ClientID
+	if clientID == "" {
+		clientID = "bridge-" + b.config.Name
+	}
+	local, err := client.Connect(conn, &client.Options{
+		ClientID:     clientID,
+		Username:     b.config.LocalUsername,
+		Password:     b.config.LocalPassword,
+		CleanSession: true,
+		OnMessage: func(msg *mqtt.Message) {
+			b.route(msg, "out", toRemote)
+		},
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer local.Close()
+
+	for _, t := range b.config.Topics {
+		if t.Direction != "out" {
+			if _, err := remote.Subscribe(t.RemotePrefix+t.Filter, t.QoS); err != nil {
+				return err
+			}
+		}
+		if t.Direction != "in" {
+			if _, err := local.Subscribe(t.LocalPrefix+t.Filter, t.QoS); err != nil {
+				return err
+			}
+		}
+	}
+
+	b.log.Info("bridge connected", "bridge", b.config.Name, "address", b.config.Address)
+
+	for {
+		select {
+		case f := <-toLocal:
+			if b.subscribed("out", f.topic) {
+				b.echo(b.localEcho, f.topic, f.msg, 1)
+			}
+			if err := local.Publish(f.topic, f.msg.Buf, f.msg.QoS, f.msg.Retain); err != nil {
+				return err
+			}
+		case f := <-toRemote:
+			if b.subscribed("in", f.topic) {
+				b.echo(b.remoteEcho, f.topic, f.msg, 1)
+			}
+			if err := remote.Publish(f.topic, f.msg.Buf, f.msg.QoS, f.msg.Retain); err != nil {
+				return err
+			}
+		case <-remote.Done():
+			return remote.Err()
+		case <-local.Done():
+			return local.Err()
+		}
+	}
+}
+
+// route maps a message received from one side to the topic on the other side.
+func (b *bridge) route(msg *mqtt.Message, direction string, queue chan forward) {
+
+	// messages from the remote broker ("in") may have been sent there by us
+	echo := b.remoteEcho
+	if direction == "out" {
+		echo = b.localEcho
+	}
+	if b.echo(echo, msg.Topic, msg, -1) {
+		return
+	}
+
+	for _, t := range b.config.Topics {
+		if t.Direction != direction && t.Direction != "both" {
+			continue
+		}
+		from, to := t.RemotePrefix, t.LocalPrefix
+		if direction == "out" {
+			from, to = to, from
+		}
+		if !strings.HasPrefix(msg.Topic, from) {
+			continue
+		}
+		topic := strings.TrimPrefix(msg.Topic, from)
+		if !topics.MatchFilter(t.Filter, topic) {
+			continue
+		}
+
+		qos := msg.QoS
+		if t.QoS < qos {
+			qos = t.QoS
+		}
+		m := msg.Copy()
+		m.QoS = qos
+
+		select {
+		case queue <- forward{to + topic, m}:
+		default:
+			b.log.Warn("bridge queue full, message dropped", "bridge", b.config.Name, "topic", msg.Topic)
+		}
+		return
+	}
+}
+
+// subscribed reports whether the bridge subscribed to the topic for the
+// direction, on the side the messages of this direction come from.
+func (b *bridge) subscribed(direction, topic string) bool {
+
+	for _, t := range b.config.Topics {
+		if t.Direction != direction && t.Direction != "both" {
+			continue
+		}
+		prefix := t.RemotePrefix
+		if direction == "out" {
+			prefix = t.LocalPrefix
+		}
+		if topics.MatchFilter(prefix+t.Filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// echo counts messages sent to one side (delta 1), and reports whether an
+// incoming message has been sent by the bridge (delta -1).
+func (b *bridge) echo(echo map[string]int, topic string, msg *mqtt.Message, delta int) bool {
+
+	key := topic + "\x00" + string(msg.Buf)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := echo[key]
+	if delta < 0 && n == 0 {
+		return false
+	}
+	if delta > 0 && len(echo) > 10000 {
+		// messages that never came back, e.g. rejected by an ACL
+		clear(echo)
+	}
+	if n+delta == 0 {
+		delete(echo, key)
+	} else {
+		echo[key] = n + delta
+	}
+	return true
+}
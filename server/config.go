@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/j-forster/mqtt"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration file of the server command, see
+// mqtt.example.yaml for all settings.
+type Config struct {
+	Listeners     []ListenerConfig  `yaml:"listeners"`
+	Limits        LimitsConfig      `yaml:"limits"`
+	SessionExpiry time.Duration     `yaml:"session_expiry"`
+	Auth          AuthConfig        `yaml:"auth"`
+	ACL           ACLConfig         `yaml:"acl"`
+	Persistence   PersistenceConfig `yaml:"persistence"`
+	Bridges       []BridgeConfig    `yaml:"bridges"`
+	Log           LogConfig         `yaml:"log"`
+	Metrics       MetricsConfig     `yaml:"metrics"`
+	Admin         AdminConfig       `yaml:"admin"`
+}
+
+type ListenerConfig struct {
+	// Type is tcp, tls, ws, wss or unix.
+	Type string `yaml:"type"`
+	// Address is host:port, or the socket path for unix listeners.
+	Address string `yaml:"address"`
+	// Path of the WebSocket endpoint. Default: /mqtt
+	Path string `yaml:"path"`
+	// Cert and Key are the certificate files for tls and wss listeners.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// CA enables client certificates signed by this CA file.
+	CA string `yaml:"ca"`
+	// Limits override the server limits for clients of this listener.
+	Limits LimitsConfig `yaml:"limits"`
+}
+
+type LimitsConfig struct {
+	MaxMessageLength   int `yaml:"max_message_length"`
+	MaxClientIDLength  int `yaml:"max_client_id_length"`
+	MaxTopicLength     int `yaml:"max_topic_length"`
+	MaxTopicLevels     int `yaml:"max_topic_levels"`
+	MaxSubscriptions   int `yaml:"max_subscriptions"`
+	MaxInflight        int `yaml:"max_inflight"`
+	MaxAwaitingRelease int `yaml:"max_awaiting_release"`
+	MaxQueuedMessages  int `yaml:"max_queued_messages"`
+	MaxRetained        int `yaml:"max_retained"`
+	MaxConnections     int `yaml:"max_connections"`
+}
+
+func (c LimitsConfig) limits() mqtt.Limits {
+	return mqtt.Limits{
+		MaxMessageLength:   c.MaxMessageLength,
+		MaxClientIDLength:  c.MaxClientIDLength,
+		MaxTopicLength:     c.MaxTopicLength,
+		MaxTopicLevels:     c.MaxTopicLevels,
+		MaxSubscriptions:   c.MaxSubscriptions,
+		MaxInflight:        c.MaxInflight,
+		MaxAwaitingRelease: c.MaxAwaitingRelease,
+		MaxQueuedMessages:  c.MaxQueuedMessages,
+		MaxRetained:        c.MaxRetained,
+		MaxConnections:     c.MaxConnections,
+	}
+}
+
+type AuthConfig struct {
+	// Passwd is a password file, see mqttpasswd.
+	Passwd  string         `yaml:"passwd"`
+	JWT     *JWTConfig     `yaml:"jwt"`
+	Webhook *WebhookConfig `yaml:"webhook"`
+	// Watch is the interval to check the password file for changes.
+	// Default: 5s
+	Watch time.Duration `yaml:"watch"`
+	// ConnectTimeout and PublishTimeout limit asynchronous auth backends.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	PublishTimeout time.Duration `yaml:"publish_timeout"`
+}
+
+type JWTConfig struct {
+	Secret        string        `yaml:"secret"`
+	SecretFile    string        `yaml:"secret_file"`
+	JWKS          string        `yaml:"jwks"`
+	UsernameClaim string        `yaml:"username_claim"`
+	ACLClaim      string        `yaml:"acl_claim"`
+	Leeway        time.Duration `yaml:"leeway"`
+}
+
+type WebhookConfig struct {
+	ConnectURL   string        `yaml:"connect_url"`
+	PublishURL   string        `yaml:"publish_url"`
+	SubscribeURL string        `yaml:"subscribe_url"`
+	Timeout      time.Duration `yaml:"timeout"`
+	CacheTTL     time.Duration `yaml:"cache_ttl"`
+	FailOpen     bool          `yaml:"fail_open"`
+}
+
+type ACLConfig struct {
+	// File is the topic access control list, see package acl.
+	File string `yaml:"file"`
+	// Watch is the interval to check the file for changes. Default: 5s
+	Watch time.Duration `yaml:"watch"`
+}
+
+type PersistenceConfig struct {
+	// Retained is the file the retained messages are stored in.
+	Retained string `yaml:"retained"`
+	// Interval is the time between two saves. Default: 1m
+	Interval time.Duration `yaml:"interval"`
+}
+
+type BridgeConfig struct {
+	Name string `yaml:"name"`
+	// Address of the remote broker, like tls://example.com:8883.
+	Address      string        `yaml:"address"`
+	ClientID     string        `yaml:"client_id"`
+	Username     string        `yaml:"username"`
+	Password     string        `yaml:"password"`
+	CleanSession bool          `yaml:"clean_session"`
+	KeepAlive    time.Duration `yaml:"keepalive"`
+	// CA verifies the remote broker with this CA file instead of the system
+	// roots. Cert and Key are the client certificate, if needed.
+	CA   string `yaml:"ca"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// LocalUsername and LocalPassword are used to connect to this server.
+	LocalUsername string `yaml:"local_username"`
+	LocalPassword string `yaml:"local_password"`
+
+	Topics []BridgeTopic `yaml:"topics"`
+}
+
+type BridgeTopic struct {
+	Filter string `yaml:"filter"`
+	// Direction is out (to the remote broker), in (from the remote broker)
+	// or both.
+	Direction    string `yaml:"direction"`
+	QoS          byte   `yaml:"qos"`
+	LocalPrefix  string `yaml:"local_prefix"`
+	RemotePrefix string `yaml:"remote_prefix"`
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error. Default: info
+	Level string `yaml:"level"`
+	// Format is text or json. Default: text
+	Format string `yaml:"format"`
+	// File to log to. Default: stderr
+	File string `yaml:"file"`
+	// Packets logs every packet at debug level, see TraceFile to record
+	// the packets themselves.
+	Packets bool `yaml:"packets"`
+	// TraceFile records every packet to this file, see mqtt.TraceRecord
+	// for the format and mqttreplay to play a connection back.
+	TraceFile string `yaml:"trace_file"`
+	// TraceClients limits the TraceFile to the packets of these client ids.
+	TraceClients []string `yaml:"trace_clients"`
+}
+
+type MetricsConfig struct {
+	// Address to serve Prometheus metrics at, e.g. ':9100'.
+	Address string `yaml:"address"`
+}
+
+type AdminConfig struct {
+	// Address to serve the admin REST API at, e.g. 'localhost:9200'.
+	Address string `yaml:"address"`
+	// Token is the bearer token of the API, or read from TokenFile.
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// DefaultConfig is used without config file: a TCP listener on port 1883.
+func DefaultConfig() *Config {
+	return &Config{
+		Listeners: []ListenerConfig{{Type: "tcp", Address: ":1883"}},
+	}
+}
+
+// LoadConfig reads a YAML config file. Unknown settings are errors.
+func LoadConfig(path string) (*Config, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", "":
+	default:
+		return nil, fmt.Errorf("%s: only YAML config files are supported", path)
+	}
+
+	config := new(Config)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(config.Listeners) == 0 {
+		config.Listeners = DefaultConfig().Listeners
+	}
+	return config, nil
+}
+
+// Check reports the first invalid setting. Files are checked when they are
+// loaded.
+func (config *Config) Check() error {
+
+	for i, l := range config.Listeners {
+		switch l.Type {
+		case "tcp", "ws", "unix":
+		case "tls", "wss":
+			if l.Cert == "" || l.Key == "" {
+				return fmt.Errorf("listeners[%d]: %s listener needs cert and key", i, l.Type)
+			}
+		default:
+			return fmt.Errorf("listeners[%d]: unknown type %q", i, l.Type)
+		}
+		if l.Address == "" {
+			return fmt.Errorf("listeners[%d]: missing address", i)
+		}
+		if l.Limits.MaxRetained != 0 {
+			return fmt.Errorf("listeners[%d].limits: max_retained is a server limit", i)
+		}
+	}
+
+	switch config.Log.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log.level: unknown level %q", config.Log.Level)
+	}
+	switch config.Log.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("log.format: unknown format %q", config.Log.Format)
+	}
+	if len(config.Log.TraceClients) != 0 && config.Log.TraceFile == "" {
+		return errors.New("log.trace_clients: needs trace_file")
+	}
+
+	if config.Admin.Address != "" && config.Admin.Token == "" && config.Admin.TokenFile == "" {
+		return errors.New("admin: needs token or token_file")
+	}
+
+	if jwt := config.Auth.JWT; jwt != nil {
+		if jwt.Secret == "" && jwt.SecretFile == "" && jwt.JWKS == "" {
+			return errors.New("auth.jwt: needs secret, secret_file or jwks")
+		}
+	}
+
+	for i, b := range config.Bridges {
+		if b.Address == "" {
+			return fmt.Errorf("bridges[%d]: missing address", i)
+		}
+		if len(b.Topics) == 0 {
+			return fmt.Errorf("bridges[%d]: no topics", i)
+		}
+		for j, t := range b.Topics {
+			switch t.Direction {
+			case "in", "out", "both":
+			default:
+				return fmt.Errorf("bridges[%d].topics[%d]: unknown direction %q", i, j, t.Direction)
+			}
+			if t.Filter == "" || t.QoS > 2 {
+				return fmt.Errorf("bridges[%d].topics[%d]: invalid filter or qos", i, j)
+			}
+		}
+	}
+	return nil
+}
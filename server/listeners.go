@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/j-forster/mqtt"
+	"golang.org/x/net/websocket"
+)
+
+// listen opens the listener of a listener config. WebSocket listeners are
+// returned as plain listeners too, see serve.
+func listen(config ListenerConfig) (net.Listener, error) {
+
+	switch config.Type {
+	case "tcp", "ws":
+		return net.Listen("tcp", config.Address)
+
+	case "tls", "wss":
+		tlsConfig, err := serverTLS(config)
+		if err != nil {
+			return nil, err
+		}
+		return tls.Listen("tcp", config.Address, tlsConfig)
+
+	case "unix":
+		// remove the socket of a previous run
+		if fi, err := os.Stat(config.Address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(config.Address)
+		}
+		return net.Listen("unix", config.Address)
+	}
+	return nil, fmt.Errorf("unknown listener type %q", config.Type)
+}
+
+func serverTLS(config ListenerConfig) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.CA != "" {
+		pool, err := loadCA(config.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func loadCA(path string) (*x509.CertPool, error) {
+
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
+}
+
+// serve serves mqtt clients on the listener until it is closed.
+func serve(server *mqtt.Server, config ListenerConfig, l net.Listener) error {
+
+	endpoint := server.NewEndpoint(config.Limits.limits())
+	if config.Type != "ws" && config.Type != "wss" {
+		return endpoint.ServeListener(l)
+	}
+
+	path := config.Path
+	if path == "" {
+		path = "/mqtt"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, websocketHandler(endpoint))
+
+	err := http.Serve(l, mux)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// websocketHandler serves mqtt over WebSocket with binary frames.
+func websocketHandler(endpoint *mqtt.Endpoint) http.Handler {
+
+	return websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			// accept the mqtt subprotocols, and clients without subprotocol
+			for _, p := range config.Protocol {
+				if p == "mqtt" || p == "mqttv3.1" {
+					config.Protocol = []string{p}
+					return nil
+				}
+			}
+			config.Protocol = nil
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			remote, _ := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+			endpoint.Serve(wsConn{ws, remote})
+		},
+	}
+}
+
+// wsConn reports the address of the client as remote address,
+// not the origin of the WebSocket.
+type wsConn struct {
+	*websocket.Conn
+	remote *net.TCPAddr
+}
+
+func (c wsConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return nil
+	}
+	return c.remote
+}
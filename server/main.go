@@ -1,18 +1,33 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/j-forster/mqtt"
+	"github.com/j-forster/mqtt/acl"
+	"github.com/j-forster/mqtt/auth"
 	// "net/http"
 	//  _ "net/http/pprof"
 )
 
-type SimpleHandler struct{}
+type SimpleHandler struct {
+	logPackets bool
+}
 
 func (h *SimpleHandler) Connect(ctx *mqtt.Context, username, password string) error {
 
-	log.Printf("%v Connected: '%v' '%v'", ctx.ClientID, username, password)
+	log.Printf("%v Connected: '%v'", ctx.ClientID, username)
+	ctx.LogPackets = h.logPackets
 	return nil // no error == accept everyone
 }
 
@@ -35,7 +50,276 @@ func (h *SimpleHandler) Subscribe(ctx *mqtt.Context, topic string, qos byte) err
 
 func main() {
 
-	var handler SimpleHandler
-	log.Println("Up and running: Port 1883")
-	mqtt.ListenAndServe(":1883", &handler)
+	configFile := flag.String("config", "", "YAML config file, see mqtt.example.yaml")
+	checkConfig := flag.Bool("check-config", false, "check the config and all files it refers to, then exit")
+	listenAddr := flag.String("listen", "", "TCP address to listen at, replaces the listeners of the config file")
+	debug := flag.Bool("debug", false, "enable debug logs and packet tracing")
+	metrics := flag.String("metrics", "", "serve Prometheus metrics at this address, e.g. ':9100'")
+	aclFile := flag.String("acl", "", "topic access control list file")
+	passwdFile := flag.String("passwd", "", "password file, see mqttpasswd")
+	traceFile := flag.String("trace", "", "record the packets of all connections to this file, see mqttreplay")
+	flag.Parse()
+
+	config := DefaultConfig()
+	if *configFile != "" {
+		var err error
+		config, err = LoadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// flags override the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			config.Listeners = []ListenerConfig{{Type: "tcp", Address: *listenAddr}}
+		case "debug":
+			if *debug {
+				config.Log.Level = "debug"
+			}
+			config.Log.Packets = *debug
+		case "metrics":
+			config.Metrics.Address = *metrics
+		case "acl":
+			config.ACL.File = *aclFile
+		case "passwd":
+			config.Auth.Passwd = *passwdFile
+		case "trace":
+			config.Log.TraceFile = *traceFile
+		}
+	})
+
+	if err := config.Check(); err != nil {
+		log.Fatal(err)
+	}
+
+	logger, err := newLogger(config.Log)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	chain, err := newChain(config, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := mqtt.NewServer(nil, chain)
+	server.Logger = logger
+	server.SessionExpiry = config.SessionExpiry
+	server.Limits = config.Limits.limits()
+	if config.Auth.ConnectTimeout > 0 {
+		server.ConnectTimeout = config.Auth.ConnectTimeout
+	}
+	if config.Auth.PublishTimeout > 0 {
+		server.PublishTimeout = config.Auth.PublishTimeout
+	}
+	if path := config.Log.TraceFile; path != "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		server.Tracer = mqtt.NewTraceWriter(file, config.Log.TraceClients...)
+	}
+
+	adminToken := config.Admin.Token
+	if config.Admin.TokenFile != "" {
+		token, err := os.ReadFile(config.Admin.TokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		adminToken = strings.TrimSpace(string(token))
+	}
+
+	var bridges []*bridge
+	for _, c := range config.Bridges {
+		b, err := newBridge(server, c, logger)
+		if err != nil {
+			log.Fatalf("bridge %s: %v", c.Name, err)
+		}
+		bridges = append(bridges, b)
+	}
+
+	if *checkConfig {
+		// the addresses may be in use by a running server, so we only
+		// check the certificates
+		for _, c := range config.Listeners {
+			if c.Type == "tls" || c.Type == "wss" {
+				if _, err := serverTLS(c); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		fmt.Println("configuration ok")
+		return
+	}
+
+	listeners := make([]net.Listener, len(config.Listeners))
+	for i, c := range config.Listeners {
+		l, err := listen(c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners[i] = l
+	}
+
+	go server.Run()
+
+	if path := config.Persistence.Retained; path != "" {
+		n, err := loadRetained(server, path)
+		if err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+		logger.Info("retained messages loaded", "file", path, "count", n)
+
+		interval := config.Persistence.Interval
+		if interval == 0 {
+			interval = time.Minute
+		}
+		go func() {
+			for range time.Tick(interval) {
+				if _, err := saveRetained(server, path); err != nil {
+					logger.Error("saving retained messages failed", "file", path, "err", err)
+				}
+			}
+		}()
+	}
+
+	if config.Metrics.Address != "" {
+		go func() {
+			log.Fatal(server.ListenMetrics(config.Metrics.Address))
+		}()
+	}
+
+	if config.Admin.Address != "" {
+		go func() {
+			log.Fatal(server.ListenAdmin(config.Admin.Address, adminToken))
+		}()
+	}
+
+	for _, b := range bridges {
+		go b.run()
+	}
+
+	for i, l := range listeners {
+		go func(c ListenerConfig, l net.Listener) {
+			if err := serve(server, c, l); err != nil && server.Alive() {
+				log.Fatal(err)
+			}
+		}(config.Listeners[i], l)
+	}
+
+	log.Println("Up and running")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	if path := config.Persistence.Retained; path != "" {
+		n, err := saveRetained(server, path)
+		if err != nil {
+			logger.Error("saving retained messages failed", "file", path, "err", err)
+		} else {
+			logger.Info("retained messages saved", "file", path, "count", n)
+		}
+	}
+	server.Close()
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func newLogger(config LogConfig) (mqtt.Logger, error) {
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(config.Level))); err != nil && config.Level != "" {
+		return nil, err
+	}
+
+	var w io.Writer = os.Stderr
+	if config.File != "" {
+		file, err := os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+		log.SetOutput(file)
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	if config.Format == "json" {
+		return mqtt.SlogLogger(slog.New(slog.NewJSONHandler(w, options))), nil
+	}
+	return mqtt.SlogLogger(slog.New(slog.NewTextHandler(w, options))), nil
+}
+
+// newChain builds the handler from the auth and acl settings. All auth
+// backends must accept a client.
+func newChain(config *Config, logger mqtt.Logger) (*mqtt.Chain, error) {
+
+	chain := mqtt.NewChain()
+
+	watch := config.Auth.Watch
+	if watch == 0 {
+		watch = 5 * time.Second
+	}
+
+	if path := config.Auth.Passwd; path != "" {
+		passwd, err := auth.LoadPasswordFile(path)
+		if err != nil {
+			return nil, err
+		}
+		passwd.Watch(watch, logger)
+		chain.Use(passwd)
+	}
+
+	if c := config.Auth.JWT; c != nil {
+		jwt := &auth.JWT{
+			Secret:        []byte(c.Secret),
+			UsernameClaim: c.UsernameClaim,
+			ACLClaim:      c.ACLClaim,
+			Leeway:        c.Leeway,
+		}
+		if c.SecretFile != "" {
+			secret, err := os.ReadFile(c.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			jwt.Secret = []byte(strings.TrimSpace(string(secret)))
+		}
+		if c.JWKS != "" {
+			if err := jwt.LoadJWKS(c.JWKS); err != nil {
+				return nil, err
+			}
+		}
+		chain.Use(jwt)
+	}
+
+	if c := config.Auth.Webhook; c != nil {
+		chain.Use(&auth.Webhook{
+			ConnectURL:   c.ConnectURL,
+			PublishURL:   c.PublishURL,
+			SubscribeURL: c.SubscribeURL,
+			Timeout:      c.Timeout,
+			CacheTTL:     c.CacheTTL,
+			FailOpen:     c.FailOpen,
+		})
+	}
+
+	if path := config.ACL.File; path != "" {
+		rules, err := acl.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		watch := config.ACL.Watch
+		if watch == 0 {
+			watch = 5 * time.Second
+		}
+		rules.Watch(watch, logger)
+		chain.Use(rules)
+	}
+
+	chain.Use(&SimpleHandler{logPackets: config.Log.Packets})
+	return chain, nil
 }
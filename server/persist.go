@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/j-forster/mqtt"
+)
+
+// retained messages are stored as JSON lines:
+//
+//	{"topic":"a/b","qos":1,"payload":"aGVsbG8="}
+type retainedMessage struct {
+	Topic   string `json:"topic"`
+	QoS     byte   `json:"qos"`
+	Payload []byte `json:"payload"`
+}
+
+// loadRetained restores the retained messages saved by saveRetained.
+// A missing file is no error.
+func loadRetained(server *mqtt.Server, path string) (int, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer file.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<28)
+	for scanner.Scan() {
+		var m retainedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return n, err
+		}
+		if !mqtt.ValidTopic(m.Topic) || len(m.Payload) == 0 {
+			continue
+		}
+		server.Retain(&mqtt.Message{Topic: m.Topic, Buf: m.Payload, QoS: m.QoS, Retain: true})
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// saveRetained writes all retained messages to the file. The file is
+// replaced atomically.
+func saveRetained(server *mqtt.Server, path string) (int, error) {
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	msgs := server.Retained()
+	w := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(w)
+	for _, msg := range msgs {
+		encoder.Encode(retainedMessage{msg.Topic, msg.QoS, msg.Buf})
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return len(msgs), os.Rename(tmp.Name(), path)
+}
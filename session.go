@@ -0,0 +1,176 @@
+package mqtt
+
+import (
+	"time"
+)
+
+// a message waiting for an offline client
+type queued struct {
+	sub *Subscription
+	msg *Message
+}
+
+// storeSession keeps the subscriptions of a closed context, so that the client
+// can resume its session if it connects again without the clean session flag.
+// Messages for the client are queued meanwhile.
+func (svr *Server) storeSession(ctx *Context) {
+
+	svr.smu.Lock()
+	svr.sessions[ctx.ClientID] = ctx
+	if svr.SessionExpiry > 0 {
+		ctx.expiry = time.AfterFunc(svr.SessionExpiry, func() {
+			svr.expireSession(ctx)
+		})
+	}
+	svr.smu.Unlock()
+
+	ctx.Log().Debug("session stored", "subscriptions", len(ctx.subs))
+}
+
+// default time a new connection waits for the older connection of its
+// client id to close
+const defaultTakeoverTimeout = 5 * time.Second
+
+// takeover closes the previous connection of the client id of a new
+// connection: a client can be connected only once. The old connection is
+// closed by its own reading goroutine, like a lost connection, except that
+// its will is never published. Its session is stored as usual, and takeover
+// waits until it is, so that the new connection can resume it.
+//
+// The connection to take over is determined under cmu, so of concurrent
+// connections with the same client id the last one to connect wins, and
+// each waits for older connections only.
+//
+// If the old connection is not closed within TakeoverTimeout, for example
+// because Close of its transport does not unblock its Read, the new
+// connection goes on without its session. The old session is then dropped
+// when the old connection is closed at last.
+func (svr *Server) takeover(old *Context) {
+
+	old.Log().Info("connection taken over")
+	old.wmu.Lock()
+	old.takenOver = true
+	old.wmu.Unlock()
+
+	old.Kick()
+	var timeout <-chan time.Time
+	if svr.TakeoverTimeout > 0 {
+		timer := time.NewTimer(svr.TakeoverTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-old.closed:
+	case <-timeout:
+		old.Log().Warn("connection not closed after takeover", "timeout", svr.TakeoverTimeout)
+		old.wmu.Lock()
+		old.abandoned = true
+		old.wmu.Unlock()
+	}
+}
+
+// resumeSession moves the subscriptions of a stored session with the same
+// client id to the new context and sends the queued messages. It must be
+// called after the CONNACK has been sent.
+// With the clean session flag a stored session is discarded instead.
+func (svr *Server) resumeSession(ctx *Context) bool {
+
+	svr.smu.Lock()
+	old, ok := svr.sessions[ctx.ClientID]
+	if ok {
+		delete(svr.sessions, ctx.ClientID)
+		if old.expiry != nil {
+			old.expiry.Stop()
+		}
+	}
+	svr.smu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if ctx.CleanSession {
+		svr.discardSession(old)
+		ctx.Log().Debug("session discarded")
+		return false
+	}
+
+	ctx.subs = old.subs
+	var n int
+
+	// Subscription.ctx is used by the Run goroutine, so we move the
+	// subscriptions there. This also keeps the queued messages in order.
+	svr.do(func() {
+		for _, sub := range ctx.subs {
+			sub.ctx = ctx
+		}
+
+		old.wmu.Lock()
+		queue := old.queue
+		old.queue = nil
+		old.wmu.Unlock()
+
+		n = len(queue)
+		for _, q := range queue {
+			ctx.Publish(q.sub, q.msg)
+		}
+	})
+
+	ctx.Log().Info("session resumed", "subscriptions", len(ctx.subs), "queued", n)
+	svr.onSessionResumed(ctx)
+	return true
+}
+
+// expireSession removes a stored session and all its subscriptions.
+func (svr *Server) expireSession(ctx *Context) {
+
+	svr.smu.Lock()
+	if svr.sessions[ctx.ClientID] != ctx {
+		svr.smu.Unlock()
+		return // resumed meanwhile
+	}
+	delete(svr.sessions, ctx.ClientID)
+	svr.smu.Unlock()
+
+	svr.discardSession(ctx)
+	ctx.Log().Info("session expired")
+	svr.onSessionExpired(ctx.ClientID)
+}
+
+// discardSession removes the subscriptions of a stored session and drops
+// its queued messages.
+func (svr *Server) discardSession(ctx *Context) {
+
+	for _, sub := range ctx.subs {
+		svr.Unsubscribe(sub)
+	}
+
+	ctx.wmu.Lock()
+	queue := ctx.queue
+	ctx.queue = nil
+	ctx.wmu.Unlock()
+
+	for _, q := range queue {
+		svr.onDrop(ctx, q.msg, ErrClientOffline)
+	}
+}
+
+// enqueue stores a message for an offline client with a stored session.
+func (ctx *Context) enqueue(sub *Subscription, msg *Message) {
+
+	if !ctx.persistent || sub.qos == 0 || msg.QoS == 0 {
+		ctx.server.onDrop(ctx, msg, ErrClientOffline)
+		return
+	}
+
+	ctx.wmu.Lock()
+	full := len(ctx.queue) >= ctx.limits.maxQueuedMessages()
+	if !full {
+		ctx.queue = append(ctx.queue, queued{sub, msg})
+	}
+	ctx.wmu.Unlock()
+
+	if full {
+		ctx.server.onDrop(ctx, msg, ErrQueueFull)
+	}
+}
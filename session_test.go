@@ -0,0 +1,261 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connectAs encodes a CONNECT of the client id with the connect flags,
+// followed by the will topic and message if the flags have a will.
+func connectAs(id string, flags byte, will ...[]byte) []byte {
+	return encode(0x10, join(str("MQIsdp"), []byte{3, flags, 0, 60}, str(id), join(will...)))
+}
+
+// subscribe subscribes the connection to the filter and checks the SUBACK.
+func (c *testConn) subscribe(filter string, qos byte) {
+
+	c.write(encode(0x82, join([]byte{0, 1}, str(filter), []byte{qos})))
+	fh, buf, err := c.read()
+	if err != nil || fh.mtype != SUBACK || len(buf) != 3 || buf[2] != qos {
+		c.t.Fatalf("no SUBACK: %+v %x %v", fh, buf, err)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func TestTakeover(t *testing.T) {
+
+	server, routed := newTestServer(t, nil)
+
+	// persistent session with a will
+	const flags = 0x04 | 0x20 // will flag, will retain
+	for i := 0; i < 10; i++ {
+
+		id := fmt.Sprint("client", i)
+		old := dial(t, server)
+		old.write(connectAs(id, flags, str("will/"+id), str("gone")))
+		if code := old.connack(); code != ACCEPTED {
+			t.Fatalf("old connection: code %d", code)
+		}
+		old.subscribe("x/"+id, 1)
+
+		c := dial(t, server)
+		c.write(connectAs(id, 0))
+		if code := c.connack(); code != ACCEPTED {
+			t.Fatalf("new connection: code %d", code)
+		}
+		old.closed()
+
+		// the session has been handed over, the will has not been published
+		server.PublishLocal("x/"+id, []byte("hello"), 1, false)
+		if msg := <-routed; msg.Topic != "x/"+id {
+			t.Fatalf("routed %s", msg.Topic)
+		}
+		fh, buf, err := c.read()
+		if err != nil || fh.mtype != PUBLISH {
+			t.Fatalf("session not resumed: %+v %x %v", fh, buf, err)
+		}
+		notRouted(t, routed)
+		if n := len(server.connected(id)); n != 1 {
+			t.Fatalf("%d connections of %s", n, id)
+		}
+	}
+}
+
+func TestConcurrentTakeover(t *testing.T) {
+
+	const n = 8
+
+	// the connections of a round are accepted at the same time
+	var mu sync.Mutex
+	var barrier *sync.WaitGroup
+	server, _ := newTestServer(t, NewChain(ConnectFunc(func(ctx *Context, username, password string) error {
+		mu.Lock()
+		b := barrier
+		mu.Unlock()
+		b.Done()
+		b.Wait()
+		return nil
+	})))
+
+	for i := 0; i < 10; i++ {
+
+		id := fmt.Sprint("client", i)
+		mu.Lock()
+		barrier = new(sync.WaitGroup)
+		barrier.Add(n)
+		mu.Unlock()
+		results := make(chan error, n)
+		start := make(chan struct{})
+		for j := 0; j < n; j++ {
+			c := dial(t, server)
+			go func() {
+				// all but one connection are closed, older ones maybe
+				// before their CONNACK
+				fh, _, err := c.read()
+				if err == nil && fh.mtype == CONNACK {
+					fh, _, err = c.read()
+				}
+				switch {
+				case errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe):
+					results <- nil
+				case err == nil:
+					results <- fmt.Errorf("unexpected %s", messageType[fh.mtype])
+				default:
+					results <- err
+				}
+			}()
+			go func() {
+				<-start
+				c.conn.Write(connectAs(id, 0x02))
+			}()
+		}
+		close(start)
+
+		for j := 0; j < n-1; j++ {
+			select {
+			case err := <-results:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s: %d of %d connections closed", id, j, n-1)
+			}
+		}
+		select {
+		case err := <-results:
+			t.Fatalf("%s: all connections closed: %v", id, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if m := len(server.connected(id)); m != 1 {
+			t.Fatalf("%d connections of %s", m, id)
+		}
+	}
+}
+
+// stuckConn is a transport whose Close does not unblock Read.
+type stuckConn struct{ net.Conn }
+
+func (stuckConn) Close() error { return nil }
+
+func TestTakeoverTimeout(t *testing.T) {
+
+	server, _ := newTestServer(t, nil)
+	server.TakeoverTimeout = 50 * time.Millisecond
+
+	conn, pipe := net.Pipe()
+	go server.Serve(stuckConn{pipe})
+	defer conn.Close()
+	old := &testConn{t, conn, bufio.NewReader(conn)}
+	old.write(connectAs("client", 0))
+	if code := old.connack(); code != ACCEPTED {
+		t.Fatalf("old connection: code %d", code)
+	}
+	old.subscribe("x", 1)
+
+	c := dial(t, server)
+	c.write(connectAs("client", 0))
+	if code := c.connack(); code != ACCEPTED {
+		t.Fatalf("new connection: code %d", code)
+	}
+
+	// the old connection is closed at last, its session is dropped
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for len(server.connected("client")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections", len(server.connected("client")))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(server.Sessions()); n != 0 {
+		t.Fatalf("%d sessions stored", n)
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+
+	server, r := newHookServer(t)
+
+	c := dial(t, server)
+	c.write(connectAs("p", 0))
+	c.connack()
+	c.subscribe("a/#", 1)
+	c.write(encode(0xe0, nil))
+	c.closed()
+
+	// QoS 1 messages are queued for the stored session, QoS 0 are dropped
+	server.PublishLocal("a/1", []byte("x"), 1, false)
+	server.PublishLocal("a/2", []byte("x"), 0, false)
+	r.expect(t, "drop p a/2 "+ErrClientOffline.Error())
+
+	c = dial(t, server)
+	c.write(connectAs("p", 0))
+	c.connack()
+	topic, mid := c.publish()
+	if topic != "a/1" {
+		t.Fatalf("received %s", topic)
+	}
+	r.expect(t, "deliver p a/1 1")
+	r.expect(t, "resumed p")
+	c.write(encode(0x40, mid))
+	r.expect(t, "ack p a/1")
+
+	// the subscription is still there
+	server.PublishLocal("a/3", []byte("x"), 0, false)
+	if topic, _ := c.publish(); topic != "a/3" {
+		t.Fatalf("received %s", topic)
+	}
+	r.expect(t, "deliver p a/3 0")
+
+	// a clean session discards the stored session
+	c.write(encode(0xe0, nil))
+	c.closed()
+	server.PublishLocal("a/4", []byte("x"), 1, false)
+	c = dial(t, server)
+	c.write(connectAs("p", 0x02))
+	c.connack()
+	r.expect(t, "drop p a/4 "+ErrClientOffline.Error())
+	c.nothing()
+	r.none(t)
+	if n := len(server.Sessions()); n != 0 {
+		t.Fatalf("%d sessions", n)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+
+	server, r := newHookServer(t)
+	server.SessionExpiry = 100 * time.Millisecond
+
+	c := dial(t, server)
+	c.write(connectAs("p", 0))
+	c.connack()
+	c.subscribe("a/#", 1)
+	c.write(encode(0xe0, nil))
+	c.closed()
+	if n := len(server.Sessions()); n != 1 {
+		t.Fatalf("%d sessions", n)
+	}
+
+	server.PublishLocal("a/1", []byte("x"), 1, false)
+	r.expect(t, "drop p a/1 "+ErrClientOffline.Error())
+	r.expect(t, "expired p")
+	if n := len(server.Sessions()); n != 0 {
+		t.Fatalf("%d sessions", n)
+	}
+
+	// the subscriptions have been removed with the session
+	server.PublishLocal("a/2", []byte("x"), 1, false)
+	c = dial(t, server)
+	c.write(connectAs("p", 0))
+	c.connack()
+	c.nothing()
+	r.none(t)
+}
@@ -0,0 +1,216 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	connectPacket = encode(0x10, join(str("MQIsdp"), []byte{3, 0x02, 0, 60}, str("client")))
+	publishPacket = encode(0x30, join(str("a/b"), []byte("hello")))
+)
+
+// encode encodes an mqtt packet with the first header byte b0.
+func encode(b0 byte, body []byte) []byte {
+
+	head, b := Head(b0, len(body), len(body))
+	copy(b, body)
+	return head
+}
+
+// testConn is the client side of a connection to a server.
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, server *Server) *testConn {
+
+	conn, pipe := net.Pipe()
+	go server.Serve(pipe)
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t, conn, bufio.NewReader(conn)}
+}
+
+// write sends the packets in the background, as the server does not read
+// while it writes to the pipe.
+func (c *testConn) write(packets ...[]byte) {
+	go c.conn.Write(join(packets...))
+}
+
+// read returns the next packet from the server.
+func (c *testConn) read() (*FixedHeader, []byte, error) {
+
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	var fh FixedHeader
+	if err := fh.Read(c.r); err != nil {
+		return nil, nil, err
+	}
+	buf := make([]byte, fh.length)
+	_, err := io.ReadFull(c.r, buf)
+	return &fh, buf, err
+}
+
+// connack reads the CONNACK and returns its return code.
+func (c *testConn) connack() byte {
+
+	fh, buf, err := c.read()
+	if err != nil || fh.mtype != CONNACK || len(buf) != 2 {
+		c.t.Fatalf("no CONNACK: %+v %v", fh, err)
+	}
+	return buf[1]
+}
+
+// closed fails the test if the server does not close the connection.
+func (c *testConn) closed() {
+
+	fh, _, err := c.read()
+	if err == nil {
+		c.t.Fatalf("unexpected %s", messageType[fh.mtype])
+	}
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+		c.t.Fatalf("connection not closed: %v", err)
+	}
+}
+
+// newTestServer returns a running server and a channel with the messages
+// routed to subscribers.
+func newTestServer(t *testing.T, handler Handler) (*Server, chan *Message) {
+
+	server := NewServer(nil, handler)
+	go server.Run()
+	t.Cleanup(server.Close)
+
+	routed := make(chan *Message, 10)
+	if _, err := server.SubscribeFunc("#", 0, func(msg *Message) { routed <- msg }); err != nil {
+		t.Fatal(err)
+	}
+	return server, routed
+}
+
+func notRouted(t *testing.T, routed chan *Message) {
+
+	select {
+	case msg := <-routed:
+		t.Errorf("message %s routed", msg.Topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func TestConnected(t *testing.T) {
+
+	server, routed := newTestServer(t, nil)
+	c := dial(t, server)
+	c.write(connectPacket)
+	if code := c.connack(); code != ACCEPTED {
+		t.Fatalf("CONNACK %d", code)
+	}
+	c.write(publishPacket)
+
+	select {
+	case msg := <-routed:
+		if msg.Topic != "a/b" {
+			t.Errorf("routed %s", msg.Topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not routed")
+	}
+}
+
+func TestPacketBeforeConnect(t *testing.T) {
+
+	for name, p := range map[string][]byte{
+		"PUBLISH":   publishPacket,
+		"SUBSCRIBE": encode(0x82, join([]byte{0, 1}, str("x/#"), []byte{0})),
+		"PINGREQ":   encode(0xc0, nil),
+		"PUBREL":    encode(0x62, []byte{0, 1}),
+	} {
+		t.Run(name, func(t *testing.T) {
+
+			server, routed := newTestServer(t, nil)
+			c := dial(t, server)
+			c.write(p, connectPacket)
+			c.closed()
+			notRouted(t, routed)
+
+			if n := server.Metrics.subscriptions.Load(); n != 1 {
+				t.Errorf("%d subscriptions", n)
+			}
+		})
+	}
+}
+
+func TestSecondConnect(t *testing.T) {
+
+	var connects atomic.Int32
+	server, _ := newTestServer(t, NewChain(ConnectFunc(func(ctx *Context, username, password string) error {
+		connects.Add(1)
+		return nil
+	})))
+
+	c := dial(t, server)
+	c.write(connectPacket)
+	if code := c.connack(); code != ACCEPTED {
+		t.Fatalf("CONNACK %d", code)
+	}
+	c.write(connectPacket)
+	c.closed()
+
+	if n := connects.Load(); n != 1 {
+		t.Errorf("%d connects", n)
+	}
+}
+
+func TestServerPacketFromClient(t *testing.T) {
+
+	server, _ := newTestServer(t, nil)
+	c := dial(t, server)
+	c.write(connectPacket)
+	c.connack()
+	c.write(encode(0xd0, nil)) // PINGRESP
+	c.closed()
+}
+
+func TestRejectedConnect(t *testing.T) {
+
+	server, routed := newTestServer(t, NewChain(ConnectFunc(func(ctx *Context, username, password string) error {
+		return ErrNotAuthorized
+	})))
+
+	c := dial(t, server)
+	c.write(connectPacket, publishPacket)
+	if code := c.connack(); code != NOT_AUTHORIZED {
+		t.Errorf("CONNACK %d", code)
+	}
+	c.closed()
+	notRouted(t, routed)
+}
+
+// asyncReject rejects all clients after a delay.
+type asyncReject time.Duration
+
+func (h asyncReject) ConnectAsync(ctx *Context, username, password string, done func(error)) {
+	time.AfterFunc(time.Duration(h), func() { done(ErrNotAuthorized) })
+}
+
+func TestRejectedAsyncConnect(t *testing.T) {
+
+	server, routed := newTestServer(t, NewChain(asyncReject(20*time.Millisecond)))
+
+	// the PUBLISH is queued while the connect decision is pending
+	c := dial(t, server)
+	c.write(connectPacket, publishPacket, connectPacket)
+	if code := c.connack(); code != NOT_AUTHORIZED {
+		t.Errorf("CONNACK %d", code)
+	}
+	c.closed()
+	notRouted(t, routed)
+}
@@ -0,0 +1,42 @@
+package tools
+
+import (
+	"os"
+	"time"
+)
+
+// WatchFile checks the modification time of a file at the given interval
+// and calls changed whenever it differs from the last check.
+// Call the returned function to stop watching.
+func WatchFile(path string, interval time.Duration, changed func()) (stop func()) {
+
+	var mtime time.Time
+	if stat, err := os.Stat(path); err == nil {
+		mtime = stat.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			stat, err := os.Stat(path)
+			if err != nil || stat.ModTime().Equal(mtime) {
+				continue
+			}
+			mtime = stat.ModTime()
+			changed()
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
@@ -0,0 +1,308 @@
+// Package topics matches mqtt topics and topic filters.
+//
+// A Tree stores values by topic filter, like the subscriptions of a broker,
+// and finds the values of all filters that match a topic:
+//
+//	var subs topics.Tree[string]
+//	subs.Insert("sensors/+/temp", "alice")
+//	subs.Insert("sensors/#", "bob")
+//	subs.Match("sensors/1/temp") // [alice bob]
+//
+// A Tree can also store values by topic, like retained messages, and find
+// the values of all topics that match a filter with Select.
+//
+// As the specification asks for, the wildcards '+' and '#' at the first level
+// of a filter do not match topics starting with '$', e.g. '#' does not match
+// '$SYS/broker/uptime', but '$SYS/#' does.
+package topics
+
+import (
+	"sort"
+	"strings"
+)
+
+// ValidTopic reports whether the topic can be published to: it is not
+// empty and has no wildcards.
+func ValidTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// ValidFilter reports whether f is a valid topic filter: '+' and '#' must
+// fill a whole level and '#' must be the last level.
+func ValidFilter(f string) bool {
+
+	if f == "" || strings.Contains(f, "\x00") {
+		return false
+	}
+	levels := strings.Split(f, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) != 1 {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchFilter reports whether the topic matches the topic filter.
+func MatchFilter(filter, topic string) bool {
+	return MatchLevels(strings.Split(filter, "/"), strings.Split(topic, "/"))
+}
+
+// MatchLevels is MatchFilter for filters and topics split at '/'.
+func MatchLevels(filter, topic []string) bool {
+
+	for i, f := range filter {
+		if f == "#" {
+			return len(topic) <= i || Wildcard(i, topic[i])
+		}
+		if i == len(topic) {
+			return false
+		}
+		if f == "+" {
+			if !Wildcard(i, topic[i]) {
+				return false
+			}
+			continue
+		}
+		if f != topic[i] {
+			return false
+		}
+	}
+	return len(filter) == len(topic)
+}
+
+// Wildcard reports whether a wildcard at level i of a filter may match the
+// topic level: wildcards at the first level do not match levels starting
+// with '$'.
+func Wildcard(i int, level string) bool {
+	return i != 0 || !strings.HasPrefix(level, "$")
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Tree stores values by topic filter. A filter can have several values, and
+// a value can be stored at several filters. The zero value is an empty tree.
+// A Tree is not safe for concurrent use.
+type Tree[V comparable] struct {
+	root node[V]
+	len  int
+}
+
+type node[V comparable] struct {
+	children map[string]*node[V]
+	values   []V
+}
+
+// Len returns the number of values.
+func (t *Tree[V]) Len() int {
+	return t.len
+}
+
+// Insert adds the value to the filter. Filters are stored as they are, so
+// filters must be valid for Match and topics for Select.
+func (t *Tree[V]) Insert(filter string, value V) {
+
+	n := &t.root
+	for _, level := range strings.Split(filter, "/") {
+		c := n.children[level]
+		if c == nil {
+			if n.children == nil {
+				n.children = make(map[string]*node[V])
+			}
+			c = new(node[V])
+			n.children[level] = c
+		}
+		n = c
+	}
+	n.values = append(n.values, value)
+	t.len++
+}
+
+// Remove removes the value from the filter once. It reports whether the
+// value has been found.
+func (t *Tree[V]) Remove(filter string, value V) bool {
+
+	if t.root.remove(strings.Split(filter, "/"), value) {
+		t.len--
+		return true
+	}
+	return false
+}
+
+func (n *node[V]) remove(levels []string, value V) bool {
+
+	if len(levels) == 0 {
+		for i, v := range n.values {
+			if v == value {
+				n.values = append(n.values[:i], n.values[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+
+	c := n.children[levels[0]]
+	if c == nil || !c.remove(levels[1:], value) {
+		return false
+	}
+	if len(c.values) == 0 && len(c.children) == 0 {
+		delete(n.children, levels[0])
+	}
+	return true
+}
+
+// Get returns the values of exactly this filter.
+func (t *Tree[V]) Get(filter string) []V {
+
+	n := &t.root
+	for _, level := range strings.Split(filter, "/") {
+		if n = n.children[level]; n == nil {
+			return nil
+		}
+	}
+	return append([]V(nil), n.values...)
+}
+
+// Match returns the values of all filters that match the topic.
+func (t *Tree[V]) Match(topic string) []V {
+
+	var values []V
+	t.MatchFunc(topic, func(v V) {
+		values = append(values, v)
+	})
+	return values
+}
+
+// MatchFunc calls fn for the values of all filters that match the topic,
+// without allocating a slice. fn must not change the tree.
+func (t *Tree[V]) MatchFunc(topic string, fn func(V)) {
+	t.root.match(strings.Split(topic, "/"), 0, fn)
+}
+
+func (n *node[V]) match(levels []string, i int, fn func(V)) {
+
+	// 'a/#' also matches 'a'
+	if c := n.children["#"]; c != nil && (i == len(levels) || Wildcard(i, levels[i])) {
+		for _, v := range c.values {
+			fn(v)
+		}
+	}
+
+	if i == len(levels) {
+		for _, v := range n.values {
+			fn(v)
+		}
+		return
+	}
+
+	if c := n.children[levels[i]]; c != nil {
+		c.match(levels, i+1, fn)
+	}
+	if c := n.children["+"]; c != nil && Wildcard(i, levels[i]) {
+		c.match(levels, i+1, fn)
+	}
+}
+
+// Select returns the values of all topics that match the filter. It is the
+// reverse of Match, for trees that store values by topic.
+func (t *Tree[V]) Select(filter string) []V {
+
+	var values []V
+	t.root.selectFilter(strings.Split(filter, "/"), 0, func(v V) {
+		values = append(values, v)
+	})
+	return values
+}
+
+func (n *node[V]) selectFilter(filter []string, i int, fn func(V)) {
+
+	if i == len(filter) {
+		for _, v := range n.values {
+			fn(v)
+		}
+		return
+	}
+
+	switch f := filter[i]; f {
+	case "#":
+		// 'a/#' also matches 'a'
+		if i != 0 {
+			for _, v := range n.values {
+				fn(v)
+			}
+		}
+		for level, c := range n.children {
+			if Wildcard(i, level) {
+				c.all(fn)
+			}
+		}
+	case "+":
+		for level, c := range n.children {
+			if Wildcard(i, level) {
+				c.selectFilter(filter, i+1, fn)
+			}
+		}
+	default:
+		if c := n.children[f]; c != nil {
+			c.selectFilter(filter, i+1, fn)
+		}
+	}
+}
+
+func (n *node[V]) all(fn func(V)) {
+
+	for _, v := range n.values {
+		fn(v)
+	}
+	for _, c := range n.children {
+		c.all(fn)
+	}
+}
+
+// Filters returns all filters with values, sorted.
+func (t *Tree[V]) Filters() []string {
+
+	var filters []string
+	t.Walk(func(filter string, values []V) bool {
+		filters = append(filters, filter)
+		return true
+	})
+	return filters
+}
+
+// Walk calls fn for all filters with values, in sorted order, until fn
+// returns false. fn must not change the tree or the values.
+func (t *Tree[V]) Walk(fn func(filter string, values []V) bool) {
+
+	for _, level := range t.root.sorted() {
+		if !t.root.children[level].walk(level, fn) {
+			return
+		}
+	}
+}
+
+func (n *node[V]) walk(filter string, fn func(filter string, values []V) bool) bool {
+
+	if len(n.values) != 0 && !fn(filter, n.values) {
+		return false
+	}
+	for _, level := range n.sorted() {
+		if !n.children[level].walk(filter+"/"+level, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *node[V]) sorted() []string {
+
+	levels := make([]string, 0, len(n.children))
+	for level := range n.children {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	return levels
+}
@@ -0,0 +1,191 @@
+package topics
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+var matchTests = []struct {
+	filter, topic string
+	match         bool
+}{
+	{"a/b", "a/b", true},
+	{"a/b", "a/c", false},
+	{"a/b", "a/b/c", false},
+	{"a/b/c", "a/b", false},
+	{"a/+", "a/b", true},
+	{"a/+", "a/b/c", false},
+	{"a/+/c", "a/b/c", true},
+	{"+/+", "a/b", true},
+	{"+", "a", true},
+	{"+", "a/b", false},
+	{"a/#", "a", true},
+	{"a/#", "a/b", true},
+	{"a/#", "a/b/c", true},
+	{"a/#", "b", false},
+	{"#", "a/b/c", true},
+	{"a/+/#", "a/b", true},
+	{"a/", "a/", true},
+	{"a/+", "a/", true},
+	{"/a", "/a", true},
+	{"+/a", "/a", true},
+
+	// wildcards at the first level do not match '$' topics
+	{"#", "$SYS/uptime", false},
+	{"+/uptime", "$SYS/uptime", false},
+	{"$SYS/#", "$SYS/uptime", true},
+	{"$SYS/+", "$SYS/uptime", true},
+	{"a/#", "a/$b", true},
+	{"a/+", "a/$b", true},
+}
+
+func TestMatchFilter(t *testing.T) {
+
+	for _, test := range matchTests {
+		if got := MatchFilter(test.filter, test.topic); got != test.match {
+			t.Errorf("MatchFilter(%q, %q) = %v", test.filter, test.topic, got)
+		}
+	}
+}
+
+func TestTreeMatch(t *testing.T) {
+
+	// the tree must agree with MatchFilter
+	var tree Tree[string]
+	for _, test := range matchTests {
+		if tree.Get(test.filter) == nil {
+			tree.Insert(test.filter, test.filter)
+		}
+	}
+
+	for _, test := range matchTests {
+		var want []string
+		for _, f := range tree.Filters() {
+			if MatchFilter(f, test.topic) {
+				want = append(want, f)
+			}
+		}
+		sort.Strings(want)
+		got := tree.Match(test.topic)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Match(%q) = %v, want %v", test.topic, got, want)
+		}
+	}
+}
+
+func TestTreeSelect(t *testing.T) {
+
+	var tree Tree[string]
+	topics := make(map[string]bool)
+	for _, test := range matchTests {
+		if !topics[test.topic] {
+			tree.Insert(test.topic, test.topic)
+			topics[test.topic] = true
+		}
+	}
+
+	for _, test := range matchTests {
+		var want []string
+		for topic := range topics {
+			if MatchFilter(test.filter, topic) {
+				want = append(want, topic)
+			}
+		}
+		sort.Strings(want)
+
+		got := tree.Select(test.filter)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Select(%q) = %v, want %v", test.filter, got, want)
+		}
+	}
+}
+
+func TestTreeRemove(t *testing.T) {
+
+	var tree Tree[int]
+	tree.Insert("a/+/c", 1)
+	tree.Insert("a/+/c", 2)
+	tree.Insert("a/+/c", 1)
+	tree.Insert("a/#", 3)
+	tree.Insert("x", 4)
+
+	if tree.Len() != 5 {
+		t.Errorf("Len = %d", tree.Len())
+	}
+	if got := tree.Get("a/+/c"); !reflect.DeepEqual(got, []int{1, 2, 1}) {
+		t.Errorf("Get = %v", got)
+	}
+
+	if !tree.Remove("a/+/c", 1) || !tree.Remove("a/+/c", 1) {
+		t.Error("Remove failed")
+	}
+	if tree.Remove("a/+/c", 1) || tree.Remove("a/b/c", 2) || tree.Remove("a/+", 2) {
+		t.Error("removed a value that is not there")
+	}
+	if got := tree.Match("a/b/c"); !reflect.DeepEqual(sorted(got), []int{2, 3}) {
+		t.Errorf("Match = %v", got)
+	}
+
+	tree.Remove("a/+/c", 2)
+	tree.Remove("a/#", 3)
+	tree.Remove("x", 4)
+	if tree.Len() != 0 || len(tree.root.children) != 0 {
+		t.Errorf("tree not empty: %d values, %d children", tree.Len(), len(tree.root.children))
+	}
+}
+
+func TestTreeWalk(t *testing.T) {
+
+	var tree Tree[int]
+	for i, f := range []string{"b", "a/#", "a/b", "a", "a/b"} {
+		tree.Insert(f, i)
+	}
+
+	var walked []string
+	tree.Walk(func(filter string, values []int) bool {
+		walked = append(walked, fmt.Sprintf("%s %v", filter, values))
+		return true
+	})
+	want := []string{"a [3]", "a/# [1]", "a/b [2 4]", "b [0]"}
+	if !reflect.DeepEqual(walked, want) {
+		t.Errorf("Walk = %v, want %v", walked, want)
+	}
+
+	var n int
+	tree.Walk(func(string, []int) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Walk did not stop: %d calls", n)
+	}
+}
+
+func TestValid(t *testing.T) {
+
+	for f, ok := range map[string]bool{
+		"a/b": true, "a/+": true, "+": true, "#": true, "a/#": true, "+/+/#": true,
+		"": false, "a/#/b": false, "a+": false, "a/b#": false, "a\x00": false,
+	} {
+		if ValidFilter(f) != ok {
+			t.Errorf("ValidFilter(%q) = %v", f, !ok)
+		}
+	}
+	for topic, ok := range map[string]bool{
+		"a/b": true, "$SYS/a": true, "/": true,
+		"": false, "a/+": false, "#": false,
+	} {
+		if ValidTopic(topic) != ok {
+			t.Errorf("ValidTopic(%q) = %v", topic, !ok)
+		}
+	}
+}
+
+func sorted(v []int) []int {
+	sort.Ints(v)
+	return v
+}
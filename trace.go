@@ -0,0 +1,203 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction tells whether a traced packet has been received from or sent to
+// the client.
+type Direction byte
+
+const (
+	TraceIn  Direction = iota // received from the client
+	TraceOut                  // sent to the client
+)
+
+func (dir Direction) String() string {
+
+	if dir == TraceOut {
+		return "out"
+	}
+	return "in"
+}
+
+// A Tracer records the packets of client connections exactly as they crossed
+// the wire, e.g. to debug device firmware. Set Server.Tracer to trace all
+// connections, or Context.Tracer in the Connect handler to trace one client.
+//
+// Trace is called with every complete packet, including the fixed header.
+// Received packets are traced before they are handled, sent packets before
+// they are written. Trace is called from many goroutines, and must not keep
+// or modify the packet.
+type Tracer interface {
+	Trace(ctx *Context, dir Direction, packet []byte)
+}
+
+// ErrInvalidTrace is the error for trace lines that cannot be parsed.
+var ErrInvalidTrace = errors.New("invalid trace record")
+
+///////////////////////////////////////////////////////////////////////////////
+
+// TraceRecord is one traced packet. Its text format is a line of four fields,
+// separated by a space:
+//
+//	2026-10-19T08:15:02.123456789Z 12 in 100f00064d5149736470030200 ...
+//
+// The time of the packet in RFC 3339 format with nanoseconds, the number of
+// the connection (counted from 1 since the server started), the direction
+// (in: received from the client, out: sent to the client) and the packet,
+// including the fixed header, in hex. Empty lines and lines starting with #
+// are comments.
+type TraceRecord struct {
+	Time   time.Time
+	Conn   int64
+	Dir    Direction
+	Packet []byte
+}
+
+func (r *TraceRecord) String() string {
+
+	return fmt.Sprintf("%s %d %s %x",
+		r.Time.UTC().Format(time.RFC3339Nano), r.Conn, r.Dir, r.Packet)
+}
+
+// ParseTraceRecord parses a line in the text format of TraceRecord.
+func ParseTraceRecord(line string) (*TraceRecord, error) {
+
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return nil, ErrInvalidTrace
+	}
+
+	var r TraceRecord
+	var err error
+	if r.Time, err = time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTrace, err)
+	}
+	if r.Conn, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTrace, err)
+	}
+	switch fields[2] {
+	case "in":
+		r.Dir = TraceIn
+	case "out":
+		r.Dir = TraceOut
+	default:
+		return nil, fmt.Errorf("%w: unknown direction %q", ErrInvalidTrace, fields[2])
+	}
+	if r.Packet, err = hex.DecodeString(fields[3]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTrace, err)
+	}
+	return &r, nil
+}
+
+// ClientID returns the client id of a CONNECT packet received from the
+// client, or "" for other or malformed packets.
+func (r *TraceRecord) ClientID() string {
+
+	if r.Dir != TraceIn || len(r.Packet) == 0 || r.Packet[0]>>4 != CONNECT {
+		return ""
+	}
+
+	// skip the fixed header
+	i := 1
+	for i < len(r.Packet) && i < 5 && r.Packet[i]&0x80 != 0 {
+		i++
+	}
+	buf := r.Packet[min(i+1, len(r.Packet)):]
+
+	// protocol name, level, flags and keep alive
+	l, _ := readString(buf)
+	if l == 0 || len(buf) < l+4 {
+		return ""
+	}
+	_, id := readString(buf[l+4:])
+	return id
+}
+
+// TraceReader reads the records of a trace file.
+type TraceReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewTraceReader(r io.Reader) *TraceReader {
+
+	scanner := bufio.NewScanner(r)
+	// a packet of the maximum length takes twice as many hex digits
+	scanner.Buffer(nil, 2*0x10000000+100)
+	return &TraceReader{scanner: scanner}
+}
+
+// Next returns the next record, or io.EOF at the end of the trace.
+func (tr *TraceReader) Next() (*TraceRecord, error) {
+
+	for tr.scanner.Scan() {
+		tr.line++
+		line := strings.TrimSpace(tr.scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r, err := ParseTraceRecord(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", tr.line, err)
+		}
+		return r, nil
+	}
+	if err := tr.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// TraceWriter is a Tracer that writes the packets as TraceRecord lines.
+// Write errors are ignored.
+type TraceWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	clients map[string]bool
+}
+
+// NewTraceWriter returns a Tracer that writes to w. With client ids it traces
+// the connections of these clients only.
+func NewTraceWriter(w io.Writer, clients ...string) *TraceWriter {
+
+	tw := &TraceWriter{w: w}
+	if len(clients) != 0 {
+		tw.clients = make(map[string]bool, len(clients))
+		for _, id := range clients {
+			tw.clients[id] = true
+		}
+	}
+	return tw
+}
+
+func (tw *TraceWriter) Trace(ctx *Context, dir Direction, packet []byte) {
+
+	r := TraceRecord{Conn: ctx.conn, Dir: dir, Packet: packet}
+	if tw.clients != nil {
+		// the client id is not known before the CONNECT has been handled
+		id := ctx.ClientID
+		if connect := r.ClientID(); connect != "" {
+			id = connect
+		}
+		if !tw.clients[id] {
+			return
+		}
+	}
+
+	tw.mu.Lock()
+	r.Time = time.Now()
+	io.WriteString(tw.w, r.String()+"\n")
+	tw.mu.Unlock()
+}
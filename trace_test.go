@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceRecord(t *testing.T) {
+
+	r := TraceRecord{
+		Time:   time.Date(2026, 10, 19, 8, 15, 2, 123456789, time.UTC),
+		Conn:   12,
+		Dir:    TraceOut,
+		Packet: []byte{0x20, 0x02, 0x00, 0x00},
+	}
+	line := r.String()
+	if line != "2026-10-19T08:15:02.123456789Z 12 out 20020000" {
+		t.Fatalf("record %q", line)
+	}
+
+	parsed, err := ParseTraceRecord(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Time.Equal(r.Time) || parsed.Conn != r.Conn || parsed.Dir != r.Dir || !bytes.Equal(parsed.Packet, r.Packet) {
+		t.Fatalf("parsed %+v", parsed)
+	}
+
+	for _, line := range []string{
+		"",
+		"2026-10-19T08:15:02Z 1 in",
+		"yesterday 1 in c000",
+		"2026-10-19T08:15:02Z x in c000",
+		"2026-10-19T08:15:02Z 1 up c000",
+		"2026-10-19T08:15:02Z 1 in c00",
+	} {
+		if _, err := ParseTraceRecord(line); !errors.Is(err, ErrInvalidTrace) {
+			t.Errorf("%q: %v", line, err)
+		}
+	}
+}
+
+func TestTraceReader(t *testing.T) {
+
+	tr := NewTraceReader(strings.NewReader(
+		"# comment\n\n2026-10-19T08:15:02Z 1 in c000\n2026-10-19T08:15:03Z 1 out d000\nbroken\n"))
+
+	for _, dir := range []Direction{TraceIn, TraceOut} {
+		r, err := tr.Next()
+		if err != nil || r.Dir != dir {
+			t.Fatalf("%+v %v", r, err)
+		}
+	}
+	if _, err := tr.Next(); !errors.Is(err, ErrInvalidTrace) || !strings.Contains(err.Error(), "line 5") {
+		t.Fatalf("broken line: %v", err)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("end: %v", err)
+	}
+}
+
+func TestTraceWriter(t *testing.T) {
+
+	var buf bytes.Buffer
+	tracer := NewTraceWriter(&buf, "client")
+	server, routed := newTestServer(t, nil)
+	server.Tracer = tracer
+
+	// the remaining length of the PUBLISH is not in its shortest form
+	publish := join([]byte{0x30, 0x8a, 0x00}, str("a/b"), []byte("hello"))
+
+	c := dial(t, server)
+	c.write(connectPacket, publish)
+	c.connack()
+	<-routed
+
+	other := dial(t, server)
+	other.write(encode(0x10, join(str("MQIsdp"), []byte{3, 0x02, 0, 60}, str("other"))))
+	other.connack()
+
+	c.write(encode(0xc0, nil))
+	c.read()
+
+	tracer.mu.Lock()
+	trace := buf.String()
+	tracer.mu.Unlock()
+
+	tr := NewTraceReader(strings.NewReader(trace))
+	var records []*TraceRecord
+	for {
+		r, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+
+	want := []struct {
+		dir    Direction
+		packet []byte
+	}{
+		{TraceIn, connectPacket},
+		{TraceOut, []byte{0x20, 0x02, 0x00, 0x00}},
+		{TraceIn, publish},
+		{TraceIn, []byte{0xc0, 0x00}},
+		{TraceOut, []byte{0xd0, 0x00}},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("trace:\n%s", trace)
+	}
+	for i, r := range records {
+		if r.Dir != want[i].dir || !bytes.Equal(r.Packet, want[i].packet) || r.Conn != records[0].Conn {
+			t.Errorf("record %d: %s", i, r)
+		}
+	}
+}